@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+)
+
+const (
+	// basicAuthCacheSize bounds the number of cached authentications
+	basicAuthCacheSize = 10000
+	// basicAuthCacheExpiration is how long a successful authentication is
+	// reused, so that the directory isn't searched on every request
+	basicAuthCacheExpiration = time.Minute
+)
+
+// basicAuthCache keeps the sessions of the basic auth credentials that were
+// accepted by the directory recently. The credentials are keyed by their
+// HMAC with a key of the process, so the passwords can't be guessed from
+// the memory of the proxy faster than from the directory.
+type basicAuthCache struct {
+	key []byte
+
+	mu      sync.Mutex
+	entries map[string]basicAuthCacheEntry
+}
+
+type basicAuthCacheEntry struct {
+	session *sessionsapi.SessionState
+	expires time.Time
+}
+
+func newBasicAuthCache() *basicAuthCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &basicAuthCache{
+		key:     key,
+		entries: make(map[string]basicAuthCacheEntry),
+	}
+}
+
+func (c *basicAuthCache) hash(user, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get returns a copy of the session of the credentials, or nil if they
+// weren't accepted recently
+func (c *basicAuthCache) Get(user, password string) *sessionsapi.SessionState {
+	key := c.hash(user, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	session := *entry.session
+	return &session
+}
+
+// Add caches the session of accepted credentials, making room by dropping
+// the expired entries or else an arbitrary one
+func (c *basicAuthCache) Add(user, password string, session *sessionsapi.SessionState) {
+	key := c.hash(user, password)
+	now := time.Now()
+	cached := *session
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= basicAuthCacheSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= basicAuthCacheSize {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = basicAuthCacheEntry{session: &cached, expires: now.Add(basicAuthCacheExpiration)}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+)
+
+// strippedRequestHeaders are identity headers that are always removed from
+// client requests, regardless of which headers are set for the upstream
+var strippedRequestHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Access-Token",
+	"GAP-Auth",
+	SignatureHeader,
+}
+
+// identityHeader is a header that is added to upstream requests or
+// auth_request responses. Its value is rendered from the user's session.
+type identityHeader struct {
+	name  string
+	value *template.Template
+}
+
+// headerData is passed to identity header templates. It exposes the session
+// fields, eg: {{.User}} or {{.Groups}}, and the Claim method.
+type headerData struct {
+	*sessionsapi.SessionState
+}
+
+// Claim returns the value of a session claim. Lists are joined with commas
+// and missing claims render as an empty string.
+func (d headerData) Claim(name string) string {
+	switch v := d.Claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ",")
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// headerFuncs returns the functions available in identity header templates
+func headerFuncs(basicAuthPassword string) template.FuncMap {
+	return template.FuncMap{
+		"join": func(sep string, values []string) string {
+			return strings.Join(values, sep)
+		},
+		"basicAuth": func(user string) string {
+			return "Basic " + b64.StdEncoding.EncodeToString([]byte(user+":"+basicAuthPassword))
+		},
+	}
+}
+
+// newIdentityHeader parses a header spec in the form of "Name=template"
+func newIdentityHeader(spec string, funcs template.FuncMap) (identityHeader, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return identityHeader{}, fmt.Errorf("invalid header spec %q: expected name=template", spec)
+	}
+	name := strings.TrimSpace(parts[0])
+	if name == "" || strings.ContainsAny(name, " \t:") {
+		return identityHeader{}, fmt.Errorf("invalid header name %q", name)
+	}
+	value, err := template.New(name).Funcs(funcs).Parse(parts[1])
+	if err != nil {
+		return identityHeader{}, fmt.Errorf("invalid template for header %q: %v", name, err)
+	}
+	return identityHeader{name: http.CanonicalHeaderKey(name), value: value}, nil
+}
+
+// presetRequestHeaders returns the header specs enabled by the pass-*
+// options. They are applied before any configured request headers.
+func presetRequestHeaders(o *Options) []string {
+	var specs []string
+	if o.PassBasicAuth {
+		specs = append(specs,
+			"X-Forwarded-User={{.User}}",
+			"X-Forwarded-Email={{.Email}}",
+			"Authorization={{basicAuth .User}}",
+		)
+	}
+	if o.PassUserHeaders {
+		specs = append(specs,
+			"X-Forwarded-User={{.User}}",
+			"X-Forwarded-Email={{.Email}}",
+		)
+	}
+	if o.PassAccessToken {
+		specs = append(specs, "X-Forwarded-Access-Token={{.AccessToken}}")
+	}
+	if o.PassAuthorization {
+		specs = append(specs, "Authorization={{if .IDToken}}Bearer {{.IDToken}}{{end}}")
+	}
+	return specs
+}
+
+// presetResponseHeaders returns the header specs enabled by the set-*
+// options. They are applied before any configured response headers.
+func presetResponseHeaders(o *Options) []string {
+	var specs []string
+	if o.SetXAuthRequest {
+		specs = append(specs,
+			"X-Auth-Request-User={{.User}}",
+			"X-Auth-Request-Email={{.Email}}",
+		)
+		if o.PassAccessToken {
+			specs = append(specs, "X-Auth-Request-Access-Token={{.AccessToken}}")
+		}
+	}
+	if o.SetAuthorization {
+		specs = append(specs, "Authorization={{if .IDToken}}Bearer {{.IDToken}}{{end}}")
+	}
+	return specs
+}
+
+// headersUseTokens reports whether any of the header specs renders one of
+// the session tokens, which are only kept in the session with a cipher
+func headersUseTokens(specs []string) bool {
+	for _, spec := range specs {
+		for _, field := range []string{".AccessToken", ".IDToken", ".RefreshToken"} {
+			if strings.Contains(spec, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setIdentityHeaders renders the headers from the session into h. Headers
+// that render to an empty value are removed.
+func setIdentityHeaders(h http.Header, headers []identityHeader, session *sessionsapi.SessionState) {
+	data := headerData{SessionState: session}
+	for _, header := range headers {
+		var value bytes.Buffer
+		if err := header.value.Execute(&value, data); err != nil {
+			logger.Printf("error rendering header %s: %v", header.name, err)
+			h.Del(header.name)
+			continue
+		}
+		if value.Len() == 0 {
+			h.Del(header.name)
+			continue
+		}
+		h.Set(header.name, value.String())
+	}
+}
+
+// normalizeHeaderName maps header names that upstreams may treat as equal,
+// eg: "X-Forwarded-User" and "x_forwarded_user", to the same value
+func normalizeHeaderName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+// newStrippedHeaders builds the set of normalized header names to remove from
+// client requests. It holds the always stripped headers, the injected request
+// headers and any extra headers. Authorization is never stripped as it carries
+// the client's own credentials.
+func newStrippedHeaders(injected []identityHeader, extra []string) map[string]struct{} {
+	stripped := make(map[string]struct{})
+	for _, name := range strippedRequestHeaders {
+		stripped[normalizeHeaderName(name)] = struct{}{}
+	}
+	for _, header := range injected {
+		stripped[normalizeHeaderName(header.name)] = struct{}{}
+	}
+	for _, name := range extra {
+		stripped[normalizeHeaderName(name)] = struct{}{}
+	}
+	delete(stripped, "authorization")
+	return stripped
+}
+
+// stripHeaders removes every header in the stripped set from h
+func stripHeaders(h http.Header, stripped map[string]struct{}) {
+	for name := range h {
+		if _, ok := stripped[normalizeHeaderName(name)]; ok {
+			delete(h, name)
+		}
+	}
+}
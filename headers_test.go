@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIdentityHeader(t *testing.T) {
+	funcs := headerFuncs("")
+
+	header, err := newIdentityHeader("x-remote-user={{.User}}", funcs)
+	assert.NoError(t, err)
+	assert.Equal(t, "X-Remote-User", header.name)
+
+	// only the first = separates the name from the template
+	_, err = newIdentityHeader(`X-Tenant={{if eq (.Claim "tid") "a=b"}}x{{end}}`, funcs)
+	assert.NoError(t, err)
+
+	_, err = newIdentityHeader("X-Remote-User", funcs)
+	assert.Error(t, err)
+	_, err = newIdentityHeader("=.User", funcs)
+	assert.Error(t, err)
+	_, err = newIdentityHeader("X Remote=.User", funcs)
+	assert.Error(t, err)
+	_, err = newIdentityHeader("X-Remote-User={{.User", funcs)
+	assert.Error(t, err)
+}
+
+func TestSetIdentityHeaders(t *testing.T) {
+	funcs := headerFuncs("secret")
+	var headers []identityHeader
+	for _, spec := range []string{
+		"X-Remote-User={{.User}}",
+		`X-Remote-Groups={{join "," .Groups}}`,
+		`X-Tenant-Id={{.Claim "tid"}}`,
+		`X-Roles={{.Claim "roles"}}`,
+		`X-Missing={{.Claim "missing"}}`,
+		"X-Forwarded-Email={{.Email}}",
+		"Authorization={{basicAuth .User}}",
+	} {
+		header, err := newIdentityHeader(spec, funcs)
+		assert.NoError(t, err)
+		headers = append(headers, header)
+	}
+
+	session := &sessions.SessionState{
+		User:   "jdoe",
+		Groups: []string{"admins", "devs"},
+		Claims: map[string]interface{}{
+			"tid":   "tenant-1",
+			"roles": []interface{}{"reader", "writer"},
+		},
+	}
+	h := http.Header{}
+	h.Set("X-Forwarded-Email", "spoofed@example.com")
+	h.Set("X-Missing", "spoofed")
+	setIdentityHeaders(h, headers, session)
+
+	assert.Equal(t, "jdoe", h.Get("X-Remote-User"))
+	assert.Equal(t, "admins,devs", h.Get("X-Remote-Groups"))
+	assert.Equal(t, "tenant-1", h.Get("X-Tenant-Id"))
+	assert.Equal(t, "reader,writer", h.Get("X-Roles"))
+	assert.Equal(t, "Basic amRvZTpzZWNyZXQ=", h.Get("Authorization"))
+	// headers that render empty are removed
+	assert.NotContains(t, h, "X-Missing")
+	assert.NotContains(t, h, "X-Forwarded-Email")
+}
+
+func TestPresetHeaders(t *testing.T) {
+	o := NewOptions()
+	o.PassBasicAuth = false
+	o.PassUserHeaders = false
+	assert.Empty(t, presetRequestHeaders(o))
+	assert.Empty(t, presetResponseHeaders(o))
+
+	o.PassAccessToken = true
+	o.PassAuthorization = true
+	o.SetXAuthRequest = true
+	assert.Equal(t, []string{
+		"X-Forwarded-Access-Token={{.AccessToken}}",
+		"Authorization={{if .IDToken}}Bearer {{.IDToken}}{{end}}",
+	}, presetRequestHeaders(o))
+	assert.Equal(t, []string{
+		"X-Auth-Request-User={{.User}}",
+		"X-Auth-Request-Email={{.Email}}",
+		"X-Auth-Request-Access-Token={{.AccessToken}}",
+	}, presetResponseHeaders(o))
+}
+
+func TestStripHeaders(t *testing.T) {
+	header, err := newIdentityHeader("X-Remote-User={{.User}}", headerFuncs(""))
+	assert.NoError(t, err)
+	authorization, err := newIdentityHeader("Authorization={{basicAuth .User}}", headerFuncs(""))
+	assert.NoError(t, err)
+	stripped := newStrippedHeaders([]identityHeader{header, authorization}, []string{"x-extra"})
+
+	h := http.Header{
+		"X-Forwarded-User":  {"spoofed"},
+		"x_forwarded_email": {"spoofed"},
+		"Gap-Signature":     {"spoofed"},
+		"X-Remote-User":     {"spoofed"},
+		"X_remote_user":     {"spoofed"},
+		"X-Extra":           {"spoofed"},
+		"Authorization":     {"Basic Zm9vOmJhcg=="},
+		"Accept":            {"*/*"},
+	}
+	stripHeaders(h, stripped)
+
+	assert.Equal(t, http.Header{
+		"Authorization": {"Basic Zm9vOmJhcg=="},
+		"Accept":        {"*/*"},
+	}, h)
+}
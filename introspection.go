@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
+)
+
+const (
+	// introspectionCacheSize bounds the number of cached introspection results
+	introspectionCacheSize = 10000
+	// introspectionCacheExpiration is how long the results of tokens without
+	// an expiry are cached, and those of tokens that aren't accepted
+	introspectionCacheExpiration = time.Minute
+)
+
+// errTokenInactive is returned for tokens the authorization server doesn't
+// consider active: unknown, expired or revoked ones
+var errTokenInactive = errors.New("token is not active")
+
+// b64TokenRegex matches the bearer tokens of RFC 6750 section 2.1
+var b64TokenRegex = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+
+// tokenIntrospector checks opaque bearer tokens with the introspection
+// endpoint of the authorization server (RFC 7662). Accepted tokens are cached
+// until they expire, so each token is only introspected once. Concurrent
+// lookups of a token wait for the first.
+type tokenIntrospector struct {
+	url          *url.URL
+	clientID     string
+	clientSecret string
+	// audiences holds the accepted audiences, the token has to be issued
+	// for one of them. All of the scopes have to be granted to the token.
+	audiences []string
+	scopes    []string
+	// timeout bounds a lookup, which is shared by the requests with the token
+	timeout time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]introspectionResult
+	pending map[string]*introspectionCall
+}
+
+// introspectionResult is the outcome of checking a token, valid until expires
+type introspectionResult struct {
+	session *sessionsapi.SessionState
+	err     error
+	expires time.Time
+}
+
+// introspectionCall is a lookup of a token in flight
+type introspectionCall struct {
+	done   chan struct{}
+	result introspectionResult
+	err    error
+}
+
+// introspectionResponse is the response of the introspection endpoint
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope"`
+	Username  string   `json:"username"`
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email"`
+	Audience  audience `json:"aud"`
+	Expiry    float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+}
+
+// audience is either a single string or a list of strings in JSON
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func newTokenIntrospector(u *url.URL, clientID, clientSecret string, audiences, scopes []string, timeout time.Duration) *tokenIntrospector {
+	return &tokenIntrospector{
+		timeout:      timeout,
+		url:          u,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		audiences:    audiences,
+		scopes:       scopes,
+		cache:        make(map[string]introspectionResult),
+		pending:      make(map[string]*introspectionCall),
+	}
+}
+
+// findOpaqueBearerToken returns the token of a Bearer authorization header,
+// or "" if there is none
+func findOpaqueBearerToken(req *http.Request) string {
+	s := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") || !b64TokenRegex.MatchString(s[1]) {
+		return ""
+	}
+	return s[1]
+}
+
+// Introspect returns a session for an active token that is valid for the
+// configured audiences and scopes
+func (t *tokenIntrospector) Introspect(ctx context.Context, token string) (*sessionsapi.SessionState, error) {
+	// Only a hash of the token is kept in memory
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	t.mu.Lock()
+	result, ok := t.cache[key]
+	if !ok || !time.Now().Before(result.expires) {
+		call, inFlight := t.pending[key]
+		if !inFlight {
+			call = &introspectionCall{done: make(chan struct{})}
+			t.pending[key] = call
+			go t.lookup(call, key, token)
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		result = call.result
+	} else {
+		t.mu.Unlock()
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+	session := *result.session
+	return &session, nil
+}
+
+// lookup introspects the token for the requests waiting on the call. It
+// isn't bound to any of them, so a request giving up doesn't fail the
+// others.
+func (t *tokenIntrospector) lookup(call *introspectionCall, key, token string) {
+	ctx := context.Background()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	call.result, call.err = t.introspect(ctx, key, token)
+	close(call.done)
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+}
+
+// introspect requests the introspection of the token and caches the result.
+// Accepted tokens are cached until they expire. Tokens without an expiry may
+// be revoked any time, and the results of tokens that aren't accepted are
+// cached briefly too, so that made up tokens aren't introspected on every
+// request.
+func (t *tokenIntrospector) introspect(ctx context.Context, key, token string) (introspectionResult, error) {
+	now := time.Now()
+	r, err := t.request(ctx, token)
+	if err != nil {
+		return introspectionResult{}, fmt.Errorf("error introspecting token: %v", err)
+	}
+
+	var result introspectionResult
+	result.session, result.err = t.newSession(token, r, now)
+	result.expires = now.Add(introspectionCacheExpiration)
+	if result.err == nil && r.Expiry > 0 {
+		result.expires = unixTime(r.Expiry)
+	}
+	t.store(key, result, now)
+	return result, nil
+}
+
+// request posts the token to the introspection endpoint, authenticated with
+// the client credentials
+func (t *tokenIntrospector) request(ctx context.Context, token string) (*introspectionResponse, error) {
+	params := url.Values{}
+	params.Set("token", token)
+	params.Set("token_type_hint", "access_token")
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// The credentials are form encoded first, RFC 6749 section 2.3.1
+	req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+
+	var r introspectionResponse
+	if err := requests.RequestJSON(req, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// newSession checks the introspected token and builds its session
+func (t *tokenIntrospector) newSession(token string, r *introspectionResponse, now time.Time) (*sessionsapi.SessionState, error) {
+	if !r.Active {
+		return nil, errTokenInactive
+	}
+	if r.Expiry > 0 && !now.Before(unixTime(r.Expiry)) {
+		return nil, fmt.Errorf("token expired at %s", unixTime(r.Expiry))
+	}
+	if r.NotBefore > 0 && now.Before(unixTime(r.NotBefore)) {
+		return nil, fmt.Errorf("token is not valid before %s", unixTime(r.NotBefore))
+	}
+	if !t.validAudience(r.Audience) {
+		return nil, fmt.Errorf("token audience %q is not accepted", []string(r.Audience))
+	}
+	granted := make(map[string]bool)
+	for _, scope := range strings.Fields(r.Scope) {
+		granted[scope] = true
+	}
+	for _, scope := range t.scopes {
+		if !granted[scope] {
+			return nil, fmt.Errorf("token is missing scope %q", scope)
+		}
+	}
+
+	session := &sessionsapi.SessionState{
+		AccessToken: token,
+		CreatedAt:   now,
+		Email:       r.Email,
+		User:        r.Username,
+	}
+	if session.Email == "" {
+		session.Email = r.Subject
+	}
+	if session.User == "" {
+		session.User = r.Subject
+	}
+	if r.Expiry > 0 {
+		session.ExpiresOn = unixTime(r.Expiry)
+	}
+	return session, nil
+}
+
+func (t *tokenIntrospector) validAudience(aud audience) bool {
+	for _, a := range aud {
+		for _, accepted := range t.audiences {
+			if a == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// store caches a result, making room by dropping the expired results or else
+// an arbitrary one
+func (t *tokenIntrospector) store(key string, result introspectionResult, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.cache) >= introspectionCacheSize {
+		for k, r := range t.cache {
+			if !now.Before(r.expires) {
+				delete(t.cache, k)
+			}
+		}
+	}
+	if len(t.cache) >= introspectionCacheSize {
+		for k := range t.cache {
+			delete(t.cache, k)
+			break
+		}
+	}
+	t.cache[key] = result
+}
+
+// unixTime converts the seconds since the epoch of the JSON numbers
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// introspectionServer answers for the tokens it knows, to the proxy's client
+type introspectionServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	tokens   map[string]map[string]interface{}
+	requests map[string]int
+	// delay holds up the responses
+	delay time.Duration
+}
+
+func newIntrospectionServer(t *testing.T) *introspectionServer {
+	exp := time.Now().Add(time.Hour).Unix()
+	s := &introspectionServer{
+		tokens: map[string]map[string]interface{}{
+			"valid-token": {
+				"active": true, "scope": "openid api:read", "aud": "dlgkj", "exp": exp,
+				"sub": "248289761001", "username": "john.doe", "email": "john.doe@example.com",
+			},
+			"other-audience": {"active": true, "scope": "api:read", "aud": []string{"other", "api"}, "exp": exp, "sub": "248289761001"},
+			"no-scope":       {"active": true, "aud": []string{"dlgkj"}, "exp": exp, "sub": "248289761001"},
+			"expired":        {"active": true, "scope": "api:read", "aud": "dlgkj", "exp": time.Now().Add(-time.Minute).Unix(), "sub": "248289761001"},
+			"no-expiry":      {"active": true, "scope": "api:read", "aud": "dlgkj", "sub": "client-credentials"},
+			"revoked":        {"active": false},
+		},
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if req.Method != "POST" || !ok || user != "dlgkj" || password != "alkgret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := req.PostFormValue("token")
+		s.mu.Lock()
+		s.requests[token]++
+		s.mu.Unlock()
+		time.Sleep(s.delay)
+		claims, ok := s.tokens[token]
+		if !ok {
+			claims = map[string]interface{}{"active": false}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(claims)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *introspectionServer) requestCount(token string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[token]
+}
+
+func newIntrospectionTestProxy(t *testing.T, s *introspectionServer, modifiers ...OptionsModifier) *OAuthProxy {
+	return newLoginStateTestProxy(t, append([]OptionsModifier{func(opts *Options) {
+		opts.IntrospectionURL = s.URL
+		opts.IntrospectionScopes = []string{"api:read"}
+	}}, modifiers...)...)
+}
+
+func authWithToken(proxy *OAuthProxy, token string) int {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	proxy.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	s := newIntrospectionServer(t)
+	proxy := newIntrospectionTestProxy(t, s)
+
+	req, _ := http.NewRequest("GET", "/private", nil)
+	req.Header.Set("Authorization", "Bearer valid-token")
+	session, err := proxy.GetIntrospectedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "valid-token", session.AccessToken)
+	assert.Equal(t, "john.doe", session.User)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpiresOn, 5*time.Second)
+
+	// The subject stands in for the username and email
+	req.Header.Set("Authorization", "Bearer no-expiry")
+	session, err = proxy.GetIntrospectedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "client-credentials", session.User)
+	assert.Equal(t, "client-credentials", session.Email)
+
+	assert.Equal(t, http.StatusAccepted, authWithToken(proxy, "valid-token"))
+	for _, token := range []string{"other-audience", "no-scope", "expired", "revoked", "unknown"} {
+		assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, token), token)
+	}
+
+	// Requests without a bearer token aren't introspected
+	req.Header.Set("Authorization", "Basic am9objpzZWNyZXQ=")
+	session, err = proxy.GetIntrospectedSession(req)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestTokenIntrospectionCache(t *testing.T) {
+	s := newIntrospectionServer(t)
+	proxy := newIntrospectionTestProxy(t, s)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusAccepted, authWithToken(proxy, "valid-token"))
+		assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "no-scope"))
+		assert.Equal(t, http.StatusAccepted, authWithToken(proxy, "no-expiry"))
+		assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "revoked"))
+	}
+	// Results are cached until the token expires, or briefly for tokens
+	// without an expiry and those that aren't accepted
+	assert.Equal(t, 1, s.requestCount("valid-token"))
+	assert.Equal(t, 1, s.requestCount("no-scope"))
+	assert.Equal(t, 1, s.requestCount("no-expiry"))
+	assert.Equal(t, 1, s.requestCount("revoked"))
+
+	// Results are looked up again once they expire
+	proxy.tokenIntrospector.mu.Lock()
+	for key, result := range proxy.tokenIntrospector.cache {
+		if result.err != nil {
+			result.expires = time.Now()
+			proxy.tokenIntrospector.cache[key] = result
+		}
+	}
+	proxy.tokenIntrospector.mu.Unlock()
+	assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "revoked"))
+	assert.Equal(t, 2, s.requestCount("revoked"))
+	assert.Equal(t, http.StatusAccepted, authWithToken(proxy, "valid-token"))
+	assert.Equal(t, 1, s.requestCount("valid-token"))
+
+	// Sessions handed out don't change the cached one
+	req, _ := http.NewRequest("GET", "/private", nil)
+	req.Header.Set("Authorization", "Bearer valid-token")
+	session, err := proxy.GetIntrospectedSession(req)
+	assert.NoError(t, err)
+	session.Email = "mallory@example.com"
+	session, err = proxy.GetIntrospectedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+}
+
+func TestTokenIntrospectionConcurrent(t *testing.T) {
+	s := newIntrospectionServer(t)
+	s.delay = 100 * time.Millisecond
+	proxy := newIntrospectionTestProxy(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "made-up-token"))
+		}()
+	}
+	wg.Wait()
+	// Lookups of the same token wait for the first
+	assert.Equal(t, 1, s.requestCount("made-up-token"))
+}
+
+func TestTokenIntrospectionCanceled(t *testing.T) {
+	s := newIntrospectionServer(t)
+	s.delay = 100 * time.Millisecond
+	proxy := newIntrospectionTestProxy(t, s)
+
+	// The first request gives up before the lookup it started is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := proxy.tokenIntrospector.Introspect(ctx, "valid-token")
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	// The requests waiting for it still get its result
+	session, err := proxy.tokenIntrospector.Introspect(context.Background(), "valid-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+	assert.Equal(t, 1, s.requestCount("valid-token"))
+}
+
+func TestTokenIntrospectionAudience(t *testing.T) {
+	s := newIntrospectionServer(t)
+	proxy := newIntrospectionTestProxy(t, s, func(opts *Options) {
+		opts.IntrospectionAudiences = []string{"api"}
+	})
+	assert.Equal(t, http.StatusAccepted, authWithToken(proxy, "other-audience"))
+	assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "valid-token"))
+}
+
+func TestTokenIntrospectionClientCredentials(t *testing.T) {
+	s := newIntrospectionServer(t)
+	proxy := newIntrospectionTestProxy(t, s, func(opts *Options) {
+		opts.IntrospectionClientID = "resource-server"
+		opts.IntrospectionClientSecret = "secret"
+		opts.IntrospectionAudiences = []string{"dlgkj"}
+	})
+	// The server doesn't know these credentials
+	assert.Equal(t, http.StatusUnauthorized, authWithToken(proxy, "valid-token"))
+	assert.Equal(t, 0, s.requestCount("valid-token"))
+}
+
+func TestTokenIntrospectionOptions(t *testing.T) {
+	o := testOptions()
+	o.IntrospectionURL = "/introspect"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"invalid setting: token-introspection-url=\"/introspect\" must be an absolute http(s) url"}), err.Error())
+
+	o.IntrospectionURL = "https://auth.example.com/introspect"
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, o.ClientID, o.tokenIntrospector.clientID)
+	assert.Equal(t, []string{o.ClientID}, o.tokenIntrospector.audiences)
+
+	o.IntrospectionClientID = "resource-server"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"missing setting: token-introspection-client-secret"}), err.Error())
+}
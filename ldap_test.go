@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/ldap"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDirectory knows john.doe, jane.roe, from another email domain, and
+// no.mail, without an email address, with the password "secret", and fails to
+// reach the server for "unreachable"
+type testDirectory struct{}
+
+func (testDirectory) Authenticate(ctx context.Context, username, password string) (*ldap.User, error) {
+	switch {
+	case username == "unreachable":
+		return nil, errors.New("connection refused")
+	case username == "no.mail" && password == "secret":
+		return &ldap.User{DN: "uid=no.mail,ou=people,dc=example,dc=com"}, nil
+	case username == "jane.roe" && password == "secret":
+		return &ldap.User{DN: "uid=jane.roe,ou=people,dc=example,dc=com", Email: "jane.roe@example.org"}, nil
+	case username != "john.doe" || password != "secret":
+		return nil, ldap.ErrInvalidCredentials
+	}
+	return &ldap.User{
+		DN:     "uid=john.doe,ou=people,dc=example,dc=com",
+		Email:  "john.doe@example.com",
+		Groups: []string{"cn=admins,ou=groups,dc=example,dc=com"},
+	}, nil
+}
+
+// countingDirectory counts the authentications reaching the directory
+type countingDirectory struct {
+	userDirectory
+	calls int
+}
+
+func (d *countingDirectory) Authenticate(ctx context.Context, username, password string) (*ldap.User, error) {
+	d.calls++
+	return d.userDirectory.Authenticate(ctx, username, password)
+}
+
+func newLDAPTestProxy(t *testing.T) *OAuthProxy {
+	proxy := newLoginStateTestProxy(t)
+	proxy.ldapDirectory = testDirectory{}
+	proxy.DisplayHtpasswdForm = true
+	proxy.Validator = NewValidator([]string{"example.com"}, "")
+	return proxy
+}
+
+func TestLDAPSignIn(t *testing.T) {
+	proxy := newLDAPTestProxy(t)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `name="password"`)
+
+	signIn := func(username, password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}, "rd": {"/private"}}
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw = signIn("john.doe", "secret")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/private", rw.Header().Get("Location"))
+	req, _ = http.NewRequest("GET", "/private", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	session, err := proxy.LoadCookiedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe", session.User)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=com"}, session.Groups)
+
+	// The session is accepted by the following requests
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/auth", nil)
+	for _, c := range signIn("john.doe", "secret").Result().Cookies() {
+		req.AddCookie(c)
+	}
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	for _, username := range []string{"nobody", "unreachable", "jane.roe", "no.mail"} {
+		rw = signIn(username, "secret")
+		assert.Equal(t, 200, rw.Code, username)
+		assert.Empty(t, rw.Result().Cookies(), username)
+	}
+	rw = signIn("john.doe", "wrong")
+	assert.Equal(t, 200, rw.Code)
+	assert.Empty(t, rw.Result().Cookies())
+}
+
+func TestLDAPBasicAuth(t *testing.T) {
+	proxy := newLDAPTestProxy(t)
+
+	req, _ := http.NewRequest("GET", "/private", nil)
+	req.SetBasicAuth("john.doe", "secret")
+	session, err := proxy.CheckBasicAuth(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe", session.User)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=com"}, session.Groups)
+
+	req.SetBasicAuth("john.doe", "wrong")
+	session, err = proxy.CheckBasicAuth(req)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+
+	// Users need an email address passing the email validation
+	for _, username := range []string{"jane.roe", "no.mail"} {
+		req.SetBasicAuth(username, "secret")
+		session, err = proxy.CheckBasicAuth(req)
+		assert.NoError(t, err)
+		assert.Nil(t, session, username)
+	}
+}
+
+func TestLDAPBasicAuthCache(t *testing.T) {
+	proxy := newLDAPTestProxy(t)
+	directory := &countingDirectory{userDirectory: testDirectory{}}
+	proxy.ldapDirectory = directory
+
+	req, _ := http.NewRequest("GET", "/private", nil)
+	req.SetBasicAuth("john.doe", "secret")
+	for i := 0; i < 3; i++ {
+		session, err := proxy.CheckBasicAuth(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "john.doe@example.com", session.Email)
+	}
+	assert.Equal(t, 1, directory.calls)
+
+	// Only accepted credentials are cached
+	req.SetBasicAuth("john.doe", "wrong")
+	for i := 0; i < 2; i++ {
+		session, err := proxy.CheckBasicAuth(req)
+		assert.NoError(t, err)
+		assert.Nil(t, session)
+	}
+	assert.Equal(t, 3, directory.calls)
+
+	// The directory is asked again once the cached session expires
+	for key, entry := range proxy.basicAuthCache.entries {
+		entry.expires = time.Now()
+		proxy.basicAuthCache.entries[key] = entry
+	}
+	req.SetBasicAuth("john.doe", "secret")
+	session, err := proxy.CheckBasicAuth(req)
+	assert.NoError(t, err)
+	assert.NotNil(t, session)
+	assert.Equal(t, 4, directory.calls)
+}
+
+func TestLDAPOptions(t *testing.T) {
+	o := testOptions()
+	o.LDAPURL = "ldaps://ldap.example.com"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"missing setting: ldap-base-dn"}), err.Error())
+
+	o.LDAPBaseDN = "ou=people,dc=example,dc=com"
+	assert.NoError(t, o.Validate())
+	assert.NotNil(t, o.ldapDirectory)
+
+	o.LDAPStartTLS = true
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"invalid ldap settings: StartTLS can't be used with ldaps://"}), err.Error())
+
+	o.LDAPStartTLS = false
+	o.LDAPUserFilter = "(uid=jdoe)"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"invalid ldap settings: user filter \"(uid=jdoe)\" doesn't contain {username}"}), err.Error())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errLoginExpired is returned for the state of a login that took longer than
+// the maximum login duration
+var errLoginExpired = errors.New("login expired")
+
+// loginState is passed through the provider in the state parameter of a
+// login. It is encrypted and authenticated, so the provider and its logs
+// learn nothing about it and it can't be tampered with.
+type loginState struct {
+	// Nonce is also the value of the CSRF cookie of the login
+	Nonce        string `json:"n"`
+	Redirect     string `json:"r,omitempty"`
+	ProviderID   string `json:"p,omitempty"`
+	CodeVerifier string `json:"v,omitempty"`
+	// OIDCNonce is the nonce the ID token of the login has to carry
+	OIDCNonce string `json:"o,omitempty"`
+	// IssuedAt is the Unix time the login started
+	IssuedAt int64 `json:"t"`
+}
+
+// encodeState encrypts the state of a login for the state parameter. The
+// issue time is set to now.
+func (p *OAuthProxy) encodeState(state *loginState) (string, error) {
+	state.IssuedAt = time.Now().Unix()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	return p.stateCiphers[0].Encrypt(string(b), "state")
+}
+
+// decodeState decrypts the state parameter of a login encrypted with the
+// cookie secret or a previous cookie secret. It returns errLoginExpired when
+// the login started more than the maximum login duration ago.
+func (p *OAuthProxy) decodeState(value string) (*loginState, error) {
+	var plaintext string
+	var err error
+	for _, c := range p.stateCiphers {
+		if plaintext, err = c.Decrypt(value, "state"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &loginState{}
+	if err := json.Unmarshal([]byte(plaintext), state); err != nil {
+		return nil, fmt.Errorf("error decoding state: %v", err)
+	}
+	if state.Nonce == "" {
+		return nil, errors.New("state has no nonce")
+	}
+	if time.Since(time.Unix(state.IssuedAt, 0)) > p.maxLoginDuration {
+		return nil, errLoginExpired
+	}
+	return state, nil
+}
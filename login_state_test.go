@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLoginState returns the state parameter, escaped for a query, of a
+// login with the nonce
+func testLoginState(proxy *OAuthProxy, nonce string) string {
+	state, err := proxy.encodeState(&loginState{Nonce: nonce})
+	if err != nil {
+		panic(err)
+	}
+	return url.QueryEscape(state)
+}
+
+func newLoginStateTestProxy(t *testing.T, modifiers ...OptionsModifier) *OAuthProxy {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	t.Cleanup(providerServer.Close)
+
+	opts := NewOptions()
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.EmailDomains = []string{"*"}
+	for _, modifier := range modifiers {
+		modifier(opts)
+	}
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestLoginStateRoundTrip(t *testing.T) {
+	proxy := newLoginStateTestProxy(t)
+	value, err := proxy.encodeState(&loginState{
+		Nonce:        "nonce",
+		Redirect:     "/private?a=b",
+		ProviderID:   "provider",
+		CodeVerifier: "verifier",
+	})
+	assert.NoError(t, err)
+	// Nothing of the login is revealed to the provider
+	assert.NotContains(t, value, "nonce")
+	assert.NotContains(t, value, "private")
+	assert.NotContains(t, value, "verifier")
+
+	state, err := proxy.decodeState(value)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce", state.Nonce)
+	assert.Equal(t, "/private?a=b", state.Redirect)
+	assert.Equal(t, "provider", state.ProviderID)
+	assert.Equal(t, "verifier", state.CodeVerifier)
+
+	// The state of a login started before the secret was rotated is accepted
+	rotated := newLoginStateTestProxy(t, func(opts *Options) {
+		opts.CookieSecret = "plughxyzzyplughxyzzyplughxyzzyxp"
+		opts.PreviousCookieSecrets = []string{"xyzzyplughxyzzyplughxyzzyplughxp"}
+	})
+	state, err = rotated.decodeState(value)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce", state.Nonce)
+}
+
+func TestOAuthCallbackState(t *testing.T) {
+	proxy := newLoginStateTestProxy(t, func(opts *Options) {
+		opts.MaxLoginDuration = time.Minute
+	})
+	valid, err := proxy.encodeState(&loginState{Nonce: "nonce"})
+	assert.NoError(t, err)
+	// encodeState always issues states now
+	b, err := json.Marshal(&loginState{Nonce: "nonce", IssuedAt: time.Now().Add(-2 * time.Minute).Unix()})
+	assert.NoError(t, err)
+	expired, err := proxy.stateCiphers[0].Encrypt(string(b), "state")
+	assert.NoError(t, err)
+	plainValue := "nonce:/"
+	tampered := []byte(valid)
+	tampered[len(tampered)-2] ^= 1
+
+	testCases := []struct {
+		name  string
+		state string
+		code  int
+	}{
+		{"valid", valid, 302},
+		{"expired", expired, 403},
+		{"plain", plainValue, 500},
+		{"tampered", string(tampered), 500},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(tc.state), nil)
+			req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", "nonce", proxy.maxLoginDuration, time.Now()))
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.code, rw.Code)
+		})
+	}
+}
+
+// NonceProvider records the nonce it redeems codes with
+type NonceProvider struct {
+	*TestProvider
+	nonce string
+}
+
+func (p *NonceProvider) Redeem(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*sessions.SessionState, error) {
+	p.nonce = nonce
+	return p.TestProvider.Redeem(ctx, redirectURI, code, codeVerifier, nonce)
+}
+
+func TestOAuthFlowWithNonce(t *testing.T) {
+	proxy := newLoginStateTestProxy(t)
+	provider := &NonceProvider{TestProvider: proxy.provider.(*TestProvider)}
+	provider.UsesNonce = true
+	proxy.provider = provider
+
+	login := func() string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		loginURL, err := url.Parse(rw.Header().Get("Location"))
+		assert.NoError(t, err)
+		state, err := proxy.decodeState(loginURL.Query().Get("state"))
+		assert.NoError(t, err)
+
+		// The nonce is sent to the provider and kept in the state
+		nonce := loginURL.Query().Get("nonce")
+		assert.NotEmpty(t, nonce)
+		assert.Equal(t, nonce, state.OIDCNonce)
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(loginURL.Query().Get("state")), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, state.Nonce, state.Nonce, proxy.maxLoginDuration, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		return nonce
+	}
+	first := login()
+	assert.Equal(t, first, provider.nonce)
+	second := login()
+	assert.Equal(t, second, provider.nonce)
+	// Every login gets a nonce of its own
+	assert.NotEqual(t, first, second)
+}
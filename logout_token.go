@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// backchannelLogoutEvent is the events claim member identifying a logout
+// token, see OpenID Connect Back-Channel Logout 1.0 section 2.4
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenMaxAge bounds how old a logout token without an exp claim may
+// be when it is received
+const logoutTokenMaxAge = 5 * time.Minute
+
+// logoutToken holds the claims of a verified logout token that identify the
+// sessions to revoke. At least one of them is set.
+type logoutToken struct {
+	// Issuer is the issuer of the verifier that accepted the token, the
+	// subject and session ID are only unique for it
+	Issuer    string
+	Subject   string
+	SessionID string
+}
+
+// logoutVerifierConfig configures a verifier for logout tokens. These share
+// the ID token key set, issuer and audience, but exp is optional in them so
+// expiry is checked by verifyLogoutToken instead.
+func logoutVerifierConfig(clientID string) *oidc.Config {
+	return &oidc.Config{
+		ClientID:        clientID,
+		SkipExpiryCheck: true,
+	}
+}
+
+// verifyLogoutToken verifies the signature and claims of a back-channel
+// logout token
+func verifyLogoutToken(ctx context.Context, verifier *oidc.IDTokenVerifier, rawToken string) (*logoutToken, error) {
+	if rawToken == "" {
+		return nil, errors.New("missing logout_token")
+	}
+	token, err := verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify logout token: %v", err)
+	}
+
+	now := time.Now()
+	if !token.Expiry.IsZero() && now.After(token.Expiry) {
+		return nil, fmt.Errorf("logout token is expired (exp: %v)", token.Expiry)
+	}
+	if token.IssuedAt.IsZero() {
+		return nil, errors.New("logout token is missing iat")
+	}
+	if token.Expiry.IsZero() && now.Sub(token.IssuedAt) > logoutTokenMaxAge {
+		return nil, fmt.Errorf("logout token is too old (iat: %v)", token.IssuedAt)
+	}
+	if token.Nonce != "" {
+		return nil, errors.New("logout token must not contain a nonce")
+	}
+
+	var claims struct {
+		SessionID string                     `json:"sid"`
+		Events    map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("unable to parse logout token claims: %v", err)
+	}
+	event, ok := claims.Events[backchannelLogoutEvent]
+	if !ok {
+		return nil, fmt.Errorf("logout token events claim is missing %s", backchannelLogoutEvent)
+	}
+	var eventObject map[string]interface{}
+	if err := json.Unmarshal(event, &eventObject); err != nil || eventObject == nil {
+		return nil, errors.New("logout token event must be a JSON object")
+	}
+	if token.Subject == "" && claims.SessionID == "" {
+		return nil, errors.New("logout token must contain sub or sid")
+	}
+
+	return &logoutToken{
+		Issuer:    token.Issuer,
+		Subject:   token.Subject,
+		SessionID: claims.SessionID,
+	}, nil
+}
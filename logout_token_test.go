@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLogoutToken builds an unsigned logout token, for use with NoOpKeySet
+func newLogoutToken(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("signature"))
+}
+
+func newLogoutTokenClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://issuer.example.com",
+		"aud":    "client",
+		"iat":    time.Now().Unix(),
+		"jti":    "bWJq",
+		"sub":    "248289761001",
+		"sid":    "08a5019c-17e1-4977-8f42-65a12843ea02",
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}
+}
+
+func TestVerifyLogoutToken(t *testing.T) {
+	verifier := oidc.NewVerifier("https://issuer.example.com", NoOpKeySet{}, logoutVerifierConfig("client"))
+
+	testCases := []struct {
+		name      string
+		modify    func(map[string]interface{})
+		expected  *logoutToken
+		expectErr bool
+	}{
+		{
+			name:     "valid token",
+			modify:   func(map[string]interface{}) {},
+			expected: &logoutToken{Issuer: "https://issuer.example.com", Subject: "248289761001", SessionID: "08a5019c-17e1-4977-8f42-65a12843ea02"},
+		},
+		{
+			name:     "subject only",
+			modify:   func(c map[string]interface{}) { delete(c, "sid") },
+			expected: &logoutToken{Issuer: "https://issuer.example.com", Subject: "248289761001"},
+		},
+		{
+			name:      "missing sub and sid",
+			modify:    func(c map[string]interface{}) { delete(c, "sub"); delete(c, "sid") },
+			expectErr: true,
+		},
+		{
+			name:      "missing events",
+			modify:    func(c map[string]interface{}) { delete(c, "events") },
+			expectErr: true,
+		},
+		{
+			name: "event is not an object",
+			modify: func(c map[string]interface{}) {
+				c["events"] = map[string]interface{}{backchannelLogoutEvent: "logout"}
+			},
+			expectErr: true,
+		},
+		{
+			name:      "contains nonce",
+			modify:    func(c map[string]interface{}) { c["nonce"] = "abc" },
+			expectErr: true,
+		},
+		{
+			name:      "wrong audience",
+			modify:    func(c map[string]interface{}) { c["aud"] = "other" },
+			expectErr: true,
+		},
+		{
+			name:      "expired",
+			modify:    func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+			expectErr: true,
+		},
+		{
+			name:      "too old",
+			modify:    func(c map[string]interface{}) { c["iat"] = time.Now().Add(-time.Hour).Unix() },
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := newLogoutTokenClaims()
+			tc.modify(claims)
+
+			token, err := verifyLogoutToken(context.Background(), verifier, newLogoutToken(claims))
+			if tc.expectErr {
+				assert.NotEqual(t, nil, err)
+				return
+			}
+			assert.Equal(t, nil, err)
+			assert.Equal(t, tc.expected, token)
+		})
+	}
+}
@@ -24,8 +24,22 @@ func main() {
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
 	jwtIssuers := StringArray{}
+	introspectionAudiences := StringArray{}
+	introspectionScopes := StringArray{}
 	googleGroups := StringArray{}
 	redisSentinelConnectionURLs := StringArray{}
+	redisClusterConnectionURLs := StringArray{}
+	redisCAFiles := StringArray{}
+	allowedGroups := StringArray{}
+	allowedRoles := StringArray{}
+	oidcSessionClaims := StringArray{}
+	injectRequestHeaders := StringArray{}
+	injectResponseHeaders := StringArray{}
+	stripRequestHeaders := StringArray{}
+	providerCAFiles := StringArray{}
+	upstreamCAFiles := StringArray{}
+	previousCookieSecrets := StringArray{}
+	ldapCAFiles := StringArray{}
 
 	config := flagSet.String("config", "", "path to config file")
 	showVersion := flagSet.Bool("version", false, "print version string")
@@ -44,14 +58,29 @@ func main() {
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
 	flagSet.Bool("pass-authorization-header", false, "pass the Authorization Header to upstream")
 	flagSet.Bool("set-authorization-header", false, "set Authorization response headers (useful in Nginx auth_request mode)")
+	flagSet.Var(&injectRequestHeaders, "inject-request-header", "a Name=template pair of a header to pass to upstream, rendered from the session (ie: X-Remote-Groups={{join \",\" .Groups}}) (may be given multiple times)")
+	flagSet.Var(&injectResponseHeaders, "inject-response-header", "a Name=template pair of a response header to set, rendered from the session (useful in Nginx auth_request mode) (may be given multiple times)")
+	flagSet.Var(&stripRequestHeaders, "strip-request-header", "a header to remove from client requests in addition to the identity headers set by the proxy (may be given multiple times)")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.String("admin-token", "", "bearer token enabling the admin API at /oauth2/admin/sessions; requires a server side session store")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS providers")
 	flagSet.Bool("ssl-upstream-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS upstreams")
+	flagSet.Var(&upstreamCAFiles, "upstream-ca-file", "path to a PEM bundle of CAs trusted for HTTPS upstreams in addition to the system roots (may be given multiple times)")
+	flagSet.String("upstream-client-cert-file", "", "path to the client certificate presented to HTTPS upstreams")
+	flagSet.String("upstream-client-key-file", "", "path to the private key of the upstream client certificate")
+	flagSet.String("upstream-proxy-url", "", "egress proxy for requests to the upstreams; taken from the environment when empty")
+	flagSet.Duration("upstream-dial-timeout", time.Duration(30)*time.Second, "timeout of connecting to an upstream")
+	flagSet.Duration("upstream-timeout", time.Duration(0), "time to wait for the response headers of an upstream; 0 for no limit")
 	flagSet.Duration("flush-interval", time.Duration(1)*time.Second, "period between response flushing when streaming responses")
 	flagSet.Bool("skip-jwt-bearer-tokens", false, "will skip requests that have verified JWT bearer tokens (default false)")
 	flagSet.Var(&jwtIssuers, "extra-jwt-issuers", "if skip-jwt-bearer-tokens is set, a list of extra JWT issuer=audience pairs (where the issuer URL has a .well-known/openid-configuration or a .well-known/jwks.json)")
+	flagSet.String("token-introspection-url", "", "introspection endpoint (RFC 7662) checking opaque bearer tokens; requests with an active token are skipped")
+	flagSet.String("token-introspection-client-id", "", "client ID authenticating to the token introspection endpoint (defaults to the client-id)")
+	flagSet.String("token-introspection-client-secret", "", "client secret authenticating to the token introspection endpoint (defaults to the client-secret)")
+	flagSet.Var(&introspectionAudiences, "token-introspection-audience", "audience accepted in introspected tokens (may be given multiple times, defaults to the introspection client ID)")
+	flagSet.Var(&introspectionScopes, "token-introspection-scope", "scope required in introspected tokens (may be given multiple times)")
 
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
 	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domains for redirection after authentication. Prefix domain with a . to allow subdomains (eg .example.com)")
@@ -68,7 +97,19 @@ func main() {
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
-	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file or LDAP directory is provided")
+	flagSet.String("ldap-url", "", "additionally authenticate against an LDAP directory (ie: ldaps://ldap.example.com)")
+	flagSet.Bool("ldap-start-tls", false, "upgrade ldap:// connections to TLS with StartTLS")
+	flagSet.Var(&ldapCAFiles, "ldap-ca-file", "path to a PEM bundle of CAs trusted for the LDAP server (may be given multiple times)")
+	flagSet.Bool("ldap-insecure-skip-tls-verify", false, "skip verifying the certificate of the LDAP server")
+	flagSet.String("ldap-bind-dn", "", "DN of the service account searching for users; the search is anonymous when empty")
+	flagSet.String("ldap-bind-password", "", "password of the LDAP service account")
+	flagSet.String("ldap-base-dn", "", "DN of the subtree searched for users (ie: ou=people,dc=example,dc=com)")
+	flagSet.String("ldap-user-filter", "(uid={username})", "LDAP filter finding the entry of a user; {username} is replaced by the escaped username (ie: (sAMAccountName={username}))")
+	flagSet.String("ldap-email-attribute", "mail", "LDAP attribute holding the user's email address")
+	flagSet.String("ldap-groups-attribute", "memberOf", "LDAP attribute holding the DNs of the user's groups")
+	flagSet.Int("ldap-pool-size", 5, "maximum number of connections to the LDAP server")
+	flagSet.Duration("ldap-timeout", time.Duration(10)*time.Second, "timeout of authenticating a user with the LDAP server, including connecting")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("banner", "", "custom banner string. Use \"-\" to disable default banner.")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
@@ -78,18 +119,42 @@ func main() {
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.Var(&previousCookieSecrets, "previous-cookie-secret", "a previous cookie secret still accepted when reading cookies, while they are re-saved with cookie-secret (may be given multiple times)")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
 	flagSet.String("cookie-path", "/", "an optional cookie path to force cookies to (ie: /poc/)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
+	flagSet.Duration("cookie-idle-timeout", time.Duration(0), "expire sessions not used for this duration, within cookie-expire; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
 
 	flagSet.String("session-store-type", "cookie", "the session storage provider to use")
+	flagSet.Bool("session-legacy-decryption", true, "accept session values encrypted with AES-CFB by older versions, which can be tampered with unnoticed")
 	flagSet.String("redis-connection-url", "", "URL of redis server for redis session storage (eg: redis://HOST[:PORT])")
 	flagSet.Bool("redis-use-sentinel", false, "Connect to redis via sentinels. Must set --redis-sentinel-master-name and --redis-sentinel-connection-urls to use this feature")
 	flagSet.String("redis-sentinel-master-name", "", "Redis sentinel master name. Used in conjunction with --redis-use-sentinel")
 	flagSet.Var(&redisSentinelConnectionURLs, "redis-sentinel-connection-urls", "List of Redis sentinel connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-sentinel")
+	flagSet.String("redis-sentinel-password", "", "Redis sentinel password. Used in conjunction with --redis-use-sentinel")
+	flagSet.Bool("redis-use-cluster", false, "Connect to redis cluster. Must set --redis-cluster-connection-urls to use this feature")
+	flagSet.Var(&redisClusterConnectionURLs, "redis-cluster-connection-urls", "List of Redis cluster connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-cluster")
+	flagSet.String("redis-username", "", "Redis ACL username, overriding the one of the connection URL")
+	flagSet.String("redis-password", "", "Redis password, overriding the one of the connection URL")
+	flagSet.Int("redis-db", 0, "Redis database to use, overriding the one of the connection URL when not 0")
+	flagSet.String("redis-key-prefix", "", "prefix of the redis keys of the sessions, in addition to the cookie name")
+	flagSet.Var(&redisCAFiles, "redis-ca-file", "path to a PEM bundle of CAs trusted for rediss:// connections (may be given multiple times)")
+	flagSet.String("redis-client-cert-file", "", "path to the client certificate presented to redis over rediss:// connections")
+	flagSet.String("redis-client-key-file", "", "path to the private key of the redis client certificate")
+	flagSet.Bool("redis-insecure-skip-tls-verify", false, "skip verifying the certificate of redis over rediss:// connections")
+	flagSet.Int("redis-pool-size", 0, "maximum number of connections to redis; 0 uses the redis client default")
+	flagSet.Duration("redis-dial-timeout", time.Duration(0), "timeout of connecting to redis; 0 uses the redis client default")
+	flagSet.Duration("redis-read-timeout", time.Duration(0), "timeout of reading from redis; 0 uses the redis client default")
+	flagSet.Duration("redis-write-timeout", time.Duration(0), "timeout of writing to redis; 0 uses the redis client default")
+	flagSet.Duration("redis-pool-timeout", time.Duration(0), "time to wait for a connection to redis when all are busy; 0 uses the redis client default")
+	flagSet.Duration("redis-idle-timeout", time.Duration(0), "time after which idle connections to redis are closed; 0 uses the redis client default")
+	flagSet.Int("memory-max-sessions", 10000, "maximum number of sessions kept by the memory session storage, the least recently used are evicted first")
+	flagSet.Duration("memory-cleanup-interval", time.Duration(1)*time.Minute, "interval at which expired sessions are removed from the memory session storage")
+	flagSet.String("file-store-path", "", "path of the database file of the file session storage")
+	flagSet.Duration("file-store-compaction-interval", time.Duration(1)*time.Hour, "interval at which expired sessions are removed from the file session storage")
 
 	flagSet.String("logging-filename", "", "File to log requests to, empty for stdout")
 	flagSet.Int("logging-max-size", 100, "Maximum size in megabytes of the log file before rotation")
@@ -114,13 +179,31 @@ func main() {
 	flagSet.Bool("insecure-oidc-allow-unverified-email", false, "Don't fail if an email address in an id_token is not verified")
 	flagSet.Bool("skip-oidc-discovery", false, "Skip OIDC discovery and use manually supplied Endpoints")
 	flagSet.String("oidc-jwks-url", "", "OpenID Connect JWKS URL (ie: https://www.googleapis.com/oauth2/v3/certs)")
+	flagSet.String("oidc-end-session-url", "", "OpenID Connect end session URL used to sign out of the provider; discovered from the issuer when empty")
+	flagSet.String("oidc-groups-claim", "groups", "ID token claim holding the user's groups; nested claims are separated with dots (ie: realm_access.groups)")
+	flagSet.String("oidc-roles-claim", "roles", "ID token claim holding the user's roles; nested claims are separated with dots (ie: realm_access.roles)")
+	flagSet.String("saml-idp-metadata", "", "https URL or path of the SAML identity provider metadata")
+	flagSet.String("saml-entity-id", "", "SAML service provider entity ID (default the URL of the SAML metadata endpoint)")
+	flagSet.String("saml-email-attribute", "email", "SAML attribute holding the user's email address; the NameID is used without it if it is an email address")
+	flagSet.String("saml-groups-attribute", "groups", "SAML attribute holding the user's groups")
+	flagSet.Var(&allowedGroups, "allowed-group", "restrict logins to members of this group (may be given multiple times). Read from the oidc-groups-claim of the ID token; sessions from token introspection or LDAP are denied")
+	flagSet.Var(&allowedRoles, "allowed-role", "restrict logins to users with this role (may be given multiple times). Read from the oidc-roles-claim of the ID token; sessions from token introspection or LDAP are denied")
+	flagSet.Var(&oidcSessionClaims, "oidc-session-claim", "an ID token claim to keep in the session in addition to sub, sid, preferred_username and name (may be given multiple times)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
 	flagSet.String("scope", "", "OAuth scope specification")
+	flagSet.String("code-challenge-method", "", "enable PKCE for the login flow with this code challenge method: S256 or plain")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.Duration("max-login-duration", time.Duration(30)*time.Minute, "reject logins that take longer than this, from starting them until the provider redirects back")
+	flagSet.Duration("provider-timeout", time.Duration(30)*time.Second, "timeout of each request to the provider; 0 to only abort when the client disconnects")
+	flagSet.Duration("provider-dial-timeout", time.Duration(30)*time.Second, "timeout of connecting to the provider")
+	flagSet.Var(&providerCAFiles, "provider-ca-file", "path to a PEM bundle of CAs trusted for HTTPS providers in addition to the system roots (may be given multiple times)")
+	flagSet.String("provider-client-cert-file", "", "path to the client certificate presented to HTTPS providers")
+	flagSet.String("provider-client-key-file", "", "path to the private key of the provider client certificate")
+	flagSet.String("provider-proxy-url", "", "egress proxy for requests to the providers; taken from the environment when empty")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 	flagSet.String("acr-values", "http://idmanagement.gov/ns/assurance/loa/1", "acr values string:  optional, used by login.gov")
@@ -144,6 +227,10 @@ func main() {
 		if err != nil {
 			logger.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
 		}
+		opts.Providers, err = loadProviderOptions(*config)
+		if err != nil {
+			logger.Fatalf("ERROR: failed to load providers from config file %s - %s", *config, err)
+		}
 	}
 	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
@@ -179,6 +266,9 @@ func main() {
 			logger.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
 		}
 	}
+	if opts.LDAPURL != "" {
+		logger.Printf("using LDAP directory %s", opts.LDAPURL)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"crypto/subtle"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,6 +14,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,7 +22,9 @@ import (
 	"github.com/mbland/hmacauth"
 	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
 	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+	"github.com/msepp/oauth2_proxy/v4/pkg/ldap"
 	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
 	"github.com/msepp/oauth2_proxy/v4/providers"
 	"github.com/yhat/wsutil"
 )
@@ -55,18 +60,29 @@ var (
 	ErrNeedsLogin = errors.New("redirect to login page")
 )
 
+const (
+	// maxPendingLoginFlows bounds the CSRF cookies of login flows that were
+	// started but not completed, e.g. in tabs that were closed since
+	maxPendingLoginFlows = 5
+	// staleLoginFlowAge is the age of pending login flows whose CSRF
+	// cookies are cleared once the user logged in
+	staleLoginFlowAge = 10 * time.Minute
+)
+
 // OAuthProxy is the main authentication proxy
 type OAuthProxy struct {
-	CookieSeed     string
-	CookieName     string
-	CSRFCookieName string
-	CookieDomain   string
-	CookiePath     string
-	CookieSecure   bool
-	CookieHTTPOnly bool
-	CookieExpire   time.Duration
-	CookieRefresh  time.Duration
-	Validator      func(string) bool
+	CookieSeed        string
+	cookieSeeds       []string
+	CookieName        string
+	CSRFCookieName    string
+	CookieDomain      string
+	CookiePath        string
+	CookieSecure      bool
+	CookieHTTPOnly    bool
+	CookieExpire      time.Duration
+	CookieRefresh     time.Duration
+	CookieIdleTimeout time.Duration
+	Validator         func(string) bool
 
 	RobotsPath        string
 	PingPath          string
@@ -75,28 +91,39 @@ type OAuthProxy struct {
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	BackchannelPath   string
+	AdminSessionsPath string
+	SAMLMetadataPath  string
+	SAMLACSPath       string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
 	provider            providers.Provider
+	signInProviders     []*signInProvider
 	sessionStore        sessionsapi.SessionStore
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
+	ldapDirectory       userDirectory
+	basicAuthCache      *basicAuthCache
 	DisplayHtpasswdForm bool
 	serveMux            http.Handler
-	SetXAuthRequest     bool
-	PassBasicAuth       bool
 	SkipProviderButton  bool
-	PassUserHeaders     bool
-	BasicAuthPassword   string
-	PassAccessToken     bool
-	SetAuthorization    bool
-	PassAuthorization   bool
+	codeChallengeMethod string
+	providerTimeout     time.Duration
+	requestHeaders      []identityHeader
+	responseHeaders     []identityHeader
+	strippedHeaders     map[string]struct{}
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
 	skipJwtBearerTokens bool
 	jwtBearerVerifiers  []*oidc.IDTokenVerifier
+	tokenIntrospector   *tokenIntrospector
+	logoutVerifiers     []*oidc.IDTokenVerifier
+	stateCiphers        []*encryption.Cipher
+	maxLoginDuration    time.Duration
+	adminToken          string
+	refreshes           refreshGroup
 	compiledRegex       []*regexp.Regexp
 	templates           *template.Template
 	Banner              string
@@ -132,10 +159,8 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func NewReverseProxy(target *url.URL, opts *Options) (proxy *httputil.ReverseProxy) {
 	proxy = httputil.NewSingleHostReverseProxy(target)
 	proxy.FlushInterval = opts.FlushInterval
-	if opts.SSLUpstreamInsecureSkipVerify {
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	if opts.upstreamTransport != nil {
+		proxy.Transport = opts.upstreamTransport
 	}
 	return proxy
 }
@@ -193,6 +218,9 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 
 // NewOAuthProxy creates a new instance of OOuthProxy from the options provided
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+	if opts.providerClient != nil {
+		requests.SetClient(opts.providerClient)
+	}
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
@@ -234,30 +262,44 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			logger.Printf("Skipping JWT tokens from extra JWT issuer: %q", issuer)
 		}
 	}
+	if opts.tokenIntrospector != nil {
+		logger.Printf("Skipping bearer tokens introspected at: %q", opts.IntrospectionURL)
+	}
 	redirectURL := opts.redirectURL
 	if redirectURL.Path == "" {
 		redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 	}
 
-	logger.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	if len(opts.signInProviders) == 0 {
+		logger.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	}
+	for _, sp := range opts.signInProviders {
+		logger.Printf("OAuthProxy configured for %s (%s) Client ID: %s", sp.Name, sp.ID, sp.provider.Data().ClientID)
+	}
 	refresh := "disabled"
 	if opts.CookieRefresh != time.Duration(0) {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
 	}
+	idleTimeout := "disabled"
+	if opts.CookieIdleTimeout != time.Duration(0) {
+		idleTimeout = opts.CookieIdleTimeout.String()
+	}
 
-	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s path:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHTTPOnly, opts.CookieExpire, opts.CookieDomain, opts.CookiePath, refresh)
+	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s path:%s refresh:%s idle-timeout:%s", opts.CookieName, opts.CookieSecure, opts.CookieHTTPOnly, opts.CookieExpire, opts.CookieDomain, opts.CookiePath, refresh, idleTimeout)
 
 	return &OAuthProxy{
-		CookieName:     opts.CookieName,
-		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
-		CookieSeed:     opts.CookieSecret,
-		CookieDomain:   opts.CookieDomain,
-		CookiePath:     opts.CookiePath,
-		CookieSecure:   opts.CookieSecure,
-		CookieHTTPOnly: opts.CookieHTTPOnly,
-		CookieExpire:   opts.CookieExpire,
-		CookieRefresh:  opts.CookieRefresh,
-		Validator:      validator,
+		CookieName:        opts.CookieName,
+		CSRFCookieName:    fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
+		CookieSeed:        opts.CookieSecret,
+		cookieSeeds:       opts.CookieSecrets(),
+		CookieDomain:      opts.CookieDomain,
+		CookiePath:        opts.CookiePath,
+		CookieSecure:      opts.CookieSecure,
+		CookieHTTPOnly:    opts.CookieHTTPOnly,
+		CookieExpire:      opts.CookieExpire,
+		CookieRefresh:     opts.CookieRefresh,
+		CookieIdleTimeout: opts.CookieIdleTimeout,
+		Validator:         validator,
 
 		RobotsPath:        "/robots.txt",
 		PingPath:          opts.PingPath,
@@ -266,9 +308,14 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		BackchannelPath:   fmt.Sprintf("%s/backchannel-logout", opts.ProxyPrefix),
+		AdminSessionsPath: fmt.Sprintf("%s/admin/sessions", opts.ProxyPrefix),
+		SAMLMetadataPath:  fmt.Sprintf("%s/saml/metadata", opts.ProxyPrefix),
+		SAMLACSPath:       fmt.Sprintf("%s/saml/acs", opts.ProxyPrefix),
 
 		ProxyPrefix:         opts.ProxyPrefix,
 		provider:            opts.provider,
+		signInProviders:     newSignInProviders(opts, validator),
 		sessionStore:        opts.sessionStore,
 		serveMux:            serveMux,
 		redirectURL:         redirectURL,
@@ -277,21 +324,55 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		skipAuthPreflight:   opts.SkipAuthPreflight,
 		skipJwtBearerTokens: opts.SkipJwtBearerTokens,
 		jwtBearerVerifiers:  opts.jwtBearerVerifiers,
+		tokenIntrospector:   opts.tokenIntrospector,
+		logoutVerifiers:     opts.logoutVerifiers,
+		stateCiphers:        opts.stateCiphers,
+		maxLoginDuration:    opts.MaxLoginDuration,
+		adminToken:          opts.AdminToken,
+		ldapDirectory:       opts.ldapDirectory,
+		basicAuthCache:      newBasicAuthCache(),
 		compiledRegex:       opts.CompiledRegex,
-		SetXAuthRequest:     opts.SetXAuthRequest,
-		PassBasicAuth:       opts.PassBasicAuth,
-		PassUserHeaders:     opts.PassUserHeaders,
-		BasicAuthPassword:   opts.BasicAuthPassword,
-		PassAccessToken:     opts.PassAccessToken,
-		SetAuthorization:    opts.SetAuthorization,
-		PassAuthorization:   opts.PassAuthorization,
 		SkipProviderButton:  opts.SkipProviderButton,
+		codeChallengeMethod: opts.CodeChallengeMethod,
+		providerTimeout:     opts.ProviderTimeout,
+		requestHeaders:      opts.requestHeaders,
+		responseHeaders:     opts.responseHeaders,
+		strippedHeaders:     newStrippedHeaders(opts.requestHeaders, opts.StripRequestHeaders),
 		templates:           loadTemplates(opts.CustomTemplatesDir),
 		Banner:              opts.Banner,
 		Footer:              opts.Footer,
 	}
 }
 
+// newSignInProviders sets up the email validators of the providers users can
+// choose from, the ones without email domains share the default validator
+func newSignInProviders(opts *Options, validator func(string) bool) []*signInProvider {
+	var signInProviders []*signInProvider
+	for _, sp := range opts.signInProviders {
+		sp := *sp
+		sp.validator = validator
+		if len(sp.emailDomains) > 0 {
+			sp.validator = NewValidator(sp.emailDomains, opts.AuthenticatedEmailsFile)
+		}
+		signInProviders = append(signInProviders, &sp)
+	}
+	return signInProviders
+}
+
+// getProvider returns the provider with the ID and its email validator. The
+// empty ID is the default provider.
+func (p *OAuthProxy) getProvider(id string) (providers.Provider, func(string) bool, bool) {
+	if id == "" {
+		return p.provider, p.Validator, true
+	}
+	for _, sp := range p.signInProviders {
+		if sp.ID == id {
+			return sp.provider, sp.validator, true
+		}
+	}
+	return nil, nil, false
+}
+
 // GetRedirectURI returns the redirectURL that the upstream OAuth Provider will
 // redirect clients to once authenticated
 func (p *OAuthProxy) GetRedirectURI(host string) string {
@@ -312,26 +393,74 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 	return u.String()
 }
 
+// absoluteURL turns a relative redirect into an absolute URL on the proxy,
+// as required by providers when redirecting back after logout
+func (p *OAuthProxy) absoluteURL(host, redirect string) string {
+	if !strings.HasPrefix(redirect, "/") {
+		return redirect
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return ""
+	}
+	u.Scheme = p.redirectURL.Scheme
+	if u.Scheme == "" {
+		if p.CookieSecure {
+			u.Scheme = httpsScheme
+		} else {
+			u.Scheme = httpScheme
+		}
+	}
+	u.Host = p.redirectURL.Host
+	if u.Host == "" {
+		u.Host = host
+	}
+	return u.String()
+}
+
 func (p *OAuthProxy) displayCustomLoginForm() bool {
-	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
+	return (p.HtpasswdFile != nil || p.ldapDirectory != nil) && p.DisplayHtpasswdForm
+}
+
+// validateGroup checks the group membership of email with the provider
+func (p *OAuthProxy) validateGroup(req *http.Request, provider providers.Provider, email string) bool {
+	ctx, cancel := p.providerContext(req)
+	defer cancel()
+	return provider.ValidateGroup(ctx, email)
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *sessionsapi.SessionState, err error) {
+// providerContext returns the context for a call to the provider made while
+// serving req. The call is aborted when the client disconnects or when the
+// provider timeout expires.
+func (p *OAuthProxy) providerContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if p.providerTimeout <= 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), p.providerTimeout)
+}
+
+func (p *OAuthProxy) redeemCode(req *http.Request, provider providers.Provider, code, codeVerifier, nonce string) (s *sessionsapi.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
-	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	redirectURI := p.GetRedirectURI(req.Host)
+	ctx, cancel := p.providerContext(req)
+	s, err = provider.Redeem(ctx, redirectURI, code, codeVerifier, nonce)
+	cancel()
 	if err != nil {
 		return
 	}
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		ctx, cancel = p.providerContext(req)
+		s.Email, err = provider.GetEmailAddress(ctx, s)
+		cancel()
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		ctx, cancel = p.providerContext(req)
+		s.User, err = provider.GetUserName(ctx, s)
+		cancel()
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
@@ -339,9 +468,22 @@ func (p *OAuthProxy) redeemCode(host, code string) (s *sessionsapi.SessionState,
 	return
 }
 
-// MakeCSRFCookie creates a cookie for CSRF
-func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
+// csrfCookieName is the name of the CSRF cookie of the login flow with the
+// nonce. Every flow has a cookie of its own, so that logins started in
+// parallel, e.g. in several tabs, each complete.
+func (p *OAuthProxy) csrfCookieName(nonce string) string {
+	hash := sha256.Sum256([]byte(nonce))
+	return fmt.Sprintf("%s_%x", p.CSRFCookieName, hash[:8])
+}
+
+// MakeCSRFCookie creates the CSRF cookie of the login flow with the nonce,
+// signing the value if present
+func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, nonce string, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	name := p.csrfCookieName(nonce)
+	if value != "" {
+		value = encryption.SignedValue(p.CookieSeed, name, value, now)
+	}
+	return p.makeCookie(req, name, value, expiration, now)
 }
 
 func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
@@ -366,15 +508,47 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 	}
 }
 
-// ClearCSRFCookie creates a cookie to unset the CSRF cookie stored in the user's
-// session
-func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
+// ClearCSRFCookie creates a cookie to unset the CSRF cookie of the login
+// flow with the nonce
+func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request, nonce string) {
+	http.SetCookie(rw, p.MakeCSRFCookie(req, nonce, "", time.Hour*-1, time.Now()))
 }
 
-// SetCSRFCookie adds a CSRF cookie to the response
-func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+// SetCSRFCookie adds the CSRF cookie of the login flow with the nonce to the
+// response
+func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, nonce string, val string) {
+	http.SetCookie(rw, p.MakeCSRFCookie(req, nonce, val, p.maxLoginDuration, time.Now()))
+}
+
+// clearStaleCSRFCookies unsets the CSRF cookies of login flows that are not
+// going to complete: those that are not valid, the cookie shared by all
+// flows of earlier versions, those started more than maxAge ago, and all
+// but the keep most recently started. The cookie named except is left alone.
+func (p *OAuthProxy) clearStaleCSRFCookies(rw http.ResponseWriter, req *http.Request, except string, keep int, maxAge time.Duration) {
+	type flow struct {
+		name    string
+		started time.Time
+	}
+	var flows []flow
+	for _, c := range req.Cookies() {
+		switch {
+		case c.Name == except:
+		case c.Name == p.CSRFCookieName:
+			http.SetCookie(rw, p.makeCookie(req, c.Name, "", time.Hour*-1, time.Now()))
+		case strings.HasPrefix(c.Name, p.CSRFCookieName+"_"):
+			_, started, _, ok := encryption.ValidateAny(c, p.cookieSeeds, p.maxLoginDuration)
+			if !ok || time.Since(started) > maxAge {
+				http.SetCookie(rw, p.makeCookie(req, c.Name, "", time.Hour*-1, time.Now()))
+				continue
+			}
+			flows = append(flows, flow{name: c.Name, started: started})
+		}
+	}
+
+	sort.Slice(flows, func(i, j int) bool { return flows[i].started.After(flows[j].started) })
+	for i := keep; i < len(flows); i++ {
+		http.SetCookie(rw, p.makeCookie(req, flows[i].name, "", time.Hour*-1, time.Now()))
+	}
 }
 
 // ClearSessionCookie creates a cookie to unset the user's authentication cookie
@@ -436,6 +610,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 
 	t := struct {
 		ProviderName  string
+		Providers     []*signInProvider
 		SignInMessage string
 		CustomLogin   bool
 		Redirect      string
@@ -444,6 +619,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Footer        template.HTML
 	}{
 		ProviderName:  p.provider.Data().ProviderName,
+		Providers:     p.signInProviders,
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirecURL,
@@ -455,22 +631,71 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 }
 
 // ManualSignIn handles basic auth logins to the proxy
-func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
-	if req.Method != "POST" || p.HtpasswdFile == nil {
-		return "", false
+func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, bool) {
+	if req.Method != "POST" || (p.HtpasswdFile == nil && p.ldapDirectory == nil) {
+		return nil, false
 	}
 	user := req.FormValue("username")
 	passwd := req.FormValue("password")
 	if user == "" {
-		return "", false
+		return nil, false
 	}
 	// check auth
-	if p.HtpasswdFile.Validate(user, passwd) {
+	if p.HtpasswdFile != nil && p.HtpasswdFile.Validate(user, passwd) {
 		logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via HtpasswdFile")
-		return user, true
+		return &sessionsapi.SessionState{User: user}, true
+	}
+	if session := p.authenticateLDAP(req, user, passwd); session != nil {
+		logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via LDAP")
+		return session, true
+	}
+	logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via %s", p.passwordBackends())
+	return nil, false
+}
+
+// userDirectory authenticates users by their password, like an
+// ldap.Authenticator
+type userDirectory interface {
+	Authenticate(ctx context.Context, username, password string) (*ldap.User, error)
+}
+
+// authenticateLDAP checks the password of the user with the LDAP directory,
+// if configured, and returns the session of the user. The groups of the
+// directory entry are kept in the session. Users need an email address that
+// passes the email validation, as it is checked again on every request.
+func (p *OAuthProxy) authenticateLDAP(req *http.Request, user, password string) *sessionsapi.SessionState {
+	if p.ldapDirectory == nil {
+		return nil
+	}
+	entry, err := p.ldapDirectory.Authenticate(req.Context(), user, password)
+	if err != nil {
+		if err != ldap.ErrInvalidCredentials {
+			logger.PrintAuthf(user, req, logger.AuthError, "Error authenticating via LDAP: %s", err)
+		}
+		return nil
+	}
+	if entry.Email == "" {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via LDAP: entry %s has no email", entry.DN)
+		return nil
+	}
+	if !p.Validator(entry.Email) {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via LDAP: email %s not allowed", entry.Email)
+		return nil
+	}
+	return &sessionsapi.SessionState{User: user, Email: entry.Email, Groups: entry.Groups}
+}
+
+// passwordBackends names the configured backends checking passwords, for
+// the log
+func (p *OAuthProxy) passwordBackends() string {
+	switch {
+	case p.HtpasswdFile != nil && p.ldapDirectory != nil:
+		return "HtpasswdFile and LDAP"
+	case p.ldapDirectory != nil:
+		return "LDAP"
+	default:
+		return "HtpasswdFile"
 	}
-	logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile")
-	return "", false
 }
 
 // GetRedirect reads the query parameter to get the URL to redirect clients to
@@ -562,6 +787,10 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		prepareNoCache(rw)
 	}
 
+	// Identity headers must only ever come from the proxy itself, remove
+	// any the client sent before the request can reach an upstream
+	stripHeaders(req.Header, p.strippedHeaders)
+
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
@@ -579,6 +808,14 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.BackchannelPath:
+		p.BackchannelLogout(rw, req)
+	case p.adminToken != "" && path == p.AdminSessionsPath:
+		p.AdminSessions(rw, req)
+	case path == p.SAMLMetadataPath:
+		p.SAMLMetadata(rw, req)
+	case path == p.SAMLACSPath:
+		p.SAMLACS(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -593,9 +830,8 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user, ok := p.ManualSignIn(rw, req)
+	session, ok := p.ManualSignIn(rw, req)
 	if ok {
-		session := &sessionsapi.SessionState{User: user}
 		p.SaveSession(rw, req, session)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
@@ -607,38 +843,263 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// SignOut sends a response to clear the authentication cookie
+// SignOut sends a response to clear the authentication cookie. With
+// everywhere=true, all sessions of the user are cleared.
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		logger.Printf("Error obtaining redirect: %s", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+
+	// Signing out everywhere must not be triggered by other sites, with a
+	// link or an image it has to be a POST, and forms must be the proxy's own
+	everywhere := req.FormValue("everywhere") == "true"
+	if everywhere && req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if everywhere && !p.isSameOrigin(req) {
+		p.ErrorPage(rw, http.StatusForbidden, "Forbidden", "Signing out everywhere is only allowed from the same origin")
+		return
+	}
+
+	// Errors are ignored here, a missing or broken session only means there
+	// is nothing to sign out of at the provider
+	session, _ := p.LoadCookiedSession(req)
+	if everywhere && session != nil && session.UserKey() != "" {
+		store, ok := p.sessionStore.(sessionsapi.RevocableSessionStore)
+		if !ok {
+			p.ErrorPage(rw, http.StatusNotImplemented, "Not Implemented", "Signing out everywhere requires a server side session store")
+			return
+		}
+		if err := store.ClearByUser(session.UserKey()); err != nil {
+			logger.Printf("Error clearing all sessions of %s: %s", session.UserKey(), err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Signed out of all sessions")
+	}
 	p.ClearSessionCookie(rw, req)
-	http.Redirect(rw, req, "/", 302)
+	if session != nil {
+		if provider, _, ok := p.getProvider(session.ProviderID); ok {
+			logoutURL := provider.GetLogoutURL(session, p.absoluteURL(req.Host, redirect))
+			if logoutURL != "" {
+				redirect = logoutURL
+			}
+		}
+	}
+	http.Redirect(rw, req, redirect, 302)
+}
+
+// isSameOrigin reports whether the Origin header of the request, which
+// browsers send with every POST, names the host of the proxy. Requests
+// without one don't come from a browser.
+func (p *OAuthProxy) isSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == req.Host || (p.redirectURL.Host != "" && u.Host == p.redirectURL.Host)
+}
+
+// BackchannelLogout receives OIDC back-channel logout tokens from the
+// provider and clears the server side sessions they identify
+func (p *OAuthProxy) BackchannelLogout(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := p.sessionStore.(sessionsapi.RevocableSessionStore)
+	if len(p.logoutVerifiers) == 0 || !ok {
+		http.Error(rw, "Back-channel logout requires the oidc provider and a server side session store", http.StatusNotImplemented)
+		return
+	}
+
+	// The token is verified against each OIDC provider until one accepts it,
+	// and only revokes sessions of that provider's issuer
+	var token *logoutToken
+	var err error
+	for _, verifier := range p.logoutVerifiers {
+		token, err = verifyLogoutToken(req.Context(), verifier, req.PostFormValue("logout_token"))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logger.Printf("Error verifying logout token: %s", err.Error())
+		http.Error(rw, "Invalid logout token", http.StatusBadRequest)
+		return
+	}
+
+	// A session ID narrows the logout to a single login of the subject
+	if token.SessionID != "" {
+		err = store.ClearBySessionID(token.Issuer, token.SessionID)
+	} else {
+		err = store.ClearBySubject(token.Issuer, token.Subject)
+	}
+	if err != nil {
+		logger.Printf("Error clearing sessions for logout token: %s", err.Error())
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	logger.PrintAuthf(token.Subject, req, logger.AuthSuccess, "Signed out via back-channel logout (iss: %q, sid: %q)", token.Issuer, token.SessionID)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// AdminSessions lists the sessions of the user given by the user parameter
+// on GET. On DELETE it clears the session given by the id parameter, or all
+// sessions of the user without it. Requests must carry the admin token as
+// a bearer token.
+func (p *OAuthProxy) AdminSessions(rw http.ResponseWriter, req *http.Request) {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || !strings.EqualFold(auth[0], "Bearer") ||
+		subtle.ConstantTimeCompare([]byte(auth[1]), []byte(p.adminToken)) != 1 {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	store, ok := p.sessionStore.(sessionsapi.ManageableSessionStore)
+	if !ok {
+		http.Error(rw, "The admin API requires a server side session store", http.StatusNotImplemented)
+		return
+	}
+	user := req.FormValue("user")
+	if user == "" {
+		http.Error(rw, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		infos, err := store.ListByUser(user)
+		if err != nil {
+			logger.Printf("Error listing sessions of %s: %s", user, err.Error())
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		for i := range infos {
+			if infos[i].ProviderID == "" {
+				infos[i].ProviderID = p.provider.Data().ProviderName
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"sessions": infos})
+	case http.MethodDelete:
+		var err error
+		if id := req.FormValue("id"); id != "" {
+			err = store.ClearByID(user, id)
+		} else {
+			err = store.ClearByUser(user)
+		}
+		if err == sessionsapi.ErrSessionNotFound {
+			http.Error(rw, "Session not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Printf("Error clearing sessions of %s: %s", user, err.Error())
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("Cleared sessions of %s via the admin API (id: %q)", user, req.FormValue("id"))
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
 }
 
 // OAuthStart starts the OAuth2 authentication flow
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 	prepareNoCache(rw)
 
+	providerID := req.FormValue("provider")
+	if providerID == "" && len(p.signInProviders) > 0 {
+		providerID = p.signInProviders[0].ID
+	}
+	provider, _, ok := p.getProvider(providerID)
+	if !ok {
+		logger.Printf("Error starting OAuth2 flow: unknown provider %q", providerID)
+		p.ErrorPage(rw, 400, "Bad Request", "Unknown provider")
+		return
+	}
+
 	nonce, err := encryption.Nonce()
 	if err != nil {
 		logger.Printf("Error obtaining nonce: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
+	var codeVerifier string
+	var extraParams url.Values
+	if p.codeChallengeMethod != "" {
+		codeVerifier, err = encryption.CodeVerifier()
+		if err != nil {
+			logger.Printf("Error obtaining code verifier: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		codeChallenge, err := encryption.CodeChallenge(codeVerifier, p.codeChallengeMethod)
+		if err != nil {
+			logger.Printf("Error obtaining code challenge: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		extraParams = url.Values{
+			"code_challenge":        {codeChallenge},
+			"code_challenge_method": {p.codeChallengeMethod},
+		}
+	}
+	// The ID token issued for the login has to carry a nonce of its own
+	var oidcNonce string
+	if provider.Data().UsesNonce {
+		oidcNonce, err = encryption.Nonce()
+		if err != nil {
+			logger.Printf("Error obtaining nonce: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		if extraParams == nil {
+			extraParams = url.Values{}
+		}
+		extraParams.Set("nonce", oidcNonce)
+	}
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
 		logger.Printf("Error obtaining redirect: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
+	// Everything the callback needs travels encrypted in the state, the
+	// CSRF cookie ties it to the browser
+	state, err := p.encodeState(&loginState{
+		Nonce:        nonce,
+		Redirect:     redirect,
+		ProviderID:   providerID,
+		CodeVerifier: codeVerifier,
+		OIDCNonce:    oidcNonce,
+	})
+	if err != nil {
+		logger.Printf("Error encoding state: %s", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	// Make room for the cookie of this flow
+	p.clearStaleCSRFCookies(rw, req, "", maxPendingLoginFlows-1, p.maxLoginDuration)
+	p.SetCSRFCookie(rw, req, nonce, nonce)
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	http.Redirect(rw, req, provider.GetLoginURL(redirectURI, state, extraParams), 302)
 }
 
 // OAuthCallback is the OAuth2 authentication flow callback that finishes the
 // OAuth2 authentication flow
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
-	remoteAddr := getRemoteAddr(req)
-
 	// finish the oauth cycle
 	err := req.ParseForm()
 	if err != nil {
@@ -653,50 +1114,86 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	state, csrfCookie, ok := p.checkLoginState(rw, req, req.Form.Get("state"), "OAuth2")
+	if !ok {
+		return
+	}
+	provider, validator, ok := p.getProvider(state.ProviderID)
+	if !ok {
+		logger.Printf("Error while parsing OAuth2 callback: unknown provider %q", state.ProviderID)
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		return
+	}
+
+	session, err := p.redeemCode(req, provider, req.Form.Get("code"), state.CodeVerifier, state.OIDCNonce)
 	if err != nil {
 		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
 
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
-	if len(s) != 2 {
-		logger.Printf("Error while parsing OAuth2 state: invalid length")
+	p.completeLogin(rw, req, state, csrfCookie, provider, validator, session, "OAuth2")
+}
+
+// checkLoginState decodes the state of a login returned by the provider and
+// checks it against the CSRF cookie of the login, which is cleared. It
+// writes an error page and returns false if the state isn't valid. via
+// names the protocol for the log.
+func (p *OAuthProxy) checkLoginState(rw http.ResponseWriter, req *http.Request, encodedState string, via string) (*loginState, *http.Cookie, bool) {
+	state, err := p.decodeState(encodedState)
+	if err == errLoginExpired {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via %s: login took longer than %s", via, p.maxLoginDuration)
+		p.ErrorPage(rw, 403, "Permission Denied", "Login expired")
+		return nil, nil, false
+	} else if err != nil {
+		logger.Printf("Error while parsing %s state: %s", via, err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
-		return
+		return nil, nil, false
 	}
-	nonce := s[0]
-	redirect := s[1]
-	c, err := req.Cookie(p.CSRFCookieName)
+	c, err := req.Cookie(p.csrfCookieName(state.Nonce))
 	if err != nil {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unable too obtain CSRF cookie")
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via %s: unable too obtain CSRF cookie", via)
 		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
-		return
+		return nil, nil, false
 	}
-	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
+	p.ClearCSRFCookie(rw, req, state.Nonce)
+	value, _, _, ok := encryption.ValidateAny(c, p.cookieSeeds, p.maxLoginDuration)
+	if !ok {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via %s: invalid CSRF cookie signature", via)
 		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
-		return
+		return nil, nil, false
 	}
+	if value != state.Nonce {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via %s: csrf token mismatch, potential attack", via)
+		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		return nil, nil, false
+	}
+	return state, c, true
+}
 
+// completeLogin authorizes the session of a login with the provider, saves
+// it and redirects the user back to where the login started
+func (p *OAuthProxy) completeLogin(rw http.ResponseWriter, req *http.Request, state *loginState, csrfCookie *http.Cookie, provider providers.Provider, validator func(string) bool, session *sessionsapi.SessionState, via string) {
+	redirect := state.Redirect
 	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
-		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2: %s", session)
+	session.ProviderID = state.ProviderID
+	if validator(session.Email) && p.validateGroup(req, provider, session.Email) && provider.Authorize(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via %s: %s", via, session)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
-			logger.Printf("%s %s", remoteAddr, err)
+			logger.Printf("%s %s", getRemoteAddr(req), err)
 			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 			return
 		}
+		// Flows started in parallel, e.g. in other tabs, may still complete
+		p.clearStaleCSRFCookies(rw, req, csrfCookie.Name, maxPendingLoginFlows, staleLoginFlowAge)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unauthorized")
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via %s: unauthorized", via)
 		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
 	}
 }
@@ -738,6 +1235,10 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
 
+	case errSessionLocked:
+		p.ErrorPage(rw, http.StatusServiceUnavailable,
+			"Service Unavailable", "The session is being refreshed, please try again")
+
 	default:
 		// unknown error
 		logger.Printf("Unexpected internal error: %s", err)
@@ -747,13 +1248,20 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 
 }
 
+// idleTouchInterval is how often the last seen time of sessions is
+// updated. Sessions may expire up to this much earlier than the idle
+// timeout, never later.
+func (p *OAuthProxy) idleTouchInterval() time.Duration {
+	return p.CookieIdleTimeout / 10
+}
+
 // getAuthenticatedSession checks whether a user is authenticated and returns a session object and nil error if so
 // Returns nil, ErrNeedsLogin if user needs to login.
 // Set-Cookie headers may be set on the response as a side-effect of calling this method.
 func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
 	var session *sessionsapi.SessionState
 	var err error
-	var saveSession, clearSession, revalidated bool
+	var saveSession, clearSession, revalidated, touchSession bool
 
 	if p.skipJwtBearerTokens && req.Header.Get("Authorization") != "" {
 		session, err = p.GetJwtSession(req)
@@ -764,27 +1272,71 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 			saveSession = false
 		}
 	}
+	if session == nil && p.tokenIntrospector != nil && req.Header.Get("Authorization") != "" {
+		session, err = p.GetIntrospectedSession(req)
+		if err != nil {
+			logger.Printf("Error introspecting token in Authorization header: %s", err)
+		}
+	}
 
 	remoteAddr := getRemoteAddr(req)
+	provider, validator := p.provider, p.Validator
 	if session == nil {
 		session, err = p.LoadCookiedSession(req)
 		if err != nil {
 			logger.Printf("Error loading cookied session: %s", err)
 		}
 
+		// Sessions are refreshed and validated by the provider they were
+		// created with
+		if session != nil {
+			var ok bool
+			if provider, validator, ok = p.getProvider(session.ProviderID); !ok {
+				logger.Printf("Removing session: unknown provider %q %s", session.ProviderID, session)
+				session = nil
+				clearSession = true
+			}
+		}
+
+		if session != nil && p.CookieIdleTimeout != time.Duration(0) {
+			if session.IdleTime() > p.CookieIdleTimeout {
+				logger.Printf("Removing session: idle for %s %s (idle timeout %s)", session.IdleTime(), session, p.CookieIdleTimeout)
+				session = nil
+				clearSession = true
+			} else if session.IdleTime() > p.idleTouchInterval() {
+				// Only record the session as seen every so often, as it
+				// takes saving the session
+				touchSession = true
+			}
+		}
+
 		if session != nil {
+			if session.Rotated {
+				logger.Printf("Re-saving session saved with a previous cookie secret %s", session)
+				saveSession = true
+			}
 			if session.Age() > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 				logger.Printf("Refreshing %s old session cookie for %s (refresh after %s)", session.Age(), session, p.CookieRefresh)
 				saveSession = true
 			}
 
-			if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+			refreshed, ok, release, err := p.refreshSession(req, provider, session)
+			defer release()
+			if err == errSessionLocked {
+				// The session is kept, to be refreshed by a later request
+				logger.Printf("%s error refreshing access token %s %s", remoteAddr, err, session)
+				return nil, err
+			}
+			if err != nil {
 				logger.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
 				clearSession = true
 				session = nil
-			} else if ok {
-				saveSession = true
-				revalidated = true
+			} else {
+				session = refreshed
+				if ok {
+					saveSession = true
+					revalidated = true
+				}
 			}
 		}
 	}
@@ -797,7 +1349,10 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		ctx, cancel := p.providerContext(req)
+		valid := provider.ValidateSessionState(ctx, session)
+		cancel()
+		if !valid {
 			logger.Printf("Removing session: error validating %s", session)
 			saveSession = false
 			session = nil
@@ -806,7 +1361,7 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	}
 
 	if session != nil && session.Email != "" {
-		if !p.Validator(session.Email) || !p.provider.ValidateGroup(session.Email) {
+		if !validator(session.Email) || !p.validateGroup(req, provider, session.Email) || !provider.Authorize(session) {
 			logger.Printf(session.Email, req, logger.AuthFailure, "Invalid authentication via session: removing session %s", session)
 			session = nil
 			saveSession = false
@@ -814,7 +1369,10 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		}
 	}
 
-	if saveSession && session != nil {
+	if (saveSession || touchSession) && session != nil {
+		if p.CookieIdleTimeout != time.Duration(0) {
+			session.LastSeenAt = time.Now()
+		}
 		err = p.SaveSession(rw, req, session)
 		if err != nil {
 			logger.PrintAuthf(session.Email, req, logger.AuthError, "Save session error %s", err)
@@ -842,64 +1400,8 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 
 // addHeadersForProxying adds the appropriate headers the request / response for proxying
 func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
-	if p.PassBasicAuth {
-		req.SetBasicAuth(session.User, p.BasicAuthPassword)
-		req.Header["X-Forwarded-User"] = []string{session.User}
-		if session.Email != "" {
-			req.Header["X-Forwarded-Email"] = []string{session.Email}
-		} else {
-			req.Header.Del("X-Forwarded-Email")
-		}
-	}
-
-	if p.PassUserHeaders {
-		req.Header["X-Forwarded-User"] = []string{session.User}
-		if session.Email != "" {
-			req.Header["X-Forwarded-Email"] = []string{session.Email}
-		} else {
-			req.Header.Del("X-Forwarded-Email")
-		}
-	}
-
-	if p.SetXAuthRequest {
-		rw.Header().Set("X-Auth-Request-User", session.User)
-		if session.Email != "" {
-			rw.Header().Set("X-Auth-Request-Email", session.Email)
-		} else {
-			rw.Header().Del("X-Auth-Request-Email")
-		}
-
-		if p.PassAccessToken {
-			if session.AccessToken != "" {
-				rw.Header().Set("X-Auth-Request-Access-Token", session.AccessToken)
-			} else {
-				rw.Header().Del("X-Auth-Request-Access-Token")
-			}
-		}
-	}
-
-	if p.PassAccessToken {
-		if session.AccessToken != "" {
-			req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
-		} else {
-			req.Header.Del("X-Forwarded-Access-Token")
-		}
-	}
-
-	if p.PassAuthorization {
-		if session.IDToken != "" {
-			req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", session.IDToken)}
-		} else {
-			req.Header.Del("Authorization")
-		}
-	}
-	if p.SetAuthorization {
-		if session.IDToken != "" {
-			rw.Header().Set("Authorization", fmt.Sprintf("Bearer %s", session.IDToken))
-		} else {
-			rw.Header().Del("Authorization")
-		}
-	}
+	setIdentityHeaders(req.Header, p.requestHeaders, session)
+	setIdentityHeaders(rw.Header(), p.responseHeaders, session)
 
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
@@ -909,9 +1411,10 @@ func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Req
 }
 
 // CheckBasicAuth checks the requests Authorization header for basic auth
-// credentials and authenticates these against the proxies HtpasswdFile
+// credentials and authenticates these against the proxies HtpasswdFile and
+// LDAP directory
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*sessionsapi.SessionState, error) {
-	if p.HtpasswdFile == nil {
+	if p.HtpasswdFile == nil && p.ldapDirectory == nil {
 		return nil, nil
 	}
 	auth := req.Header.Get("Authorization")
@@ -930,11 +1433,20 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*sessionsapi.SessionStat
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
-	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
+	if p.HtpasswdFile != nil && p.HtpasswdFile.Validate(pair[0], pair[1]) {
 		logger.PrintAuthf(pair[0], req, logger.AuthSuccess, "Authenticated via basic auth and HTpasswd File")
 		return &sessionsapi.SessionState{User: pair[0]}, nil
 	}
-	logger.PrintAuthf(pair[0], req, logger.AuthFailure, "Invalid authentication via basic auth: not in Htpasswd File")
+	// The directory is only searched again once the cached session expires
+	if session := p.basicAuthCache.Get(pair[0], pair[1]); session != nil {
+		return session, nil
+	}
+	if session := p.authenticateLDAP(req, pair[0], pair[1]); session != nil {
+		logger.PrintAuthf(pair[0], req, logger.AuthSuccess, "Authenticated via basic auth and LDAP")
+		p.basicAuthCache.Add(pair[0], pair[1], session)
+		return session, nil
+	}
+	logger.PrintAuthf(pair[0], req, logger.AuthFailure, "Invalid authentication via basic auth: not in %s", p.passwordBackends())
 	return nil, nil
 }
 
@@ -966,7 +1478,8 @@ func (p *OAuthProxy) GetJwtSession(req *http.Request) (*sessionsapi.SessionState
 		return nil, err
 	}
 
-	ctx := context.Background()
+	ctx, cancel := p.providerContext(req)
+	defer cancel()
 	var session *sessionsapi.SessionState
 	for _, verifier := range p.jwtBearerVerifiers {
 		bearerToken, err := verifier.Verify(ctx, rawBearerToken)
@@ -1002,11 +1515,31 @@ func (p *OAuthProxy) GetJwtSession(req *http.Request) (*sessionsapi.SessionState
 			Email:        claims.Email,
 			User:         claims.Email,
 		}
+		if oidc, ok := p.provider.(*providers.OIDCProvider); ok {
+			var allClaims map[string]interface{}
+			if err := bearerToken.Claims(&allClaims); err != nil {
+				return nil, fmt.Errorf("failed to parse bearer token claims: %v", err)
+			}
+			oidc.SetSessionClaims(session, allClaims)
+		}
 		return session, nil
 	}
 	return nil, fmt.Errorf("unable to verify jwt token %s", req.Header.Get("Authorization"))
 }
 
+// GetIntrospectedSession loads a session based on an opaque bearer token in
+// the authorization header, checked at the token introspection endpoint.
+// There is no session nor error without a bearer token.
+func (p *OAuthProxy) GetIntrospectedSession(req *http.Request) (*sessionsapi.SessionState, error) {
+	token := findOpaqueBearerToken(req)
+	if token == "" {
+		return nil, nil
+	}
+	ctx, cancel := p.providerContext(req)
+	defer cancel()
+	return p.tokenIntrospector.Introspect(ctx, token)
+}
+
 // findBearerToken finds a valid JWT token from the Authorization header of a given request.
 func (p *OAuthProxy) findBearerToken(req *http.Request) (string, error) {
 	auth := req.Header.Get("Authorization")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -19,6 +20,7 @@ import (
 	oidc "github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
 	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/cookie"
 	"github.com/msepp/oauth2_proxy/v4/providers"
@@ -262,15 +264,15 @@ func NewTestProvider(providerURL *url.URL, emailAddress string) *TestProvider {
 	}
 }
 
-func (tp *TestProvider) GetEmailAddress(session *sessions.SessionState) (string, error) {
+func (tp *TestProvider) GetEmailAddress(ctx context.Context, session *sessions.SessionState) (string, error) {
 	return tp.EmailAddress, nil
 }
 
-func (tp *TestProvider) ValidateSessionState(session *sessions.SessionState) bool {
+func (tp *TestProvider) ValidateSessionState(ctx context.Context, session *sessions.SessionState) bool {
 	return tp.ValidToken
 }
 
-func (tp *TestProvider) ValidateGroup(email string) bool {
+func (tp *TestProvider) ValidateGroup(ctx context.Context, email string) bool {
 	if tp.GroupValidator != nil {
 		return tp.GroupValidator(email)
 	}
@@ -315,9 +317,9 @@ func TestBasicAuthPassword(t *testing.T) {
 	})
 
 	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+testLoginState(proxy, "nonce"),
 		strings.NewReader(""))
-	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", "nonce", proxy.CookieExpire, time.Now()))
 	proxy.ServeHTTP(rw, req)
 	if rw.Code >= 400 {
 		t.Fatalf("expected 3xx got %d", rw.Code)
@@ -345,7 +347,7 @@ func TestBasicAuthPassword(t *testing.T) {
 		Expires:  time.Now().Add(time.Duration(24)),
 		HttpOnly: true,
 	})
-	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", "nonce", proxy.CookieExpire, time.Now()))
 
 	rw = httptest.NewRecorder()
 	proxy.ServeHTTP(rw, req)
@@ -357,6 +359,331 @@ func TestBasicAuthPassword(t *testing.T) {
 	providerServer.Close()
 }
 
+func TestOAuthFlowWithPKCE(t *testing.T) {
+	var codeVerifier string
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		codeVerifier = r.PostForm.Get("code_verifier")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, providerServer.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	opts.CodeChallengeMethod = encryption.CodeChallengeMethodS256
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	const emailAddress = "john.doe@example.com"
+	opts.provider = NewTestProvider(providerURL, emailAddress)
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == emailAddress
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+	state := loginURL.Query().Get("state")
+
+	// The code verifier travels in the encrypted state
+	loginState, err := proxy.decodeState(state)
+	assert.NoError(t, err)
+	challenge, err := encryption.CodeChallenge(loginState.CodeVerifier, encryption.CodeChallengeMethodS256)
+	assert.NoError(t, err)
+	assert.Equal(t, challenge, loginURL.Query().Get("code_challenge"))
+
+	var csrfCookie *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.csrfCookieName(loginState.Nonce) {
+			csrfCookie = c
+		}
+	}
+	if assert.NotNil(t, csrfCookie) {
+		value, _, ok := encryption.Validate(csrfCookie, opts.CookieSecret, proxy.maxLoginDuration)
+		assert.True(t, ok)
+		assert.Equal(t, loginState.Nonce, value)
+	}
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(csrfCookie)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, loginState.CodeVerifier, codeVerifier)
+}
+
+func TestOAuthParallelLoginFlows(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// The browser's cookie jar
+	jar := map[string]*http.Cookie{}
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		for _, c := range jar {
+			req.AddCookie(c)
+		}
+		proxy.ServeHTTP(rw, req)
+		for _, c := range rw.Result().Cookies() {
+			if c.Value == "" {
+				delete(jar, c.Name)
+			} else {
+				jar[c.Name] = c
+			}
+		}
+		return rw
+	}
+	start := func() string {
+		rw := serve("/oauth2/start")
+		assert.Equal(t, 302, rw.Code)
+		loginURL, err := url.Parse(rw.Header().Get("Location"))
+		assert.NoError(t, err)
+		return loginURL.Query().Get("state")
+	}
+	csrfCookies := func() int {
+		var n int
+		for name := range jar {
+			if strings.HasPrefix(name, proxy.CSRFCookieName) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Logins started in two tabs both complete
+	first, second := start(), start()
+	assert.Equal(t, 2, csrfCookies())
+	assert.Equal(t, 302, serve("/oauth2/callback?code=callback_code&state="+url.QueryEscape(second)).Code)
+	assert.Equal(t, 302, serve("/oauth2/callback?code=callback_code&state="+url.QueryEscape(first)).Code)
+	assert.Equal(t, 0, csrfCookies())
+
+	// Pending flows are bounded
+	for i := 0; i < maxPendingLoginFlows+2; i++ {
+		start()
+	}
+	assert.Equal(t, maxPendingLoginFlows, csrfCookies())
+
+	// The cookie shared by all flows of earlier versions is cleared when a
+	// flow starts, stale flows once logged in
+	for name := range jar {
+		delete(jar, name)
+	}
+	stale := proxy.MakeCSRFCookie(&http.Request{}, "stale", "stale", proxy.CookieExpire, time.Now().Add(-staleLoginFlowAge-time.Minute))
+	jar[stale.Name] = stale
+	jar[proxy.CSRFCookieName] = &http.Cookie{Name: proxy.CSRFCookieName, Value: "legacy"}
+	pending, current := start(), start()
+	assert.Equal(t, 3, csrfCookies())
+	assert.NotContains(t, jar, proxy.CSRFCookieName)
+	assert.Equal(t, 302, serve("/oauth2/callback?code=callback_code&state="+url.QueryEscape(current)).Code)
+	assert.Equal(t, 1, csrfCookies())
+	assert.Equal(t, 302, serve("/oauth2/callback?code=callback_code&state="+url.QueryEscape(pending)).Code)
+}
+
+func TestOAuthCallbackCSRFCookieSignature(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PreviousCookieSecrets = []string{"previous secret"}
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	testCases := []struct {
+		name     string
+		value    string
+		expected int
+	}{
+		{"current secret", encryption.SignedValue(opts.CookieSecret, proxy.csrfCookieName("nonce"), "nonce", time.Now()), 302},
+		{"previous secret", encryption.SignedValue("previous secret", proxy.csrfCookieName("nonce"), "nonce", time.Now()), 302},
+		{"unknown secret", encryption.SignedValue("unknown secret", proxy.csrfCookieName("nonce"), "nonce", time.Now()), 403},
+		{"unsigned", "nonce", 403},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+testLoginState(proxy, "nonce"), nil)
+			req.AddCookie(&http.Cookie{Name: proxy.csrfCookieName("nonce"), Value: tc.value})
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tc.expected, rw.Code)
+		})
+	}
+}
+
+func TestOAuthCallbackProviderTimeout(t *testing.T) {
+	done := make(chan struct{})
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer providerServer.Close()
+	defer close(done)
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	opts.ProviderTimeout = 50 * time.Millisecond
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+testLoginState(proxy, "nonce"), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", "nonce", proxy.CookieExpire, time.Now()))
+	start := time.Now()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 500, rw.Code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestOAuthCallbackClientDisconnect(t *testing.T) {
+	done := make(chan struct{})
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer providerServer.Close()
+	defer close(done)
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	opts.ProviderTimeout = 0
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/oauth2/callback?code=callback_code&state="+testLoginState(proxy, "nonce"), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", "nonce", proxy.CookieExpire, time.Now()))
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 500, rw.Code)
+}
+
+func TestOAuthFlowWithMultipleProviders(t *testing.T) {
+	redeemed := make(map[string]int)
+	newProviderServer := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			redeemed[id]++
+			w.WriteHeader(200)
+			w.Write([]byte(`{"access_token": "my_auth_token"}`))
+		}))
+	}
+	employeesServer := newProviderServer("employees")
+	defer employeesServer.Close()
+	contractorsServer := newProviderServer("contractors")
+	defer contractorsServer.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, employeesServer.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	assert.NoError(t, opts.Validate())
+
+	employeesURL, _ := url.Parse(employeesServer.URL)
+	contractorsURL, _ := url.Parse(contractorsServer.URL)
+	opts.signInProviders = []*signInProvider{
+		{ID: "employees", Name: "Employees", provider: NewTestProvider(employeesURL, "john.doe@example.com")},
+		{ID: "contractors", Name: "Contractors", provider: NewTestProvider(contractorsURL, "jane.doe@contractor.com")},
+	}
+	opts.provider = opts.signInProviders[0].provider
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	// one button per provider
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `name="provider" value="employees">Sign in with Employees`)
+	assert.Contains(t, rw.Body.String(), `name="provider" value="contractors">Sign in with Contractors`)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=unknown", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=contractors", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, contractorsURL.Host, loginURL.Host)
+
+	rw2 := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(loginURL.Query().Get("state")), nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	proxy.ServeHTTP(rw2, req)
+	assert.Equal(t, 302, rw2.Code)
+	assert.Equal(t, map[string]int{"contractors": 1}, redeemed)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range rw2.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	session, err := proxy.LoadCookiedSession(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "contractors", session.ProviderID)
+		assert.Equal(t, "jane.doe@contractor.com", session.Email)
+	}
+}
+
+func TestSessionWithUnknownProvider(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", ProviderID: "removed", CreatedAt: time.Now()})
+
+	session, err := test.LoadCookiedSession()
+	assert.NoError(t, err)
+	assert.Equal(t, "removed", session.ProviderID)
+
+	_, err = test.proxy.getAuthenticatedSession(test.rw, test.req)
+	assert.Equal(t, ErrNeedsLogin, err)
+}
+
 type PassAccessTokenTest struct {
 	providerServer *httptest.Server
 	proxy          *OAuthProxy
@@ -415,12 +742,12 @@ func (patTest *PassAccessTokenTest) Close() {
 func (patTest *PassAccessTokenTest) getCallbackEndpoint() (httpCode int,
 	cookie string) {
 	rw := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+testLoginState(patTest.proxy, "nonce"),
 		strings.NewReader(""))
 	if err != nil {
 		return 0, ""
 	}
-	req.AddCookie(patTest.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	req.AddCookie(patTest.proxy.MakeCSRFCookie(req, "nonce", "nonce", time.Hour, time.Now()))
 	patTest.proxy.ServeHTTP(rw, req)
 	return rw.Code, rw.HeaderMap["Set-Cookie"][1]
 }
@@ -688,6 +1015,35 @@ func TestLoadCookiedSession(t *testing.T) {
 	assert.Equal(t, startSession.AccessToken, session.AccessToken)
 }
 
+func TestProcessCookieRotatedSecret(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+
+	opts := NewOptions()
+	opts.ClientID = "asdfljk"
+	opts.ClientSecret = "lkjfdsig"
+	opts.CookieSecret = "abcdef0123456789abcd"
+	opts.EmailDomains = []string{"*"}
+	opts.PreviousCookieSecrets = []string{pcTest.opts.CookieSecret}
+	opts.CookieRefresh = time.Hour
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ValidToken: true}
+
+	rw := httptest.NewRecorder()
+	session, err := proxy.getAuthenticatedSession(rw, pcTest.req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+
+	// the session is saved again with the new secret
+	cookies := rw.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		_, _, ok := encryption.Validate(cookies[0], opts.CookieSecret, opts.CookieExpire)
+		assert.True(t, ok)
+	}
+}
+
 func TestProcessCookieNoCookieError(t *testing.T) {
 	pcTest := NewProcessCookieTestWithDefaults()
 
@@ -746,6 +1102,46 @@ func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
 	}
 }
 
+func TestAuthOnlyEndpointIdleTimeout(t *testing.T) {
+	testCases := []struct {
+		name       string
+		lastSeen   time.Duration
+		expected   int
+		setsCookie bool
+	}{
+		{"recently seen", -time.Minute, http.StatusAccepted, false},
+		{"seen a while ago", -10 * time.Minute, http.StatusAccepted, true},
+		{"idle too long", -40 * time.Minute, http.StatusUnauthorized, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test := NewAuthOnlyEndpointTest(func(opts *Options) {
+				opts.CookieExpire = 12 * time.Hour
+				opts.CookieIdleTimeout = 30 * time.Minute
+			})
+			test.SaveSession(&sessions.SessionState{
+				Email:      "michael.bland@gsa.gov",
+				CreatedAt:  time.Now().Add(-time.Hour),
+				LastSeenAt: time.Now().Add(tc.lastSeen),
+			})
+
+			rw := httptest.NewRecorder()
+			test.proxy.ServeHTTP(rw, test.req)
+			assert.Equal(t, tc.expected, rw.Code)
+			assert.Equal(t, tc.setsCookie, len(rw.Result().Cookies()) > 0)
+			if tc.expected == http.StatusAccepted && tc.setsCookie {
+				test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+				for _, cookie := range rw.Result().Cookies() {
+					test.req.AddCookie(cookie)
+				}
+				session, err := test.LoadCookiedSession()
+				assert.NoError(t, err)
+				assert.True(t, session.IdleTime() < time.Minute)
+			}
+		})
+	}
+}
+
 func NewAuthOnlyEndpointTest(modifiers ...OptionsModifier) *ProcessCookieTest {
 	pcTest := NewProcessCookieTestWithOptionsModifiers(modifiers...)
 	pcTest.req, _ = http.NewRequest("GET",
@@ -851,6 +1247,260 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pcTest.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointInjectResponseHeaders(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.InjectResponseHeaders = []string{
+			"X-Remote-User={{.User}}",
+			`X-Remote-Groups={{join "," .Groups}}`,
+			`X-Tenant-Id={{.Claim "tid"}}`,
+		}
+	})
+
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: time.Now(),
+		Groups: []string{"admins", "devs"}, Claims: map[string]interface{}{"tid": "tenant-1"}}
+	test.SaveSession(startSession)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "oauth_user", test.rw.Header().Get("X-Remote-User"))
+	assert.Equal(t, "admins,devs", test.rw.Header().Get("X-Remote-Groups"))
+	assert.Equal(t, "tenant-1", test.rw.Header().Get("X-Tenant-Id"))
+}
+
+type LogoutTestProvider struct {
+	*TestProvider
+}
+
+func (tp *LogoutTestProvider) GetLogoutURL(s *sessions.SessionState, redirectURI string) string {
+	return "https://provider.example.com/logout?" + url.Values{
+		"id_token_hint":            {s.IDToken},
+		"post_logout_redirect_uri": {redirectURI},
+	}.Encode()
+}
+
+func TestSignOutRedirect(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.whitelistDomains = []string{"example.com"}
+
+	for rd, expected := range map[string]string{
+		"":                                "/",
+		"/app":                            "/app",
+		"https://example.com/signed-out":  "https://example.com/signed-out",
+		"https://evil.example.org/phish":  "/",
+		"//evil.example.org/protocol-rel": "/",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/sign_out?rd="+url.QueryEscape(rd), nil)
+		test.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		assert.Equal(t, expected, rw.Header().Get("Location"))
+	}
+}
+
+func TestSignOutProviderLogout(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &LogoutTestProvider{TestProvider: &TestProvider{ValidToken: true}}
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", IDToken: "id-token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_out?rd=%2Fapp", nil)
+	req.Host = "proxy.example.com"
+	for _, c := range test.req.Cookies() {
+		req.AddCookie(c)
+	}
+	test.proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 302, rw.Code)
+	logoutURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "provider.example.com", logoutURL.Host)
+	assert.Equal(t, "id-token", logoutURL.Query().Get("id_token_hint"))
+	assert.Equal(t, "https://proxy.example.com/app", logoutURL.Query().Get("post_logout_redirect_uri"))
+
+	// the session cookie is cleared
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == test.proxy.CookieName {
+			assert.Equal(t, "", c.Value)
+		}
+	}
+}
+
+type RevocableTestSessionStore struct {
+	sessions.SessionStore
+	subjects   []string
+	sessionIDs []string
+	users      []string
+}
+
+func (s *RevocableTestSessionStore) ClearBySubject(issuer string, subject string) error {
+	s.subjects = append(s.subjects, issuer+" "+subject)
+	return nil
+}
+
+func (s *RevocableTestSessionStore) ClearBySessionID(issuer string, sid string) error {
+	s.sessionIDs = append(s.sessionIDs, issuer+" "+sid)
+	return nil
+}
+
+func (s *RevocableTestSessionStore) ClearByUser(user string) error {
+	s.users = append(s.users, user)
+	return nil
+}
+
+func TestSignOutEverywhere(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	store := &RevocableTestSessionStore{SessionStore: test.proxy.sessionStore}
+	test.proxy.sessionStore = store
+	test.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()})
+
+	signOut := func(method, query, body, origin string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/oauth2/sign_out"+query, strings.NewReader(body))
+		req.Host = "proxy.example.com"
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for _, c := range test.req.Cookies() {
+			req.AddCookie(c)
+		}
+		test.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 302, signOut("GET", "", "", "").Code)
+	assert.Empty(t, store.users)
+
+	// Other sites can't sign the user out everywhere with a link or a form
+	rw := signOut("GET", "?everywhere=true", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, "POST", rw.Header().Get("Allow"))
+	rw = signOut("POST", "", "everywhere=true", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Empty(t, store.users)
+
+	rw = signOut("POST", "", "everywhere=true", "https://proxy.example.com")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, []string{"john.doe@example.com"}, store.users)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == test.proxy.CookieName {
+			assert.Equal(t, "", c.Value)
+		}
+	}
+}
+
+func TestSignOutEverywhereNotSupported(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/sign_out", strings.NewReader("everywhere=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range test.req.Cookies() {
+		req.AddCookie(c)
+	}
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotImplemented, rw.Code)
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	store := &RevocableTestSessionStore{SessionStore: test.proxy.sessionStore}
+	test.proxy.sessionStore = store
+	test.proxy.logoutVerifiers = []*oidc.IDTokenVerifier{
+		oidc.NewVerifier("https://issuer.example.com", NoOpKeySet{}, logoutVerifierConfig("client")),
+	}
+
+	logout := func(method string, claims map[string]interface{}) int {
+		form := url.Values{"logout_token": {newLogoutToken(claims)}}
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/oauth2/backchannel-logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		test.proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	claims := newLogoutTokenClaims()
+	assert.Equal(t, http.StatusOK, logout("POST", claims))
+	assert.Equal(t, []string{"https://issuer.example.com 08a5019c-17e1-4977-8f42-65a12843ea02"}, store.sessionIDs)
+	assert.Empty(t, store.subjects)
+
+	delete(claims, "sid")
+	assert.Equal(t, http.StatusOK, logout("POST", claims))
+	assert.Equal(t, []string{"https://issuer.example.com 248289761001"}, store.subjects)
+
+	delete(claims, "events")
+	assert.Equal(t, http.StatusBadRequest, logout("POST", claims))
+	assert.Equal(t, http.StatusMethodNotAllowed, logout("GET", newLogoutTokenClaims()))
+	assert.Equal(t, 1, len(store.subjects))
+	assert.Equal(t, 1, len(store.sessionIDs))
+}
+
+func TestBackchannelLogoutMultipleProviders(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.SessionOptions.Type = "memory"
+	})
+	defer test.proxy.sessionStore.(io.Closer).Close()
+	test.proxy.logoutVerifiers = []*oidc.IDTokenVerifier{
+		oidc.NewVerifier("https://issuer.example.com", NoOpKeySet{}, logoutVerifierConfig("client")),
+		oidc.NewVerifier("https://other.example.com", NoOpKeySet{}, logoutVerifierConfig("client")),
+	}
+
+	// Both providers signed in a user with the same sub
+	save := func(issuer string) *http.Request {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		err := test.proxy.SaveSession(rw, req, &sessions.SessionState{
+			Email:     "john.doe@example.com",
+			CreatedAt: time.Now(),
+			Claims:    map[string]interface{}{"iss": issuer, "sub": "248289761001"},
+		})
+		assert.NoError(t, err)
+		loadReq, _ := http.NewRequest("GET", "/", nil)
+		for _, c := range rw.Result().Cookies() {
+			loadReq.AddCookie(c)
+		}
+		return loadReq
+	}
+	first := save("https://issuer.example.com")
+	other := save("https://other.example.com")
+
+	claims := newLogoutTokenClaims()
+	claims["iss"] = "https://other.example.com"
+	delete(claims, "sid")
+	form := url.Values{"logout_token": {newLogoutToken(claims)}}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	_, err := test.proxy.sessionStore.Load(other)
+	assert.Error(t, err)
+	_, err = test.proxy.sessionStore.Load(first)
+	assert.NoError(t, err)
+}
+
+func TestBackchannelLogoutNotSupported(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.logoutVerifiers = []*oidc.IDTokenVerifier{
+		oidc.NewVerifier("https://issuer.example.com", NoOpKeySet{}, logoutVerifierConfig("client")),
+	}
+
+	form := url.Values{"logout_token": {newLogoutToken(newLogoutTokenClaims())}}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	test.proxy.ServeHTTP(rw, req)
+
+	// the cookie session store can't revoke sessions
+	assert.Equal(t, http.StatusNotImplemented, rw.Code)
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -878,6 +1528,50 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	assert.Equal(t, "response", rw.Body.String())
 }
 
+func TestClientIdentityHeadersStripped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(strings.Join([]string{
+			r.Header.Get("X-Forwarded-User"),
+			r.Header.Get("X_Forwarded_Email"),
+			r.Header.Get("Gap-Auth"),
+			r.Header.Get("X-Remote-Groups"),
+			r.Header.Get("X-Custom"),
+			r.Header.Get("Authorization"),
+		}, "|")))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "aljsal"
+	opts.ClientSecret = "jglkfsdgj"
+	opts.CookieSecret = "dkfjgdls"
+	opts.PassBasicAuth = false
+	opts.PassUserHeaders = false
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.InjectRequestHeaders = []string{`X-Remote-Groups={{join "," .Groups}}`}
+	opts.StripRequestHeaders = []string{"X-Custom"}
+	opts.Validate()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/public", nil)
+	req.Header["X-Forwarded-User"] = []string{"admin"}
+	req.Header["X_Forwarded_Email"] = []string{"admin@example.com"}
+	req.Header.Set("GAP-Auth", "admin")
+	req.Header.Set("X-Remote-Groups", "admins")
+	req.Header.Set("X-Custom", "spoofed")
+	req.Header.Set("Authorization", "Bearer client-token")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "|||||Bearer client-token", rw.Body.String())
+}
+
 type SignatureAuthenticator struct {
 	auth hmacauth.HmacAuth
 }
@@ -1378,3 +2072,76 @@ func Test_noCacheHeadersDoesNotExistsInResponseHeadersFromUpstream(t *testing.T)
 		assert.Equal(t, "", rec.Header().Get(k))
 	}
 }
+
+func TestAdminSessions(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.SessionOptions.Type = "memory"
+		opts.AdminToken = "admin-secret"
+	})
+	defer test.proxy.sessionStore.(io.Closer).Close()
+	test.proxy.provider = NewTestProvider(&url.URL{Host: "localhost"}, "")
+	// each login gets a session of its own
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		err := test.proxy.SaveSession(httptest.NewRecorder(), req, &sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()})
+		assert.NoError(t, err)
+	}
+
+	admin := func(method string, query string, token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/oauth2/admin/sessions"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		test.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	list := func() []sessions.SessionInfo {
+		rw := admin("GET", "?user=john.doe@example.com", "admin-secret")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var body struct {
+			Sessions []sessions.SessionInfo `json:"sessions"`
+		}
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &body))
+		return body.Sessions
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, admin("GET", "?user=john.doe@example.com", "wrong").Code)
+	// The token has to be sent with the Bearer scheme, in any case
+	for header, code := range map[string]int{
+		"admin-secret":        http.StatusUnauthorized,
+		"Basic admin-secret":  http.StatusUnauthorized,
+		"Bearer":              http.StatusUnauthorized,
+		"bearer admin-secret": http.StatusOK,
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/admin/sessions?user=john.doe@example.com", nil)
+		req.Header.Set("Authorization", header)
+		test.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, header)
+	}
+	assert.Equal(t, http.StatusBadRequest, admin("GET", "", "admin-secret").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, admin("POST", "?user=john.doe@example.com", "admin-secret").Code)
+
+	infos := list()
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, "Test Provider", infos[0].ProviderID)
+
+	assert.Equal(t, http.StatusNotFound, admin("DELETE", "?user=john.doe@example.com&id=00ff", "admin-secret").Code)
+	assert.Equal(t, http.StatusNoContent, admin("DELETE", "?user=john.doe@example.com&id="+infos[0].ID, "admin-secret").Code)
+	assert.Equal(t, []sessions.SessionInfo{infos[1]}, list())
+
+	assert.Equal(t, http.StatusNoContent, admin("DELETE", "?user=john.doe@example.com", "admin-secret").Code)
+	assert.Empty(t, list())
+}
+
+func TestAdminSessionsDisabled(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = NewTestProvider(&url.URL{Host: "localhost"}, "")
+
+	// without an admin token the path is proxied like any other, an empty
+	// bearer token must not match
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/admin/sessions?user=john.doe@example.com", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
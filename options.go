@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"crypto"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
@@ -20,7 +19,10 @@ import (
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
 	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
 	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+	"github.com/msepp/oauth2_proxy/v4/pkg/ldap"
 	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
+	"github.com/msepp/oauth2_proxy/v4/pkg/saml"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions"
 	"github.com/msepp/oauth2_proxy/v4/providers"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
@@ -52,11 +54,30 @@ type Options struct {
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group" env:"OAUTH2_PROXY_GOOGLE_GROUPS"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email" env:"OAUTH2_PROXY_GOOGLE_ADMIN_EMAIL"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json" env:"OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON"`
+	AllowedGroups            []string `flag:"allowed-group" cfg:"allowed_groups" env:"OAUTH2_PROXY_ALLOWED_GROUPS"`
+	AllowedRoles             []string `flag:"allowed-role" cfg:"allowed_roles" env:"OAUTH2_PROXY_ALLOWED_ROLES"`
+	OIDCSessionClaims        []string `flag:"oidc-session-claim" cfg:"oidc_session_claims" env:"OAUTH2_PROXY_OIDC_SESSION_CLAIMS"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file" env:"OAUTH2_PROXY_HTPASSWD_FILE"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form" env:"OAUTH2_PROXY_DISPLAY_HTPASSWD_FORM"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir" env:"OAUTH2_PROXY_CUSTOM_TEMPLATES_DIR"`
 	Banner                   string   `flag:"banner" cfg:"banner" env:"OAUTH2_PROXY_BANNER"`
 	Footer                   string   `flag:"footer" cfg:"footer" env:"OAUTH2_PROXY_FOOTER"`
+	AdminToken               string   `flag:"admin-token" cfg:"admin_token" env:"OAUTH2_PROXY_ADMIN_TOKEN"`
+
+	// LDAP checks the passwords of the sign in form and of basic auth, in
+	// addition to the htpasswd file
+	LDAPURL                   string        `flag:"ldap-url" cfg:"ldap_url" env:"OAUTH2_PROXY_LDAP_URL"`
+	LDAPStartTLS              bool          `flag:"ldap-start-tls" cfg:"ldap_start_tls" env:"OAUTH2_PROXY_LDAP_START_TLS"`
+	LDAPCAFiles               []string      `flag:"ldap-ca-file" cfg:"ldap_ca_files" env:"OAUTH2_PROXY_LDAP_CA_FILES"`
+	LDAPInsecureSkipTLSVerify bool          `flag:"ldap-insecure-skip-tls-verify" cfg:"ldap_insecure_skip_tls_verify" env:"OAUTH2_PROXY_LDAP_INSECURE_SKIP_TLS_VERIFY"`
+	LDAPBindDN                string        `flag:"ldap-bind-dn" cfg:"ldap_bind_dn" env:"OAUTH2_PROXY_LDAP_BIND_DN"`
+	LDAPBindPassword          string        `flag:"ldap-bind-password" cfg:"ldap_bind_password" env:"OAUTH2_PROXY_LDAP_BIND_PASSWORD"`
+	LDAPBaseDN                string        `flag:"ldap-base-dn" cfg:"ldap_base_dn" env:"OAUTH2_PROXY_LDAP_BASE_DN"`
+	LDAPUserFilter            string        `flag:"ldap-user-filter" cfg:"ldap_user_filter" env:"OAUTH2_PROXY_LDAP_USER_FILTER"`
+	LDAPEmailAttribute        string        `flag:"ldap-email-attribute" cfg:"ldap_email_attribute" env:"OAUTH2_PROXY_LDAP_EMAIL_ATTRIBUTE"`
+	LDAPGroupsAttribute       string        `flag:"ldap-groups-attribute" cfg:"ldap_groups_attribute" env:"OAUTH2_PROXY_LDAP_GROUPS_ATTRIBUTE"`
+	LDAPPoolSize              int           `flag:"ldap-pool-size" cfg:"ldap_pool_size" env:"OAUTH2_PROXY_LDAP_POOL_SIZE"`
+	LDAPTimeout               time.Duration `flag:"ldap-timeout" cfg:"ldap_timeout" env:"OAUTH2_PROXY_LDAP_TIMEOUT"`
 
 	// Embed CookieOptions
 	options.CookieOptions
@@ -68,6 +89,11 @@ type Options struct {
 	SkipAuthRegex                 []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex" env:"OAUTH2_PROXY_SKIP_AUTH_REGEX"`
 	SkipJwtBearerTokens           bool          `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens" env:"OAUTH2_PROXY_SKIP_JWT_BEARER_TOKENS"`
 	ExtraJwtIssuers               []string      `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers" env:"OAUTH2_PROXY_EXTRA_JWT_ISSUERS"`
+	IntrospectionURL              string        `flag:"token-introspection-url" cfg:"token_introspection_url" env:"OAUTH2_PROXY_TOKEN_INTROSPECTION_URL"`
+	IntrospectionClientID         string        `flag:"token-introspection-client-id" cfg:"token_introspection_client_id" env:"OAUTH2_PROXY_TOKEN_INTROSPECTION_CLIENT_ID"`
+	IntrospectionClientSecret     string        `flag:"token-introspection-client-secret" cfg:"token_introspection_client_secret" env:"OAUTH2_PROXY_TOKEN_INTROSPECTION_CLIENT_SECRET"`
+	IntrospectionAudiences        []string      `flag:"token-introspection-audience" cfg:"token_introspection_audiences" env:"OAUTH2_PROXY_TOKEN_INTROSPECTION_AUDIENCES"`
+	IntrospectionScopes           []string      `flag:"token-introspection-scope" cfg:"token_introspection_scopes" env:"OAUTH2_PROXY_TOKEN_INTROSPECTION_SCOPES"`
 	PassBasicAuth                 bool          `flag:"pass-basic-auth" cfg:"pass_basic_auth" env:"OAUTH2_PROXY_PASS_BASIC_AUTH"`
 	BasicAuthPassword             string        `flag:"basic-auth-password" cfg:"basic_auth_password" env:"OAUTH2_PROXY_BASIC_AUTH_PASSWORD"`
 	PassAccessToken               bool          `flag:"pass-access-token" cfg:"pass_access_token" env:"OAUTH2_PROXY_PASS_ACCESS_TOKEN"`
@@ -76,26 +102,50 @@ type Options struct {
 	PassUserHeaders               bool          `flag:"pass-user-headers" cfg:"pass_user_headers" env:"OAUTH2_PROXY_PASS_USER_HEADERS"`
 	SSLInsecureSkipVerify         bool          `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify" env:"OAUTH2_PROXY_SSL_INSECURE_SKIP_VERIFY"`
 	SSLUpstreamInsecureSkipVerify bool          `flag:"ssl-upstream-insecure-skip-verify" cfg:"ssl_upstream_insecure_skip_verify" env:"OAUTH2_PROXY_SSL_UPSTREAM_INSECURE_SKIP_VERIFY"`
+	UpstreamCAFiles               []string      `flag:"upstream-ca-file" cfg:"upstream_ca_files" env:"OAUTH2_PROXY_UPSTREAM_CA_FILES"`
+	UpstreamClientCertFile        string        `flag:"upstream-client-cert-file" cfg:"upstream_client_cert_file" env:"OAUTH2_PROXY_UPSTREAM_CLIENT_CERT_FILE"`
+	UpstreamClientKeyFile         string        `flag:"upstream-client-key-file" cfg:"upstream_client_key_file" env:"OAUTH2_PROXY_UPSTREAM_CLIENT_KEY_FILE"`
+	UpstreamProxyURL              string        `flag:"upstream-proxy-url" cfg:"upstream_proxy_url" env:"OAUTH2_PROXY_UPSTREAM_PROXY_URL"`
+	UpstreamDialTimeout           time.Duration `flag:"upstream-dial-timeout" cfg:"upstream_dial_timeout" env:"OAUTH2_PROXY_UPSTREAM_DIAL_TIMEOUT"`
+	UpstreamTimeout               time.Duration `flag:"upstream-timeout" cfg:"upstream_timeout" env:"OAUTH2_PROXY_UPSTREAM_TIMEOUT"`
 	SetXAuthRequest               bool          `flag:"set-xauthrequest" cfg:"set_xauthrequest" env:"OAUTH2_PROXY_SET_XAUTHREQUEST"`
 	SetAuthorization              bool          `flag:"set-authorization-header" cfg:"set_authorization_header" env:"OAUTH2_PROXY_SET_AUTHORIZATION_HEADER"`
 	PassAuthorization             bool          `flag:"pass-authorization-header" cfg:"pass_authorization_header" env:"OAUTH2_PROXY_PASS_AUTHORIZATION_HEADER"`
+	InjectRequestHeaders          []string      `flag:"inject-request-header" cfg:"inject_request_headers" env:"OAUTH2_PROXY_INJECT_REQUEST_HEADERS"`
+	InjectResponseHeaders         []string      `flag:"inject-response-header" cfg:"inject_response_headers" env:"OAUTH2_PROXY_INJECT_RESPONSE_HEADERS"`
+	StripRequestHeaders           []string      `flag:"strip-request-header" cfg:"strip_request_headers" env:"OAUTH2_PROXY_STRIP_REQUEST_HEADERS"`
 	SkipAuthPreflight             bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight" env:"OAUTH2_PROXY_SKIP_AUTH_PREFLIGHT"`
 	FlushInterval                 time.Duration `flag:"flush-interval" cfg:"flush_interval" env:"OAUTH2_PROXY_FLUSH_INTERVAL"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider                         string `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
-	OIDCIssuerURL                    string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
-	InsecureOIDCAllowUnverifiedEmail bool   `flag:"insecure-oidc-allow-unverified-email" cfg:"insecure_oidc_allow_unverified_email" env:"OAUTH2_PROXY_INSECURE_OIDC_ALLOW_UNVERIFIED_EMAIL"`
-	SkipOIDCDiscovery                bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY"`
-	OIDCJwksURL                      string `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_PROXY_OIDC_JWKS_URL"`
-	LoginURL                         string `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
-	RedeemURL                        string `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
-	ProfileURL                       string `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
-	ProtectedResource                string `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
-	ValidateURL                      string `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
-	Scope                            string `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
-	ApprovalPrompt                   string `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"`
+	Provider                         string        `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
+	OIDCIssuerURL                    string        `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
+	InsecureOIDCAllowUnverifiedEmail bool          `flag:"insecure-oidc-allow-unverified-email" cfg:"insecure_oidc_allow_unverified_email" env:"OAUTH2_PROXY_INSECURE_OIDC_ALLOW_UNVERIFIED_EMAIL"`
+	SkipOIDCDiscovery                bool          `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY"`
+	OIDCJwksURL                      string        `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_PROXY_OIDC_JWKS_URL"`
+	OIDCEndSessionURL                string        `flag:"oidc-end-session-url" cfg:"oidc_end_session_url" env:"OAUTH2_PROXY_OIDC_END_SESSION_URL"`
+	OIDCGroupsClaim                  string        `flag:"oidc-groups-claim" cfg:"oidc_groups_claim" env:"OAUTH2_PROXY_OIDC_GROUPS_CLAIM"`
+	OIDCRolesClaim                   string        `flag:"oidc-roles-claim" cfg:"oidc_roles_claim" env:"OAUTH2_PROXY_OIDC_ROLES_CLAIM"`
+	SAMLIDPMetadata                  string        `flag:"saml-idp-metadata" cfg:"saml_idp_metadata" env:"OAUTH2_PROXY_SAML_IDP_METADATA"`
+	SAMLEntityID                     string        `flag:"saml-entity-id" cfg:"saml_entity_id" env:"OAUTH2_PROXY_SAML_ENTITY_ID"`
+	SAMLEmailAttribute               string        `flag:"saml-email-attribute" cfg:"saml_email_attribute" env:"OAUTH2_PROXY_SAML_EMAIL_ATTRIBUTE"`
+	SAMLGroupsAttribute              string        `flag:"saml-groups-attribute" cfg:"saml_groups_attribute" env:"OAUTH2_PROXY_SAML_GROUPS_ATTRIBUTE"`
+	LoginURL                         string        `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
+	RedeemURL                        string        `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
+	ProfileURL                       string        `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
+	ProtectedResource                string        `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
+	ValidateURL                      string        `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
+	Scope                            string        `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
+	ApprovalPrompt                   string        `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"`
+	CodeChallengeMethod              string        `flag:"code-challenge-method" cfg:"code_challenge_method" env:"OAUTH2_PROXY_CODE_CHALLENGE_METHOD"`
+	MaxLoginDuration                 time.Duration `flag:"max-login-duration" cfg:"max_login_duration" env:"OAUTH2_PROXY_MAX_LOGIN_DURATION"`
+	ProviderTimeout                  time.Duration `flag:"provider-timeout" cfg:"provider_timeout" env:"OAUTH2_PROXY_PROVIDER_TIMEOUT"`
+	ProviderDialTimeout              time.Duration `flag:"provider-dial-timeout" cfg:"provider_dial_timeout" env:"OAUTH2_PROXY_PROVIDER_DIAL_TIMEOUT"`
+	ProviderCAFiles                  []string      `flag:"provider-ca-file" cfg:"provider_ca_files" env:"OAUTH2_PROXY_PROVIDER_CA_FILES"`
+	ProviderClientCertFile           string        `flag:"provider-client-cert-file" cfg:"provider_client_cert_file" env:"OAUTH2_PROXY_PROVIDER_CLIENT_CERT_FILE"`
+	ProviderClientKeyFile            string        `flag:"provider-client-key-file" cfg:"provider_client_key_file" env:"OAUTH2_PROXY_PROVIDER_CLIENT_KEY_FILE"`
+	ProviderProxyURL                 string        `flag:"provider-proxy-url" cfg:"provider_proxy_url" env:"OAUTH2_PROXY_PROVIDER_PROXY_URL"`
 
 	// Configuration values for logging
 	LoggingFilename       string `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_PROXY_LOGGING_FILENAME"`
@@ -119,6 +169,9 @@ type Options struct {
 	PubJWKURL             string `flag:"pubjwk-url" cfg:"pubjwk_url" env:"OAUTH2_PROXY_PUBJWK_URL"`
 	GCPHealthChecks       bool   `flag:"gcp-healthchecks" cfg:"gcp_healthchecks" env:"OAUTH2_PROXY_GCP_HEALTHCHECKS"`
 
+	// Providers can only be set in the config file, see ProviderOptions
+	Providers []ProviderOptions
+
 	// internal values that are set after config validation
 	redirectURL        *url.URL
 	proxyURLs          []*url.URL
@@ -127,7 +180,16 @@ type Options struct {
 	sessionStore       sessionsapi.SessionStore
 	signatureData      *SignatureData
 	oidcVerifier       *oidc.IDTokenVerifier
+	logoutVerifiers    []*oidc.IDTokenVerifier
+	stateCiphers       []*encryption.Cipher
 	jwtBearerVerifiers []*oidc.IDTokenVerifier
+	tokenIntrospector  *tokenIntrospector
+	requestHeaders     []identityHeader
+	responseHeaders    []identityHeader
+	signInProviders    []*signInProvider
+	providerClient     *http.Client
+	upstreamTransport  *http.Transport
+	ldapDirectory      userDirectory
 }
 
 // SignatureData holds hmacauth signature hash and key
@@ -145,6 +207,11 @@ func NewOptions() *Options {
 		HTTPAddress:         "127.0.0.1:4180",
 		HTTPSAddress:        ":443",
 		DisplayHtpasswdForm: true,
+		LDAPUserFilter:      "(uid={username})",
+		LDAPEmailAttribute:  "mail",
+		LDAPGroupsAttribute: "memberOf",
+		LDAPPoolSize:        5,
+		LDAPTimeout:         time.Duration(10) * time.Second,
 		CookieOptions: options.CookieOptions{
 			CookieName:     "_oauth2_proxy",
 			CookieSecure:   true,
@@ -154,7 +221,17 @@ func NewOptions() *Options {
 		},
 		SessionOptions: options.SessionOptions{
 			Type: "cookie",
+			// TODO: After appropriate rollout window, default to false
+			LegacyDecryption: true,
+			MemoryStoreOptions: options.MemoryStoreOptions{
+				MemoryMaxSessions:     10000,
+				MemoryCleanupInterval: time.Duration(1) * time.Minute,
+			},
+			FileStoreOptions: options.FileStoreOptions{
+				FileStoreCompactionInterval: time.Duration(1) * time.Hour,
+			},
 		},
+		UpstreamDialTimeout:              time.Duration(30) * time.Second,
 		SetXAuthRequest:                  false,
 		SkipAuthPreflight:                false,
 		PassBasicAuth:                    true,
@@ -164,8 +241,15 @@ func NewOptions() *Options {
 		SetAuthorization:                 false,
 		PassAuthorization:                false,
 		ApprovalPrompt:                   "force",
+		MaxLoginDuration:                 time.Duration(30) * time.Minute,
+		ProviderTimeout:                  time.Duration(30) * time.Second,
+		ProviderDialTimeout:              time.Duration(30) * time.Second,
 		InsecureOIDCAllowUnverifiedEmail: false,
 		SkipOIDCDiscovery:                false,
+		OIDCGroupsClaim:                  "groups",
+		OIDCRolesClaim:                   "roles",
+		SAMLEmailAttribute:               "email",
+		SAMLGroupsAttribute:              "groups",
 		LoggingFilename:                  "",
 		LoggingMaxSize:                   100,
 		LoggingMaxAge:                    7,
@@ -201,68 +285,49 @@ func parseURL(toParse string, urltype string, msgs []string) (*url.URL, []string
 // Validate checks that required options are set and validates those that they
 // are of the correct format
 func (o *Options) Validate() error {
-	if o.SSLInsecureSkipVerify {
-		// TODO: Accept a certificate bundle.
-		insecureTransport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		http.DefaultClient = &http.Client{Transport: insecureTransport}
-	}
-
 	msgs := make([]string, 0)
+	// The provider client must be set up before anything talks to the
+	// providers, OIDC discovery included
+	msgs = parseTransports(o, msgs)
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
-	if o.ClientID == "" {
-		msgs = append(msgs, "missing setting: client-id")
+	for _, secret := range o.PreviousCookieSecrets {
+		if secret == "" {
+			msgs = append(msgs, "invalid setting: previous-cookie-secret must not be empty")
+		}
 	}
-	// login.gov uses a signed JWT to authenticate, not a client-secret
-	if o.ClientSecret == "" && o.Provider != "login.gov" {
-		msgs = append(msgs, "missing setting: client-secret")
+	// Each of the [[providers]] has its own client
+	// SAML identity providers have no clients
+	if len(o.Providers) == 0 && o.Provider != "saml" {
+		if o.ClientID == "" {
+			msgs = append(msgs, "missing setting: client-id")
+		}
+		// login.gov uses a signed JWT to authenticate, not a client-secret
+		if o.ClientSecret == "" && o.Provider != "login.gov" {
+			msgs = append(msgs, "missing setting: client-secret")
+		}
 	}
 	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required."+
 			"\n      use email-domain=* to authorize all email addresses")
 	}
 
-	if o.OIDCIssuerURL != "" {
-
-		ctx := context.Background()
+	var err error
+	msgs, err = parseOIDCIssuer(o, msgs)
+	if err != nil {
+		return err
+	}
 
-		// Construct a manual IDTokenVerifier from issuer URL & JWKS URI
-		// instead of metadata discovery if we enable -skip-oidc-discovery.
-		// In this case we need to make sure the required endpoints for
-		// the provider are configured.
-		if o.SkipOIDCDiscovery {
-			if o.LoginURL == "" {
-				msgs = append(msgs, "missing setting: login-url")
-			}
-			if o.RedeemURL == "" {
-				msgs = append(msgs, "missing setting: redeem-url")
-			}
-			if o.OIDCJwksURL == "" {
-				msgs = append(msgs, "missing setting: oidc-jwks-url")
-			}
-			keySet := oidc.NewRemoteKeySet(ctx, o.OIDCJwksURL)
-			o.oidcVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet, &oidc.Config{
-				ClientID: o.ClientID,
-			})
-		} else {
-			// Configure discoverable provider data.
-			provider, err := oidc.NewProvider(ctx, o.OIDCIssuerURL)
-			if err != nil {
-				return err
-			}
-			o.oidcVerifier = provider.Verifier(&oidc.Config{
-				ClientID: o.ClientID,
-			})
+	switch o.CodeChallengeMethod {
+	case "", encryption.CodeChallengeMethodS256, encryption.CodeChallengeMethodPlain:
+	default:
+		msgs = append(msgs, fmt.Sprintf("unsupported code-challenge-method %q, expected %q or %q",
+			o.CodeChallengeMethod, encryption.CodeChallengeMethodS256, encryption.CodeChallengeMethodPlain))
+	}
 
-			o.LoginURL = provider.Endpoint().AuthURL
-			o.RedeemURL = provider.Endpoint().TokenURL
-		}
-		if o.Scope == "" {
-			o.Scope = "openid email profile"
-		}
+	if (len(o.AllowedGroups) > 0 || len(o.AllowedRoles) > 0) && o.Provider != "oidc" {
+		msgs = append(msgs, "allowed-group and allowed-role are only supported by the oidc provider")
 	}
 
 	if o.SkipJwtBearerTokens {
@@ -275,7 +340,7 @@ func (o *Options) Validate() error {
 			var jwtIssuers []jwtIssuer
 			jwtIssuers, msgs = parseJwtIssuers(o.ExtraJwtIssuers, msgs)
 			for _, jwtIssuer := range jwtIssuers {
-				verifier, err := newVerifierFromJwtIssuer(jwtIssuer)
+				verifier, err := newVerifierFromJwtIssuer(o.clientContext(), jwtIssuer)
 				if err != nil {
 					msgs = append(msgs, fmt.Sprintf("error building verifiers: %s", err))
 				}
@@ -306,46 +371,53 @@ func (o *Options) Validate() error {
 		}
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
-	msgs = parseProviderInfo(o, msgs)
+	if len(o.Providers) > 0 {
+		msgs, err = parseProviders(o, msgs)
+		if err != nil {
+			return err
+		}
+	} else {
+		msgs = parseProviderInfo(o, msgs)
+	}
+	msgs = parseIdentityHeaders(o, msgs)
+	msgs = parseLDAP(o, msgs)
+	msgs = parseTokenIntrospection(o, msgs)
 
 	var cipher *encryption.Cipher
-	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.CookieRefresh != time.Duration(0)) {
-		validCookieSecretSize := false
-		for _, i := range []int{16, 24, 32} {
-			if len(secretBytes(o.CookieSecret)) == i {
-				validCookieSecretSize = true
-			}
-		}
-		var decoded bool
-		if string(secretBytes(o.CookieSecret)) != o.CookieSecret {
-			decoded = true
+	// The ID token has to be kept in the session to authorize requests
+	// against the allowed groups and roles
+	authorizeClaims := len(o.AllowedGroups) > 0 || len(o.AllowedRoles) > 0
+	for _, po := range o.Providers {
+		authorizeClaims = authorizeClaims || len(po.AllowedGroups) > 0 || len(po.AllowedRoles) > 0
+	}
+	headerTokens := headersUseTokens(o.InjectRequestHeaders) || headersUseTokens(o.InjectResponseHeaders)
+	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.CookieRefresh != time.Duration(0)) || authorizeClaims || headerTokens {
+		cipher, msgs = newCookieCipher("cookie_secret", o.CookieSecret, o.CookieName, msgs)
+		o.SessionOptions.PreviousCiphers = nil
+		for _, secret := range o.PreviousCookieSecrets {
+			var previous *encryption.Cipher
+			previous, msgs = newCookieCipher("previous_cookie_secret", secret, o.CookieName, msgs)
+			o.SessionOptions.PreviousCiphers = append(o.SessionOptions.PreviousCiphers, previous)
 		}
-		if validCookieSecretSize == false {
-			var suffix string
-			if decoded {
-				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", o.CookieSecret)
-			}
-			msgs = append(msgs, fmt.Sprintf(
-				"cookie_secret must be 16, 24, or 32 bytes "+
-					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
-				len(secretBytes(o.CookieSecret)), suffix))
-		} else {
-			var err error
-			cipher, err = encryption.NewCipher(secretBytes(o.CookieSecret))
-			if err != nil {
-				msgs = append(msgs, fmt.Sprintf("cookie-secret error: %v", err))
+	}
+
+	if !o.SessionOptions.LegacyDecryption {
+		for _, c := range append([]*encryption.Cipher{cipher}, o.SessionOptions.PreviousCiphers...) {
+			if c != nil {
+				c.DisableLegacyDecryption()
 			}
 		}
 	}
-
 	o.SessionOptions.Cipher = cipher
 	sessionStore, err := sessions.NewSessionStore(&o.SessionOptions, &o.CookieOptions)
 	if err != nil {
 		msgs = append(msgs, fmt.Sprintf("error initialising session storage: %v", err))
 	} else {
 		o.sessionStore = sessionStore
+		if _, ok := sessionStore.(sessionsapi.ManageableSessionStore); o.AdminToken != "" && !ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"admin_token requires a server side session store, not %q", o.SessionOptions.Type))
+		}
 	}
 
 	if o.CookieRefresh >= o.CookieExpire {
@@ -356,18 +428,39 @@ func (o *Options) Validate() error {
 			o.CookieExpire.String()))
 	}
 
-	if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
-		if len(o.GoogleGroups) < 1 {
-			msgs = append(msgs, "missing setting: google-group")
-		}
-		if o.GoogleAdminEmail == "" {
-			msgs = append(msgs, "missing setting: google-admin-email")
-		}
-		if o.GoogleServiceAccountJSON == "" {
-			msgs = append(msgs, "missing setting: google-service-account-json")
+	if o.CookieIdleTimeout < 0 || o.CookieIdleTimeout >= o.CookieExpire {
+		msgs = append(msgs, fmt.Sprintf(
+			"cookie_idle_timeout (%s) must be between 0 and "+
+				"cookie_expire (%s)",
+			o.CookieIdleTimeout.String(),
+			o.CookieExpire.String()))
+	}
+
+	if o.MaxLoginDuration <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"max_login_duration (%s) must be positive",
+			o.MaxLoginDuration.String()))
+	}
+
+	// The state of logins is encrypted under keys derived from the cookie
+	// secrets, whether sessions are encrypted or not
+	o.stateCiphers = nil
+	for _, secret := range o.CookieSecrets() {
+		stateCipher, err := encryption.NewStateCipher(secretBytes(secret))
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error creating the state cipher: %v", err))
+			break
 		}
+		o.stateCiphers = append(o.stateCiphers, stateCipher)
+	}
+
+	if o.ProviderTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"provider_timeout (%s) must not be negative",
+			o.ProviderTimeout.String()))
 	}
 
+	msgs = validateGoogleGroups(o, msgs)
 	msgs = parseSignatureKey(o, msgs)
 	msgs = validateCookieName(o, msgs)
 	msgs = setupLogger(o, msgs)
@@ -379,6 +472,160 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// parseOIDCIssuer sets up the ID and logout token verifiers of the OIDC
+// issuer, and the provider endpoints from its discovery document
+func parseOIDCIssuer(o *Options, msgs []string) ([]string, error) {
+	if o.OIDCIssuerURL == "" {
+		return msgs, nil
+	}
+
+	ctx := o.clientContext()
+
+	// Construct a manual IDTokenVerifier from issuer URL & JWKS URI
+	// instead of metadata discovery if we enable -skip-oidc-discovery.
+	// In this case we need to make sure the required endpoints for
+	// the provider are configured.
+	if o.SkipOIDCDiscovery {
+		if o.LoginURL == "" {
+			msgs = append(msgs, "missing setting: login-url")
+		}
+		if o.RedeemURL == "" {
+			msgs = append(msgs, "missing setting: redeem-url")
+		}
+		if o.OIDCJwksURL == "" {
+			msgs = append(msgs, "missing setting: oidc-jwks-url")
+		}
+		keySet := oidc.NewRemoteKeySet(ctx, o.OIDCJwksURL)
+		o.oidcVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet, &oidc.Config{
+			ClientID: o.ClientID,
+		})
+		o.logoutVerifiers = append(o.logoutVerifiers,
+			oidc.NewVerifier(o.OIDCIssuerURL, keySet, logoutVerifierConfig(o.ClientID)))
+	} else {
+		// Configure discoverable provider data.
+		provider, err := oidc.NewProvider(ctx, o.OIDCIssuerURL)
+		if err != nil {
+			return msgs, err
+		}
+		o.oidcVerifier = provider.Verifier(&oidc.Config{
+			ClientID: o.ClientID,
+		})
+		o.logoutVerifiers = append(o.logoutVerifiers, provider.Verifier(logoutVerifierConfig(o.ClientID)))
+
+		o.LoginURL = provider.Endpoint().AuthURL
+		o.RedeemURL = provider.Endpoint().TokenURL
+
+		// The end_session_endpoint is optional, a configured URL takes
+		// precedence over the discovered one
+		var endpoints struct {
+			EndSessionURL string `json:"end_session_endpoint"`
+		}
+		if err := provider.Claims(&endpoints); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing oidc discovery document: %v", err))
+		}
+		if o.OIDCEndSessionURL == "" {
+			o.OIDCEndSessionURL = endpoints.EndSessionURL
+		}
+	}
+	if o.Scope == "" {
+		o.Scope = "openid email profile"
+	}
+	return msgs, nil
+}
+
+// parseTransports sets up the client of the providers and the transport of
+// the upstream proxies. The client is shared by the providers once
+// NewOAuthProxy is called, the deadlines of the requests are set by their
+// contexts.
+func parseTransports(o *Options, msgs []string) []string {
+	transport, err := requests.NewTransport(requests.TransportOptions{
+		CAFiles:            o.ProviderCAFiles,
+		ClientCertFile:     o.ProviderClientCertFile,
+		ClientKeyFile:      o.ProviderClientKeyFile,
+		InsecureSkipVerify: o.SSLInsecureSkipVerify,
+		ProxyURL:           o.ProviderProxyURL,
+		DialTimeout:        o.ProviderDialTimeout,
+	})
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid provider transport: %v", err))
+	} else {
+		o.providerClient = &http.Client{Transport: transport}
+	}
+
+	o.upstreamTransport, err = requests.NewTransport(requests.TransportOptions{
+		CAFiles:               o.UpstreamCAFiles,
+		ClientCertFile:        o.UpstreamClientCertFile,
+		ClientKeyFile:         o.UpstreamClientKeyFile,
+		InsecureSkipVerify:    o.SSLUpstreamInsecureSkipVerify,
+		ProxyURL:              o.UpstreamProxyURL,
+		DialTimeout:           o.UpstreamDialTimeout,
+		ResponseHeaderTimeout: o.UpstreamTimeout,
+	})
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid upstream transport: %v", err))
+	}
+	return msgs
+}
+
+// clientContext returns a context making the requests of the setup with the
+// provider client, as it isn't shared yet
+func (o *Options) clientContext() context.Context {
+	if o.providerClient == nil {
+		return requests.ClientContext(context.Background())
+	}
+	return requests.WithClient(context.Background(), o.providerClient)
+}
+
+// newCookieCipher creates the cipher of a cookie secret for the cookie, name
+// is the setting the secret comes from
+func newCookieCipher(name string, secret string, cookieName string, msgs []string) (*encryption.Cipher, []string) {
+	validCookieSecretSize := false
+	for _, i := range []int{16, 24, 32} {
+		if len(secretBytes(secret)) == i {
+			validCookieSecretSize = true
+		}
+	}
+	var decoded bool
+	if string(secretBytes(secret)) != secret {
+		decoded = true
+	}
+	if validCookieSecretSize == false {
+		var suffix string
+		if decoded {
+			suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", secret)
+		}
+		msgs = append(msgs, fmt.Sprintf(
+			"%s must be 16, 24, or 32 bytes "+
+				"to create an AES cipher when "+
+				"pass_access_token == true, "+
+				"allowed_groups or allowed_roles are set, "+
+				"injected headers use tokens or "+
+				"cookie_refresh != 0, but is %d bytes.%s",
+			name, len(secretBytes(secret)), suffix))
+		return nil, msgs
+	}
+	cipher, err := encryption.NewCookieCipher(secretBytes(secret), cookieName)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("%s error: %v", name, err))
+	}
+	return cipher, msgs
+}
+
+func validateGoogleGroups(o *Options, msgs []string) []string {
+	if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
+		if len(o.GoogleGroups) < 1 {
+			msgs = append(msgs, "missing setting: google-group")
+		}
+		if o.GoogleAdminEmail == "" {
+			msgs = append(msgs, "missing setting: google-admin-email")
+		}
+		if o.GoogleServiceAccountJSON == "" {
+			msgs = append(msgs, "missing setting: google-service-account-json")
+		}
+	}
+	return msgs
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
 		Scope:          o.Scope,
@@ -404,7 +651,7 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			if err != nil {
 				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
 			} else {
-				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+				p.SetGroupRestriction(o.clientContext(), o.GoogleGroups, o.GoogleAdminEmail, file)
 			}
 		}
 	case *providers.BitbucketProvider:
@@ -412,6 +659,12 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		p.SetRepository(o.BitbucketRepository)
 	case *providers.OIDCProvider:
 		p.AllowUnverifiedEmail = o.InsecureOIDCAllowUnverifiedEmail
+		p.AllowedGroups = o.AllowedGroups
+		p.AllowedRoles = o.AllowedRoles
+		p.GroupsClaim = o.OIDCGroupsClaim
+		p.RolesClaim = o.OIDCRolesClaim
+		p.SessionClaims = o.OIDCSessionClaims
+		p.EndSessionURL, msgs = parseURL(o.OIDCEndSessionURL, "oidc-end-session", msgs)
 		if o.oidcVerifier == nil {
 			msgs = append(msgs, "oidc provider requires an oidc issuer URL")
 		} else {
@@ -426,7 +679,7 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			p.Verifier = o.oidcVerifier
 		} else {
 			// Initialize with default verifier for gitlab.com
-			ctx := context.Background()
+			ctx := o.clientContext()
 
 			provider, err := oidc.NewProvider(ctx, "https://gitlab.com")
 			if err != nil {
@@ -471,6 +724,136 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 				p.JWTKey = signKey
 			}
 		}
+	case *providers.SAMLProvider:
+		p.EmailAttribute = o.SAMLEmailAttribute
+		p.GroupsAttribute = o.SAMLGroupsAttribute
+		msgs = parseSAMLServiceProvider(o, p, msgs)
+	}
+	return msgs
+}
+
+// parseSAMLServiceProvider loads the metadata of the SAML identity provider.
+// The assertion consumer service URL, and the entity ID unless set, are
+// derived from the redirect URL, which has to be absolute.
+func parseSAMLServiceProvider(o *Options, p *providers.SAMLProvider, msgs []string) []string {
+	if o.redirectURL == nil || o.redirectURL.Host == "" {
+		return append(msgs, "saml provider requires an absolute redirect-url")
+	}
+	if o.SAMLIDPMetadata == "" {
+		return append(msgs, "saml provider requires saml-idp-metadata")
+	}
+	// The metadata holds the certificates trusted to sign assertions
+	if strings.HasPrefix(o.SAMLIDPMetadata, "http://") {
+		return append(msgs, "saml-idp-metadata has to be a https URL or a file")
+	}
+	base := url.URL{Scheme: o.redirectURL.Scheme, Host: o.redirectURL.Host, Path: o.ProxyPrefix}
+	p.SP = &saml.ServiceProvider{
+		EntityID: o.SAMLEntityID,
+		ACSURL:   base.String() + "/saml/acs",
+	}
+	if p.SP.EntityID == "" {
+		p.SP.EntityID = base.String() + "/saml/metadata"
+	}
+	idp, err := saml.LoadIdentityProvider(o.clientContext(), o.SAMLIDPMetadata)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading saml-idp-metadata: %v", err))
+	}
+	p.SP.IDP = idp
+	return msgs
+}
+
+// parseLDAP sets up the LDAP directory checking the passwords of the sign in
+// form and of basic auth. Connections are only made once users sign in.
+func parseLDAP(o *Options, msgs []string) []string {
+	o.ldapDirectory = nil
+	if o.LDAPURL == "" {
+		return msgs
+	}
+	if o.LDAPBaseDN == "" {
+		return append(msgs, "missing setting: ldap-base-dn")
+	}
+	if o.LDAPPoolSize < 1 {
+		return append(msgs, "invalid setting: ldap-pool-size must be at least 1")
+	}
+	tlsConfig, err := requests.NewTLSConfig(requests.TransportOptions{
+		CAFiles:            o.LDAPCAFiles,
+		InsecureSkipVerify: o.LDAPInsecureSkipTLSVerify,
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading ldap-ca-file: %v", err))
+	}
+	authenticator, err := ldap.NewAuthenticator(ldap.Config{
+		URL:             o.LDAPURL,
+		StartTLS:        o.LDAPStartTLS,
+		TLSConfig:       tlsConfig,
+		BindDN:          o.LDAPBindDN,
+		BindPassword:    o.LDAPBindPassword,
+		BaseDN:          o.LDAPBaseDN,
+		UserFilter:      o.LDAPUserFilter,
+		EmailAttribute:  o.LDAPEmailAttribute,
+		GroupsAttribute: o.LDAPGroupsAttribute,
+		PoolSize:        o.LDAPPoolSize,
+		Timeout:         o.LDAPTimeout,
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid ldap settings: %v", err))
+	}
+	o.ldapDirectory = authenticator
+	return msgs
+}
+
+// parseTokenIntrospection sets up checking opaque bearer tokens at the
+// introspection endpoint, with the client credentials of the proxy unless
+// others are configured
+func parseTokenIntrospection(o *Options, msgs []string) []string {
+	o.tokenIntrospector = nil
+	if o.IntrospectionURL == "" {
+		return msgs
+	}
+	u, msgs := parseURL(o.IntrospectionURL, "token-introspection", msgs)
+	if u == nil {
+		return msgs
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(msgs, fmt.Sprintf("invalid setting: token-introspection-url=%q must be an absolute http(s) url", o.IntrospectionURL))
+	}
+	clientID, clientSecret := o.IntrospectionClientID, o.IntrospectionClientSecret
+	if clientID == "" {
+		clientID, clientSecret = o.ClientID, o.ClientSecret
+	}
+	if clientID == "" {
+		return append(msgs, "missing setting: token-introspection-client-id")
+	}
+	if clientSecret == "" {
+		return append(msgs, "missing setting: token-introspection-client-secret")
+	}
+	audiences := o.IntrospectionAudiences
+	if len(audiences) == 0 {
+		audiences = []string{clientID}
+	}
+	o.tokenIntrospector = newTokenIntrospector(u, clientID, clientSecret, audiences, o.IntrospectionScopes, o.ProviderTimeout)
+	return msgs
+}
+
+func parseIdentityHeaders(o *Options, msgs []string) []string {
+	funcs := headerFuncs(o.BasicAuthPassword)
+	o.requestHeaders = nil
+	for _, spec := range append(presetRequestHeaders(o), o.InjectRequestHeaders...) {
+		header, err := newIdentityHeader(spec, funcs)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing inject-request-header: %v", err))
+			continue
+		}
+		o.requestHeaders = append(o.requestHeaders, header)
+	}
+	o.responseHeaders = nil
+	for _, spec := range append(presetResponseHeaders(o), o.InjectResponseHeaders...) {
+		header, err := newIdentityHeader(spec, funcs)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing inject-response-header: %v", err))
+			continue
+		}
+		o.responseHeaders = append(o.responseHeaders, header)
 	}
 	return msgs
 }
@@ -514,14 +897,14 @@ func parseJwtIssuers(issuers []string, msgs []string) ([]jwtIssuer, []string) {
 }
 
 // newVerifierFromJwtIssuer takes in issuer information in jwtIssuer info and returns
-// a verifier for that issuer.
-func newVerifierFromJwtIssuer(jwtIssuer jwtIssuer) (*oidc.IDTokenVerifier, error) {
+// a verifier for that issuer, fetching its keys with the client of ctx.
+func newVerifierFromJwtIssuer(ctx context.Context, jwtIssuer jwtIssuer) (*oidc.IDTokenVerifier, error) {
 	config := &oidc.Config{
 		ClientID: jwtIssuer.audience,
 	}
 	// Try as an OpenID Connect Provider first
 	var verifier *oidc.IDTokenVerifier
-	provider, err := oidc.NewProvider(context.Background(), jwtIssuer.issuerURI)
+	provider, err := oidc.NewProvider(ctx, jwtIssuer.issuerURI)
 	if err != nil {
 		// Try as JWKS URI
 		jwksURI := strings.TrimSuffix(jwtIssuer.issuerURI, "/") + "/.well-known/jwks.json"
@@ -529,7 +912,7 @@ func newVerifierFromJwtIssuer(jwtIssuer jwtIssuer) (*oidc.IDTokenVerifier, error
 		if err != nil {
 			return nil, err
 		}
-		verifier = oidc.NewVerifier(jwtIssuer.issuerURI, oidc.NewRemoteKeySet(context.Background(), jwksURI), config)
+		verifier = oidc.NewVerifier(jwtIssuer.issuerURI, oidc.NewRemoteKeySet(ctx, jwksURI), config)
 	} else {
 		verifier = provider.Verifier(config)
 	}
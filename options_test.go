@@ -2,12 +2,24 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
+	"github.com/msepp/oauth2_proxy/v4/providers"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,6 +65,31 @@ func TestGoogleGroupOptions(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestAllowedGroupsRequireOIDCProvider(t *testing.T) {
+	o := testOptions()
+	o.AllowedGroups = []string{"admins"}
+	o.CookieSecret = "16 bytes AES-128"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"allowed-group and allowed-role are only supported by the oidc provider"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestInjectHeadersInvalidSpec(t *testing.T) {
+	o := testOptions()
+	o.InjectRequestHeaders = []string{"X-Remote-User"}
+	o.InjectResponseHeaders = []string{"X-Remote-User={{.User"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"error parsing inject-request-header: invalid header spec \"X-Remote-User\": expected name=template",
+		"error parsing inject-response-header: invalid template for header \"X-Remote-User\": template: X-Remote-User:1: unclosed action"})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestGoogleGroupInvalidFile(t *testing.T) {
 	o := testOptions()
 	o.GoogleGroups = []string{"test_group"}
@@ -107,6 +144,43 @@ func TestProxyURLsError(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestTransportsInvalidCAFile(t *testing.T) {
+	o := testOptions()
+	o.ProviderCAFiles = []string{"/does/not/exist.pem"}
+	o.UpstreamProxyURL = "http://[::1"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid provider transport: could not read CA file")
+	assert.Contains(t, err.Error(), "invalid upstream transport: invalid proxy url")
+}
+
+func TestProviderClient(t *testing.T) {
+	defer requests.SetClient(requests.Client())
+	shared := requests.Client()
+	o := testOptions()
+	o.ProviderTimeout = time.Minute
+	assert.Equal(t, nil, o.Validate())
+	// Validating the options doesn't change the shared client
+	assert.Equal(t, shared, requests.Client())
+	// The deadlines are set by the contexts of the requests
+	assert.Equal(t, time.Duration(0), o.providerClient.Timeout)
+
+	NewOAuthProxy(o, func(string) bool { return true })
+	assert.Equal(t, o.providerClient, requests.Client())
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	o := testOptions()
+	o.UpstreamTimeout = time.Minute
+	o.SSLUpstreamInsecureSkipVerify = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, time.Minute, o.upstreamTransport.ResponseHeaderTimeout)
+	assert.Equal(t, true, o.upstreamTransport.TLSClientConfig.InsecureSkipVerify)
+
+	proxy := NewReverseProxy(o.proxyURLs[0], o)
+	assert.Equal(t, o.upstreamTransport, proxy.Transport)
+}
+
 func TestCompiledRegex(t *testing.T) {
 	o := testOptions()
 	regexps := []string{"/foo/.*", "/ba[rz]/quux"}
@@ -269,6 +343,53 @@ func TestSkipOIDCDiscovery(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestSAMLProvider(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	metadata, err := ioutil.TempFile("", "idp-metadata")
+	assert.NoError(t, err)
+	defer os.Remove(metadata.Name())
+	fmt.Fprintf(metadata, `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com">
+	<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<md:KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+		<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+	</md:IDPSSODescriptor>
+</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(cert))
+	metadata.Close()
+
+	o := testOptions()
+	o.ClientID = ""
+	o.ClientSecret = ""
+	o.Provider = "saml"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"saml provider requires an absolute redirect-url"}), err.Error())
+
+	o.RedirectURL = "https://proxy.example.com/oauth2/callback"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"saml provider requires saml-idp-metadata"}), err.Error())
+
+	o.SAMLIDPMetadata = "http://idp.example.com/metadata"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"saml-idp-metadata has to be a https URL or a file"}), err.Error())
+
+	o.SAMLIDPMetadata = metadata.Name()
+	assert.NoError(t, o.Validate())
+	p, ok := o.provider.(*providers.SAMLProvider)
+	assert.True(t, ok)
+	assert.Equal(t, "https://proxy.example.com/oauth2/saml/metadata", p.SP.EntityID)
+	assert.Equal(t, "https://proxy.example.com/oauth2/saml/acs", p.SP.ACSURL)
+	assert.Equal(t, "https://idp.example.com", p.SP.IDP.EntityID)
+	assert.Equal(t, "email", p.EmailAttribute)
+	assert.Equal(t, "groups", p.GroupsAttribute)
+
+	o.SAMLEntityID = "urn:proxy"
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, "urn:proxy", o.provider.(*providers.SAMLProvider).SP.EntityID)
+}
+
 func TestGCPHealthcheck(t *testing.T) {
 	o := testOptions()
 	o.GCPHealthChecks = true
@@ -1,13 +1,25 @@
 package options
 
-import "github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+import (
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+)
 
 // SessionOptions contains configuration options for the SessionStore providers.
 type SessionOptions struct {
 	Type   string `flag:"session-store-type" cfg:"session_store_type" env:"OAUTH2_PROXY_SESSION_STORE_TYPE"`
 	Cipher *encryption.Cipher
+	// PreviousCiphers decrypt sessions saved with the previous cookie
+	// secrets, in the same order
+	PreviousCiphers []*encryption.Cipher
+	// LegacyDecryption accepts sessions encrypted with AES-CFB by older
+	// versions, which has no integrity protection
+	LegacyDecryption bool `flag:"session-legacy-decryption" cfg:"session_legacy_decryption" env:"OAUTH2_PROXY_SESSION_LEGACY_DECRYPTION"`
 	CookieStoreOptions
 	RedisStoreOptions
+	MemoryStoreOptions
+	FileStoreOptions
 }
 
 // CookieSessionStoreType is used to indicate the CookieSessionStore should be
@@ -27,4 +39,48 @@ type RedisStoreOptions struct {
 	UseSentinel            bool     `flag:"redis-use-sentinel" cfg:"redis_use_sentinel" env:"OAUTH2_PROXY_REDIS_USE_SENTINEL"`
 	SentinelMasterName     string   `flag:"redis-sentinel-master-name" cfg:"redis_sentinel_master_name" env:"OAUTH2_PROXY_REDIS_SENTINEL_MASTER_NAME"`
 	SentinelConnectionURLs []string `flag:"redis-sentinel-connection-urls" cfg:"redis_sentinel_connection_urls" env:"OAUTH2_PROXY_REDIS_SENTINEL_CONNECTION_URLS"`
+	SentinelPassword       string   `flag:"redis-sentinel-password" cfg:"redis_sentinel_password" env:"OAUTH2_PROXY_REDIS_SENTINEL_PASSWORD"`
+	UseCluster             bool     `flag:"redis-use-cluster" cfg:"redis_use_cluster" env:"OAUTH2_PROXY_REDIS_USE_CLUSTER"`
+	ClusterConnectionURLs  []string `flag:"redis-cluster-connection-urls" cfg:"redis_cluster_connection_urls" env:"OAUTH2_PROXY_REDIS_CLUSTER_CONNECTION_URLS"`
+	// RedisUsername and RedisPassword override the credentials of the
+	// connection URLs
+	RedisUsername string `flag:"redis-username" cfg:"redis_username" env:"OAUTH2_PROXY_REDIS_USERNAME"`
+	RedisPassword string `flag:"redis-password" cfg:"redis_password" env:"OAUTH2_PROXY_REDIS_PASSWORD"`
+	// RedisDB overrides the database of the connection URL when not 0.
+	// Cluster mode only supports database 0.
+	RedisDB        int    `flag:"redis-db" cfg:"redis_db" env:"OAUTH2_PROXY_REDIS_DB"`
+	RedisKeyPrefix string `flag:"redis-key-prefix" cfg:"redis_key_prefix" env:"OAUTH2_PROXY_REDIS_KEY_PREFIX"`
+	// The TLS settings apply to rediss:// connection URLs
+	RedisCAFiles               []string `flag:"redis-ca-file" cfg:"redis_ca_files" env:"OAUTH2_PROXY_REDIS_CA_FILES"`
+	RedisClientCertFile        string   `flag:"redis-client-cert-file" cfg:"redis_client_cert_file" env:"OAUTH2_PROXY_REDIS_CLIENT_CERT_FILE"`
+	RedisClientKeyFile         string   `flag:"redis-client-key-file" cfg:"redis_client_key_file" env:"OAUTH2_PROXY_REDIS_CLIENT_KEY_FILE"`
+	RedisInsecureSkipTLSVerify bool     `flag:"redis-insecure-skip-tls-verify" cfg:"redis_insecure_skip_tls_verify" env:"OAUTH2_PROXY_REDIS_INSECURE_SKIP_TLS_VERIFY"`
+	// The pool and timeout settings use the defaults of the redis client
+	// when 0
+	RedisPoolSize     int           `flag:"redis-pool-size" cfg:"redis_pool_size" env:"OAUTH2_PROXY_REDIS_POOL_SIZE"`
+	RedisDialTimeout  time.Duration `flag:"redis-dial-timeout" cfg:"redis_dial_timeout" env:"OAUTH2_PROXY_REDIS_DIAL_TIMEOUT"`
+	RedisReadTimeout  time.Duration `flag:"redis-read-timeout" cfg:"redis_read_timeout" env:"OAUTH2_PROXY_REDIS_READ_TIMEOUT"`
+	RedisWriteTimeout time.Duration `flag:"redis-write-timeout" cfg:"redis_write_timeout" env:"OAUTH2_PROXY_REDIS_WRITE_TIMEOUT"`
+	RedisPoolTimeout  time.Duration `flag:"redis-pool-timeout" cfg:"redis_pool_timeout" env:"OAUTH2_PROXY_REDIS_POOL_TIMEOUT"`
+	RedisIdleTimeout  time.Duration `flag:"redis-idle-timeout" cfg:"redis_idle_timeout" env:"OAUTH2_PROXY_REDIS_IDLE_TIMEOUT"`
+}
+
+// MemorySessionStoreType is used to indicate the memory SessionStore should
+// be used for storing sessions.
+var MemorySessionStoreType = "memory"
+
+// MemoryStoreOptions contains configuration options for the memory SessionStore.
+type MemoryStoreOptions struct {
+	MemoryMaxSessions     int           `flag:"memory-max-sessions" cfg:"memory_max_sessions" env:"OAUTH2_PROXY_MEMORY_MAX_SESSIONS"`
+	MemoryCleanupInterval time.Duration `flag:"memory-cleanup-interval" cfg:"memory_cleanup_interval" env:"OAUTH2_PROXY_MEMORY_CLEANUP_INTERVAL"`
+}
+
+// FileSessionStoreType is used to indicate the file SessionStore should be
+// used for storing sessions.
+var FileSessionStoreType = "file"
+
+// FileStoreOptions contains configuration options for the file SessionStore.
+type FileStoreOptions struct {
+	FileStorePath               string        `flag:"file-store-path" cfg:"file_store_path" env:"OAUTH2_PROXY_FILE_STORE_PATH"`
+	FileStoreCompactionInterval time.Duration `flag:"file-store-compaction-interval" cfg:"file_store_compaction_interval" env:"OAUTH2_PROXY_FILE_STORE_COMPACTION_INTERVAL"`
 }
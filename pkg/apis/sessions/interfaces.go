@@ -1,12 +1,65 @@
 package sessions
 
 import (
+	"errors"
 	"net/http"
+	"time"
 )
 
+// ErrSessionNotFound is returned when there is no such session to clear
+var ErrSessionNotFound = errors.New("session not found")
+
 // SessionStore is an interface to storing user sessions in the proxy
 type SessionStore interface {
 	Save(rw http.ResponseWriter, req *http.Request, s *SessionState) error
 	Load(req *http.Request) (*SessionState, error)
 	Clear(rw http.ResponseWriter, req *http.Request) error
 }
+
+// RevocableSessionStore is implemented by session stores that keep sessions
+// server side, so they can be revoked without the user's cookie
+type RevocableSessionStore interface {
+	SessionStore
+	// ClearBySubject clears all sessions of the OIDC subject of the issuer
+	ClearBySubject(issuer string, subject string) error
+	// ClearBySessionID clears all sessions with the OIDC session ID of the
+	// issuer
+	ClearBySessionID(issuer string, sid string) error
+	// ClearByUser clears all sessions of the user, as identified by
+	// SessionState.UserKey
+	ClearByUser(user string) error
+}
+
+// ManageableSessionStore is implemented by server side session stores that
+// can list the sessions of a user, for the admin API
+type ManageableSessionStore interface {
+	RevocableSessionStore
+	// ListByUser returns the sessions of the user
+	ListByUser(user string) ([]SessionInfo, error)
+	// ClearByID clears the session of the user with the ID, or returns
+	// ErrSessionNotFound when the user has no such session
+	ClearByID(user string, id string) error
+}
+
+// LockingSessionStore is implemented by session stores that can lock a
+// session while it is refreshed, so that instances of the proxy sharing the
+// store don't refresh it concurrently
+type LockingSessionStore interface {
+	SessionStore
+	// Lock obtains the lock of the session of the request, expiring after
+	// expiration. It returns the token of the lock, or "" when the lock is
+	// held already.
+	Lock(req *http.Request, expiration time.Duration) (string, error)
+	// Unlock releases the lock of the session of the request with the token
+	// returned by Lock, unless it expired and was obtained by another since
+	Unlock(req *http.Request, lock string) error
+}
+
+// SessionInfo describes a session kept by a server side session store,
+// without any of its secrets
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	ProviderID string    `json:"provider,omitempty"`
+}
@@ -16,16 +16,31 @@ type SessionState struct {
 	IDToken      string    `json:",omitempty"`
 	CreatedAt    time.Time `json:"-"`
 	ExpiresOn    time.Time `json:"-"`
+	LastSeenAt   time.Time `json:"-"`
 	RefreshToken string    `json:",omitempty"`
 	Email        string    `json:",omitempty"`
 	User         string    `json:",omitempty"`
+
+	// Groups and Claims hold additional information the provider learned
+	// about the user, eg: group memberships, preferred_username or tenant ID
+	Groups []string               `json:",omitempty"`
+	Claims map[string]interface{} `json:",omitempty"`
+
+	// ProviderID is the ID of the provider the user signed in with, when
+	// more than one is configured. It is not a secret so never encrypted.
+	ProviderID string `json:",omitempty"`
+
+	// Rotated is set by the session stores when the session was saved with
+	// a previous cookie secret, so it gets saved again with the current one
+	Rotated bool `json:"-"`
 }
 
 // SessionStateJSON is used to encode SessionState into JSON without exposing time.Time zero value
 type SessionStateJSON struct {
 	*SessionState
-	CreatedAt *time.Time `json:",omitempty"`
-	ExpiresOn *time.Time `json:",omitempty"`
+	CreatedAt  *time.Time `json:",omitempty"`
+	ExpiresOn  *time.Time `json:",omitempty"`
+	LastSeenAt *time.Time `json:",omitempty"`
 }
 
 // IsExpired checks whether the session has expired
@@ -44,6 +59,28 @@ func (s *SessionState) Age() time.Duration {
 	return 0
 }
 
+// IdleTime returns how long the session has not been used: since it was
+// last seen, or since it was created when it has not been seen since
+func (s *SessionState) IdleTime() time.Duration {
+	lastSeen := s.LastSeenAt
+	if lastSeen.IsZero() {
+		lastSeen = s.CreatedAt
+	}
+	if !lastSeen.IsZero() {
+		return time.Now().Sub(lastSeen)
+	}
+	return 0
+}
+
+// UserKey identifies the user across their sessions: the email, or the
+// user name (usually the subject) when the provider gave no email
+func (s *SessionState) UserKey() string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return s.User
+}
+
 // String constructs a summary of the session state
 func (s *SessionState) String() string {
 	o := fmt.Sprintf("Session{email:%s user:%s", s.Email, s.User)
@@ -59,9 +96,18 @@ func (s *SessionState) String() string {
 	if !s.ExpiresOn.IsZero() {
 		o += fmt.Sprintf(" expires:%s", s.ExpiresOn)
 	}
+	if !s.LastSeenAt.IsZero() {
+		o += fmt.Sprintf(" last_seen:%s", s.LastSeenAt)
+	}
 	if s.RefreshToken != "" {
 		o += " refresh_token:true"
 	}
+	if len(s.Groups) > 0 {
+		o += fmt.Sprintf(" groups:%v", s.Groups)
+	}
+	if s.ProviderID != "" {
+		o += fmt.Sprintf(" provider:%s", s.ProviderID)
+	}
 	return o + "}"
 }
 
@@ -69,42 +115,55 @@ func (s *SessionState) String() string {
 func (s *SessionState) EncodeSessionState(c *encryption.Cipher) (string, error) {
 	var ss SessionState
 	if c == nil {
-		// Store only Email and User when cipher is unavailable
+		// Store only Email, User, Groups, Claims, ProviderID and LastSeenAt
+		// when cipher is unavailable
 		ss.Email = s.Email
 		ss.User = s.User
+		ss.Groups = s.Groups
+		ss.Claims = s.Claims
+		ss.ProviderID = s.ProviderID
+		ss.LastSeenAt = s.LastSeenAt
 	} else {
 		ss = *s
 		var err error
 		if ss.Email != "" {
-			ss.Email, err = c.Encrypt(ss.Email)
+			ss.Email, err = c.Encrypt(ss.Email, "Email")
 			if err != nil {
 				return "", err
 			}
 		}
 		if ss.User != "" {
-			ss.User, err = c.Encrypt(ss.User)
+			ss.User, err = c.Encrypt(ss.User, "User")
 			if err != nil {
 				return "", err
 			}
 		}
 		if ss.AccessToken != "" {
-			ss.AccessToken, err = c.Encrypt(ss.AccessToken)
+			ss.AccessToken, err = c.Encrypt(ss.AccessToken, "AccessToken")
 			if err != nil {
 				return "", err
 			}
 		}
 		if ss.IDToken != "" {
-			ss.IDToken, err = c.Encrypt(ss.IDToken)
+			ss.IDToken, err = c.Encrypt(ss.IDToken, "IDToken")
 			if err != nil {
 				return "", err
 			}
 		}
 		if ss.RefreshToken != "" {
-			ss.RefreshToken, err = c.Encrypt(ss.RefreshToken)
+			ss.RefreshToken, err = c.Encrypt(ss.RefreshToken, "RefreshToken")
 			if err != nil {
 				return "", err
 			}
 		}
+		ss.Groups, err = encryptGroups(c, s.Groups)
+		if err != nil {
+			return "", err
+		}
+		ss.Claims, err = encryptClaims(c, s.Claims)
+		if err != nil {
+			return "", err
+		}
 	}
 	// Embed SessionState and ExpiresOn pointer into SessionStateJSON
 	ssj := &SessionStateJSON{SessionState: &ss}
@@ -114,6 +173,9 @@ func (s *SessionState) EncodeSessionState(c *encryption.Cipher) (string, error)
 	if !ss.ExpiresOn.IsZero() {
 		ssj.ExpiresOn = &ss.ExpiresOn
 	}
+	if !ss.LastSeenAt.IsZero() {
+		ssj.LastSeenAt = &ss.LastSeenAt
+	}
 	b, err := json.Marshal(ssj)
 	return string(b), err
 }
@@ -189,6 +251,9 @@ func DecodeSessionState(v string, c *encryption.Cipher) (*SessionState, error) {
 		if ssj.ExpiresOn != nil {
 			ss.ExpiresOn = *ssj.ExpiresOn
 		}
+		if ssj.LastSeenAt != nil {
+			ss.LastSeenAt = *ssj.LastSeenAt
+		}
 	} else {
 		// Try to decode a legacy string when json.Unmarshal failed
 		ss, err = legacyDecodeSessionState(v, c)
@@ -197,47 +262,140 @@ func DecodeSessionState(v string, c *encryption.Cipher) (*SessionState, error) {
 		}
 	}
 	if c == nil {
-		// Load only Email and User when cipher is unavailable
+		// Load only Email, User, Groups, Claims, ProviderID and LastSeenAt
+		// when cipher is unavailable
 		ss = &SessionState{
-			Email: ss.Email,
-			User:  ss.User,
+			Email:      ss.Email,
+			User:       ss.User,
+			Groups:     ss.Groups,
+			Claims:     ss.Claims,
+			ProviderID: ss.ProviderID,
+			LastSeenAt: ss.LastSeenAt,
 		}
 	} else {
 		// Backward compatibility with using unencrypted Email
 		if ss.Email != "" {
-			decryptedEmail, errEmail := c.Decrypt(ss.Email)
+			decryptedEmail, errEmail := c.Decrypt(ss.Email, "Email")
 			if errEmail == nil {
 				ss.Email = decryptedEmail
+			} else if encryption.IsEncrypted(ss.Email) {
+				return nil, errEmail
 			}
 		}
 		// Backward compatibility with using unencrypted User
 		if ss.User != "" {
-			decryptedUser, errUser := c.Decrypt(ss.User)
+			decryptedUser, errUser := c.Decrypt(ss.User, "User")
 			if errUser == nil {
 				ss.User = decryptedUser
+			} else if encryption.IsEncrypted(ss.User) {
+				return nil, errUser
 			}
 		}
 		if ss.AccessToken != "" {
-			ss.AccessToken, err = c.Decrypt(ss.AccessToken)
+			ss.AccessToken, err = c.Decrypt(ss.AccessToken, "AccessToken")
 			if err != nil {
 				return nil, err
 			}
 		}
 		if ss.IDToken != "" {
-			ss.IDToken, err = c.Decrypt(ss.IDToken)
+			ss.IDToken, err = c.Decrypt(ss.IDToken, "IDToken")
 			if err != nil {
 				return nil, err
 			}
 		}
 		if ss.RefreshToken != "" {
-			ss.RefreshToken, err = c.Decrypt(ss.RefreshToken)
+			ss.RefreshToken, err = c.Decrypt(ss.RefreshToken, "RefreshToken")
 			if err != nil {
 				return nil, err
 			}
 		}
+		ss.Groups, err = decryptGroups(c, ss.Groups)
+		if err != nil {
+			return nil, err
+		}
+		ss.Claims, err = decryptClaims(c, ss.Claims)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if ss.User == "" {
 		ss.User = ss.Email
 	}
 	return ss, nil
 }
+
+// encryptGroups encrypts each group name separately
+func encryptGroups(c *encryption.Cipher, groups []string) ([]string, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	encrypted := make([]string, len(groups))
+	for i, group := range groups {
+		var err error
+		encrypted[i], err = c.Encrypt(group, "Groups")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptGroups reverses encryptGroups
+func decryptGroups(c *encryption.Cipher, groups []string) ([]string, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	decrypted := make([]string, len(groups))
+	for i, group := range groups {
+		var err error
+		decrypted[i], err = c.Decrypt(group, "Groups")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decrypted, nil
+}
+
+// encryptClaims JSON encodes and then encrypts every claim value, bound to
+// the name of the claim. The claim names are kept as is.
+func encryptClaims(c *encryption.Cipher, claims map[string]interface{}) (map[string]interface{}, error) {
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	encrypted := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode claim %q: %v", name, err)
+		}
+		encrypted[name], err = c.Encrypt(string(b), "Claims."+name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptClaims reverses encryptClaims
+func decryptClaims(c *encryption.Cipher, claims map[string]interface{}) (map[string]interface{}, error) {
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	decrypted := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		encrypted, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid session state (claim %q is not encrypted)", name)
+		}
+		plain, err := c.Decrypt(encrypted, "Claims."+name)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(plain), &v); err != nil {
+			return nil, fmt.Errorf("unable to decode claim %q: %v", name, err)
+		}
+		decrypted[name] = v
+	}
+	return decrypted, nil
+}
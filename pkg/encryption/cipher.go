@@ -14,20 +14,68 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"golang.org/x/crypto/hkdf"
 )
 
 // cookies are stored in a 3 part (value + timestamp + signature) to enforce that the values are as originally set.
 // additionally, the 'value' is encrypted so it's opaque to the browser
 
+// Separate keys for signing and encrypting are derived from the cookie secret
+const (
+	signingKeyInfo    = "oauth2_proxy cookie signing"
+	encryptionKeyInfo = "oauth2_proxy cookie encryption"
+	stateKeyInfo      = "oauth2_proxy state encryption"
+)
+
+// legacyWarning logs the first decryption of an AES-CFB value, once per
+// process as every request of an older session would log it again
+var legacyWarning sync.Once
+
+// versionPrefix marks values encrypted with AES-GCM. Legacy AES-CFB values
+// are plain standard base64 and can't contain the ':'.
+const versionPrefix = "v2:"
+
+// deriveKey derives a 32 byte key for the given purpose from secret with HKDF
+func deriveKey(secret []byte, info string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), key); err != nil {
+		// HKDF-SHA256 can output up to 8160 bytes
+		panic(err)
+	}
+	return key
+}
+
+func signingKey(seed string) string {
+	return string(deriveKey([]byte(seed), signingKeyInfo))
+}
+
 // Validate ensures a cookie is properly signed
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value string, t time.Time, ok bool) {
+	value, t, _, ok = ValidateAny(cookie, []string{seed}, expiration)
+	return
+}
+
+// ValidateAny ensures a cookie is properly signed with one of the seeds, which
+// are tried in order. It returns the index of the seed the cookie was signed
+// with.
+func ValidateAny(cookie *http.Cookie, seeds []string, expiration time.Duration) (value string, t time.Time, seedIndex int, ok bool) {
 	// value, timestamp, sig
 	parts := strings.Split(cookie.Value, "|")
 	if len(parts) != 3 {
 		return
 	}
-	if checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
+	seedIndex = -1
+	for i, seed := range seeds {
+		if checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
+			seedIndex = i
+			break
+		}
+	}
+	if seedIndex >= 0 {
 		ts, err := strconv.Atoi(parts[1])
 		if err != nil {
 			return
@@ -54,7 +102,7 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 func SignedValue(seed string, key string, value string, now time.Time) string {
 	encodedValue := base64.URLEncoding.EncodeToString([]byte(value))
 	timeStr := fmt.Sprintf("%d", now.Unix())
-	sig := cookieSignature(sha256.New, seed, key, encodedValue, timeStr)
+	sig := cookieSignature(sha256.New, signingKey(seed), key, encodedValue, timeStr)
 	cookieVal := fmt.Sprintf("%s|%s|%s", encodedValue, timeStr, sig)
 	return cookieVal
 }
@@ -69,14 +117,24 @@ func cookieSignature(signer func() hash.Hash, args ...string) string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// checkSignature checks the signature made with the key derived from the seed,
+// the seed being the first of args
 func checkSignature(signature string, args ...string) bool {
-	checkSig := cookieSignature(sha256.New, args...)
+	derivedArgs := append([]string{signingKey(args[0])}, args[1:]...)
+	checkSig := cookieSignature(sha256.New, derivedArgs...)
 	if checkHmac(signature, checkSig) {
 		return true
 	}
 
+	// TODO: After appropriate rollout window, remove support for signatures
+	// made with the cookie secret itself
+	legacySig := cookieSignature(sha256.New, args...)
+	if checkHmac(signature, legacySig) {
+		return true
+	}
+
 	// TODO: After appropriate rollout window, remove support for SHA1
-	legacySig := cookieSignature(sha1.New, args...)
+	legacySig = cookieSignature(sha1.New, args...)
 	return checkHmac(signature, legacySig)
 }
 
@@ -91,9 +149,18 @@ func checkHmac(input, expected string) bool {
 	return false
 }
 
-// Cipher provides methods to encrypt and decrypt cookie values
+// Cipher provides methods to encrypt and decrypt cookie values. Values are
+// encrypted with AES-256-GCM under a key derived from the secret, values
+// encrypted with AES-CFB under the secret itself can still be decrypted
+// unless DisableLegacyDecryption is called.
+//
+// Each value is bound to the name of its field, and to the name of the
+// cookie for ciphers created with NewCookieCipher, so a value can't be
+// decrypted in place of another.
 type Cipher struct {
 	cipher.Block
+	aead cipher.AEAD
+	name string
 }
 
 // NewCipher returns a new aes Cipher for encrypting cookie values
@@ -102,24 +169,105 @@ func NewCipher(secret []byte) (*Cipher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Cipher{Block: c}, err
+	block, err := aes.NewCipher(deriveKey(secret, encryptionKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{Block: c, aead: aead}, nil
+}
+
+// NewCookieCipher returns a Cipher like NewCipher, binding the values it
+// encrypts to the name of the cookie
+func NewCookieCipher(secret []byte, cookieName string) (*Cipher, error) {
+	c, err := NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	c.name = cookieName
+	return c, nil
 }
 
-// Encrypt a value for use in a cookie
-func (c *Cipher) Encrypt(value string) (string, error) {
-	ciphertext := make([]byte, aes.BlockSize+len(value))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", fmt.Errorf("failed to create initialization vector %s", err)
+// NewStateCipher returns a Cipher for the OAuth state parameter, under a key
+// derived from the secret. Unlike for NewCipher the secret may be of any
+// length, as there are no legacy values to decrypt.
+func NewStateCipher(secret []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(deriveKey(secret, stateKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
 	}
+	return &Cipher{aead: aead}, nil
+}
+
+// DisableLegacyDecryption rejects values encrypted with AES-CFB, which can
+// be tampered with unnoticed
+func (c *Cipher) DisableLegacyDecryption() {
+	c.Block = nil
+}
 
-	stream := cipher.NewCFBEncrypter(c.Block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], []byte(value))
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+// additionalData binds values to the cookie and the field they are
+// encrypted for
+func (c *Cipher) additionalData(field string) []byte {
+	return []byte(c.name + "\x00" + field)
 }
 
-// Decrypt a value from a cookie to it's original string
-func (c *Cipher) Decrypt(s string) (string, error) {
+// Encrypt a value of the field for use in a cookie
+func (c *Cipher) Encrypt(value string, field string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
+	}
+
+	ciphertext := c.aead.Seal(nonce, nonce, []byte(value), c.additionalData(field))
+	return versionPrefix + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt a value of the field from a cookie to it's original string. Values
+// that were tampered with, or encrypted for another field or cookie, are
+// rejected.
+func (c *Cipher) Decrypt(s string, field string) (string, error) {
+	if !strings.HasPrefix(s, versionPrefix) {
+		// TODO: After appropriate rollout window, remove support for AES-CFB
+		return c.legacyDecrypt(s)
+	}
+
+	encrypted, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, versionPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+	if len(encrypted) < c.aead.NonceSize() {
+		return "", fmt.Errorf("encrypted cookie value should be "+
+			"at least %d bytes, but is only %d bytes",
+			c.aead.NonceSize(), len(encrypted))
+	}
+
+	nonce := encrypted[:c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, encrypted[c.aead.NonceSize():], c.additionalData(field))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether s has the format of a value encrypted by
+// Encrypt. Legacy AES-CFB values can't be told apart from plain base64.
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, versionPrefix)
+}
+
+// legacyDecrypt decrypts a value encrypted with AES-CFB. The format has no
+// integrity protection, tampered values decrypt to garbage.
+func (c *Cipher) legacyDecrypt(s string) (string, error) {
+	if c.Block == nil {
+		return "", fmt.Errorf("failed to decrypt value: not encrypted")
+	}
 	encrypted, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
@@ -131,6 +279,10 @@ func (c *Cipher) Decrypt(s string) (string, error) {
 			aes.BlockSize, len(encrypted))
 	}
 
+	// TODO: After appropriate rollout window, disable AES-CFB by default
+	legacyWarning.Do(func() {
+		logger.Printf("WARNING: decrypting a value encrypted with AES-CFB, which has no integrity protection. This is only logged once.")
+	})
 	iv := encrypted[:aes.BlockSize]
 	encrypted = encrypted[aes.BlockSize:]
 	stream := cipher.NewCFBDecrypter(c.Block, iv)
@@ -1,11 +1,20 @@
 package encryption
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,10 +24,10 @@ func TestEncodeAndDecodeAccessToken(t *testing.T) {
 	c, err := NewCipher([]byte(secret))
 	assert.Equal(t, nil, err)
 
-	encoded, err := c.Encrypt(token)
+	encoded, err := c.Encrypt(token, "field")
 	assert.Equal(t, nil, err)
 
-	decoded, err := c.Decrypt(encoded)
+	decoded, err := c.Decrypt(encoded, "field")
 	assert.Equal(t, nil, err)
 
 	assert.NotEqual(t, token, encoded)
@@ -34,10 +43,10 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	c, err := NewCipher([]byte(secret))
 	assert.Equal(t, nil, err)
 
-	encoded, err := c.Encrypt(token)
+	encoded, err := c.Encrypt(token, "field")
 	assert.Equal(t, nil, err)
 
-	decoded, err := c.Decrypt(encoded)
+	decoded, err := c.Decrypt(encoded, "field")
 	assert.Equal(t, nil, err)
 
 	assert.NotEqual(t, token, encoded)
@@ -50,13 +59,172 @@ func TestSignAndValidate(t *testing.T) {
 	value := base64.URLEncoding.EncodeToString([]byte("I am soooo encoded"))
 	epoch := "123456789"
 
+	derivedSig := cookieSignature(sha256.New, signingKey(seed), key, value, epoch)
 	sha256sig := cookieSignature(sha256.New, seed, key, value, epoch)
 	sha1sig := cookieSignature(sha1.New, seed, key, value, epoch)
 
+	assert.True(t, checkSignature(derivedSig, seed, key, value, epoch))
+	// This should be switched to False after fully deprecating signing with
+	// the seed itself
 	assert.True(t, checkSignature(sha256sig, seed, key, value, epoch))
 	// This should be switched to False after fully deprecating SHA1
 	assert.True(t, checkSignature(sha1sig, seed, key, value, epoch))
 
+	assert.False(t, checkSignature(derivedSig, seed, key, "tampered", epoch))
 	assert.False(t, checkSignature(sha256sig, seed, key, "tampered", epoch))
 	assert.False(t, checkSignature(sha1sig, seed, key, "tampered", epoch))
 }
+
+func TestSignedValueUsesDerivedKey(t *testing.T) {
+	seed := "0123456789abcdef"
+	now := time.Now()
+	value := SignedValue(seed, "cookie-name", "value", now)
+
+	parts := strings.Split(value, "|")
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, cookieSignature(sha256.New, signingKey(seed), "cookie-name", parts[0], parts[1]), parts[2])
+	assert.NotEqual(t, cookieSignature(sha256.New, seed, "cookie-name", parts[0], parts[1]), parts[2])
+}
+
+func TestEncryptVersioned(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token", "field")
+	assert.Equal(t, nil, err)
+	assert.True(t, strings.HasPrefix(encoded, "v2:"))
+	assert.True(t, IsEncrypted(encoded))
+
+	// the same value encrypts differently every time
+	encoded2, err := c.Encrypt("my access token", "field")
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, encoded, encoded2)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	c2, err := NewCipher([]byte("0000000000abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token", "field")
+	assert.Equal(t, nil, err)
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encoded, "v2:"))
+	assert.Equal(t, nil, err)
+	raw[len(raw)-1] ^= 1
+	_, err = c.Decrypt("v2:"+base64.RawURLEncoding.EncodeToString(raw), "field")
+	assert.NotEqual(t, nil, err)
+
+	_, err = c.Decrypt("v2:"+base64.RawURLEncoding.EncodeToString(raw[:4]), "field")
+	assert.NotEqual(t, nil, err)
+
+	_, err = c2.Decrypt(encoded, "field")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecryptOtherField(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	c, err := NewCookieCipher([]byte(secret), "_oauth2_proxy")
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token", "AccessToken")
+	assert.Equal(t, nil, err)
+	decoded, err := c.Decrypt(encoded, "AccessToken")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my access token", decoded)
+
+	// Values are bound to their field and cookie
+	_, err = c.Decrypt(encoded, "Email")
+	assert.NotEqual(t, nil, err)
+	other, err := NewCookieCipher([]byte(secret), "_other_proxy")
+	assert.Equal(t, nil, err)
+	_, err = other.Decrypt(encoded, "AccessToken")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecryptLegacyCFB(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	const token = "my access token"
+	block, err := aes.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	ciphertext := make([]byte, aes.BlockSize+len(token))
+	iv := ciphertext[:aes.BlockSize]
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], []byte(token))
+	legacy := base64.StdEncoding.EncodeToString(ciphertext)
+
+	buf := bytes.NewBuffer(nil)
+	logger.SetOutput(buf)
+	defer logger.SetOutput(os.Stderr)
+	legacyWarning = sync.Once{}
+
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	assert.False(t, IsEncrypted(legacy))
+	for i := 0; i < 2; i++ {
+		decoded, err := c.Decrypt(legacy, "field")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, token, decoded)
+	}
+	// The warning is only logged once
+	assert.Equal(t, 1, strings.Count(buf.String(), "WARNING"))
+
+	c.DisableLegacyDecryption()
+	_, err = c.Decrypt(legacy, "field")
+	assert.NotEqual(t, nil, err)
+	encoded, err := c.Encrypt(token, "field")
+	assert.Equal(t, nil, err)
+	decoded, err := c.Decrypt(encoded, "field")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, token, decoded)
+}
+
+func TestValidateAny(t *testing.T) {
+	now := time.Now()
+	cookie := &http.Cookie{
+		Name:  "cookie-name",
+		Value: SignedValue("old secret", "cookie-name", "value", now),
+	}
+
+	value, ts, seedIndex, ok := ValidateAny(cookie, []string{"new secret", "old secret"}, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, now.Unix(), ts.Unix())
+	assert.Equal(t, 1, seedIndex)
+
+	_, _, _, ok = ValidateAny(cookie, []string{"new secret"}, time.Hour)
+	assert.False(t, ok)
+
+	_, _, ok = Validate(cookie, "old secret", time.Hour)
+	assert.True(t, ok)
+}
+
+func TestStateCipher(t *testing.T) {
+	// Any secret length is accepted
+	c, err := NewStateCipher([]byte("a secret of 20 bytes"))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("nonce:/redirect", "field")
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, encoded, "redirect")
+	decoded, err := c.Decrypt(encoded, "field")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "nonce:/redirect", decoded)
+
+	// The key differs from the one of the cookie cipher
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	cookieCipher, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	stateCipher, err := NewStateCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	encoded, err = cookieCipher.Encrypt("nonce:/redirect", "field")
+	assert.Equal(t, nil, err)
+	_, err = stateCipher.Decrypt(encoded, "field")
+	assert.NotEqual(t, nil, err)
+
+	// Unencrypted values are rejected
+	_, err = stateCipher.Decrypt("nonce:/redirect", "field")
+	assert.NotEqual(t, nil, err)
+}
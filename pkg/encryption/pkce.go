@@ -0,0 +1,38 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// PKCE code challenge methods as defined in RFC 7636
+const (
+	CodeChallengeMethodS256  = "S256"
+	CodeChallengeMethodPlain = "plain"
+)
+
+// CodeVerifier generates a random PKCE code verifier. 32 random bytes encode
+// to 43 characters, the minimum length allowed by RFC 7636.
+func CodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the PKCE code challenge for the verifier using the
+// given method
+func CodeChallenge(verifier, method string) (string, error) {
+	switch method {
+	case CodeChallengeMethodS256:
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+	case CodeChallengeMethodPlain:
+		return verifier, nil
+	default:
+		return "", fmt.Errorf("unsupported code challenge method %q", method)
+	}
+}
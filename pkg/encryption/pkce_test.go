@@ -0,0 +1,33 @@
+package encryption
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeVerifier(t *testing.T) {
+	verifier, err := CodeVerifier()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(verifier))
+
+	other, err := CodeVerifier()
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, verifier, other)
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 Appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	challenge, err := CodeChallenge(verifier, CodeChallengeMethodS256)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", challenge)
+
+	challenge, err = CodeChallenge(verifier, CodeChallengeMethodPlain)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, verifier, challenge)
+
+	_, err = CodeChallenge(verifier, "S512")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,224 @@
+// Package ldap authenticates users with the password of their entry in an
+// LDAP directory, like OpenLDAP or Active Directory.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// UsernamePlaceholder is replaced by the escaped username in the user filter
+const UsernamePlaceholder = "{username}"
+
+// Config configures an Authenticator
+type Config struct {
+	// URL is the ldap:// or ldaps:// URL of the server
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the credentials of the service account
+	// searching for users. The search is anonymous without them.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is searched for the entry of the user with the UserFilter
+	BaseDN     string
+	UserFilter string
+
+	EmailAttribute  string
+	GroupsAttribute string
+
+	// PoolSize is how many connections may be open at a time
+	PoolSize int
+	// Timeout bounds each authentication, including connecting
+	Timeout time.Duration
+}
+
+// User is the directory entry of an authenticated user
+type User struct {
+	DN     string
+	Email  string
+	Groups []string
+}
+
+// Authenticator checks passwords by searching for the entry of the user as
+// the service account, then binding as the user
+type Authenticator struct {
+	config Config
+	url    *url.URL
+	// tlsConfig verifies the certificate of the server against its host name
+	tlsConfig *tls.Config
+	pool      *pool
+}
+
+// NewAuthenticator creates an Authenticator. No connection is made until
+// the first authentication.
+func NewAuthenticator(config Config) (*Authenticator, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %v", config.URL, err)
+	}
+	if (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: expected ldap://host[:port] or ldaps://host[:port]", config.URL)
+	}
+	if u.Scheme == "ldaps" && config.StartTLS {
+		return nil, errors.New("StartTLS can't be used with ldaps://")
+	}
+	if !strings.Contains(config.UserFilter, UsernamePlaceholder) {
+		return nil, fmt.Errorf("user filter %q doesn't contain %s", config.UserFilter, UsernamePlaceholder)
+	}
+	if _, err := ldap.CompileFilter(strings.Replace(config.UserFilter, UsernamePlaceholder, "user", -1)); err != nil {
+		return nil, err
+	}
+	if config.PoolSize < 1 {
+		config.PoolSize = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	a := &Authenticator{config: config, url: u, tlsConfig: tlsConfig}
+	a.pool = newPool(config.PoolSize, a.dial)
+	return a, nil
+}
+
+// dial connects to the server, upgrading the connection to TLS if
+// configured
+func (a *Authenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	c, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if a.config.StartTLS {
+		setTimeout(ctx, c)
+		if err := c.StartTLS(a.tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Authenticate checks the password of the user and returns their entry.
+// ErrInvalidCredentials is returned if there is no such user or the password
+// is wrong, other errors if the directory can't be searched.
+func (a *Authenticator) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	// Servers accept binds with an empty password as unauthenticated
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.config.Timeout)
+	defer cancel()
+
+	c, err := a.pool.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", a.url.Host, err)
+	}
+	err = a.bindServiceAccount(ctx, c.Conn)
+	if err != nil && c.reused && c.IsClosing() {
+		// The server may have closed the idle connection
+		if c, err = a.pool.dialConn(ctx); err == nil {
+			err = a.bindServiceAccount(ctx, c.Conn)
+		}
+	}
+	if err != nil {
+		a.pool.put(c, err)
+		return nil, fmt.Errorf("error binding as %q: %v", a.config.BindDN, err)
+	}
+
+	user, err := a.authenticate(c.Conn, username, password)
+	a.pool.put(c, err)
+	return user, err
+}
+
+// bindServiceAccount binds as the service account, or anonymously without
+// one
+func (a *Authenticator) bindServiceAccount(ctx context.Context, c *ldap.Conn) error {
+	setTimeout(ctx, c)
+	if a.config.BindPassword == "" {
+		return c.UnauthenticatedBind(a.config.BindDN)
+	}
+	return c.Bind(a.config.BindDN, a.config.BindPassword)
+}
+
+// authenticate searches for the entry of the user and binds as it
+func (a *Authenticator) authenticate(c *ldap.Conn, username, password string) (*User, error) {
+	// More than one entry is an error, so there is no need for more
+	result, err := c.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.Replace(a.config.UserFilter, UsernamePlaceholder, ldap.EscapeFilter(username), -1),
+		[]string{a.config.EmailAttribute, a.config.GroupsAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("error searching for %q: %w", username, err)
+	}
+	var entries []*ldap.Entry
+	if result != nil {
+		entries = result.Entries
+	}
+	switch len(entries) {
+	case 0:
+		return nil, ErrInvalidCredentials
+	case 1:
+	default:
+		return nil, fmt.Errorf("more than one entry matches %q", username)
+	}
+
+	e := entries[0]
+	if err := c.Bind(e.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("error binding as %q: %w", e.DN, err)
+	}
+	return &User{
+		DN:     e.DN,
+		Email:  e.GetEqualFoldAttributeValue(a.config.EmailAttribute),
+		Groups: e.GetEqualFoldAttributeValues(a.config.GroupsAttribute),
+	}, nil
+}
+
+// Close closes the idle connections
+func (a *Authenticator) Close() {
+	a.pool.close()
+}
+
+// setTimeout bounds the requests on the connection by the deadline of the
+// context
+func setTimeout(ctx context.Context, c *ldap.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetTimeout(time.Until(deadline))
+	}
+}
+
+// isConnError returns whether the error is a failure of the connection,
+// rather than a result of the server
+func isConnError(err error) bool {
+	var e *ldap.Error
+	return errors.As(err, &e) && e.ResultCode >= ldap.ErrorNetwork
+}
@@ -0,0 +1,374 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testBindDN       = "cn=proxy,dc=example,dc=com"
+	testBindPassword = "proxy-secret"
+	testBaseDN       = "ou=people,dc=example,dc=com"
+)
+
+type testEntry struct {
+	uid      string
+	dn       string
+	password string
+	mail     string
+	groups   []string
+}
+
+var testEntries = []testEntry{
+	{
+		uid:      "jdoe",
+		dn:       "uid=jdoe,ou=people,dc=example,dc=com",
+		password: "secret",
+		mail:     "john.doe@example.com",
+		groups:   []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com"},
+	},
+	{uid: "twin", dn: "uid=twin,ou=people,dc=example,dc=com", password: "secret"},
+	{uid: "twin", dn: "uid=twin,ou=other,dc=example,dc=com", password: "secret"},
+}
+
+// testServer is a minimal LDAP server for testEntries. The uid equality
+// assertions of search filters select the entries.
+type testServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	dials   int
+	filters []string
+	conns   []net.Conn
+}
+
+func newTestServer(t *testing.T, ldaps bool) *testServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	s := &testServer{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+	}
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	if ldaps {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	go s.serve()
+	return s
+}
+
+// clientTLSConfig trusts the certificate of the server
+func (s *testServer) clientTLSConfig() *tls.Config {
+	cert, _ := x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{RootCAs: pool}
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.dials++
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// closeConns closes the connections, like servers do with idle ones
+func (s *testServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// Application tags of the protocol operations, RFC 4511 section 4.2
+const (
+	appBindRequest       = 0
+	appBindResponse      = 1
+	appUnbindRequest     = 2
+	appSearchRequest     = 3
+	appSearchResultEntry = 4
+	appSearchResultDone  = 5
+	appExtendedRequest   = 23
+	appExtendedResponse  = 24
+)
+
+func octetString(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func constructed(class ber.Class, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	p := ber.Encode(class, ber.TypeConstructed, tag, nil, "")
+	for _, c := range children {
+		p.AppendChild(c)
+	}
+	return p
+}
+
+func result(tag ber.Tag, code int64) *ber.Packet {
+	return constructed(ber.ClassApplication, tag,
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""),
+		octetString(""), octetString(""))
+}
+
+func (s *testServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		msg, err := ber.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		id := msg.Children[0]
+		op := msg.Children[1]
+		reply := func(op *ber.Packet) {
+			c.Write(constructed(ber.ClassUniversal, ber.TagSequence, id, op).Bytes())
+		}
+
+		switch op.Tag {
+		case appBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if (dn == "" && password == "") || (dn == testBindDN && password == testBindPassword) {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range testEntries {
+				if dn == e.dn && password == e.password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			reply(result(appBindResponse, code))
+		case appSearchRequest:
+			filter := op.Children[6]
+			decompiled, _ := ldap.DecompileFilter(filter)
+			s.mu.Lock()
+			s.filters = append(s.filters, decompiled)
+			s.mu.Unlock()
+			uid := findEquality(filter, "uid")
+			sizeLimit := op.Children[3].Value.(int64)
+			var n int64
+			code := int64(ldap.LDAPResultSuccess)
+			for _, e := range testEntries {
+				if e.uid != uid {
+					continue
+				}
+				if n == sizeLimit {
+					code = ldap.LDAPResultSizeLimitExceeded
+					break
+				}
+				n++
+				groups := constructed(ber.ClassUniversal, ber.TagSet)
+				for _, g := range e.groups {
+					groups.AppendChild(octetString(g))
+				}
+				reply(constructed(ber.ClassApplication, appSearchResultEntry,
+					octetString(e.dn),
+					constructed(ber.ClassUniversal, ber.TagSequence,
+						constructed(ber.ClassUniversal, ber.TagSequence, octetString("mail"), constructed(ber.ClassUniversal, ber.TagSet, octetString(e.mail))),
+						constructed(ber.ClassUniversal, ber.TagSequence, octetString("memberOf"), groups),
+					),
+				))
+			}
+			reply(result(appSearchResultDone, code))
+		case appExtendedRequest:
+			reply(result(appExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(c, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			c, r = tlsConn, bufio.NewReader(tlsConn)
+		case appUnbindRequest:
+			return
+		}
+	}
+}
+
+// findEquality returns the value of the first equality assertion of the
+// attribute in the filter
+func findEquality(p *ber.Packet, attr string) string {
+	if p.Tag == ldap.FilterEqualityMatch && p.Children[0].Data.String() == attr {
+		return p.Children[1].Data.String()
+	}
+	if p.Tag == ldap.FilterAnd || p.Tag == ldap.FilterOr {
+		for _, c := range p.Children {
+			if v := findEquality(c, attr); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func newTestAuthenticator(t *testing.T, s *testServer, modify func(*Config)) *Authenticator {
+	config := Config{
+		URL:             "ldap://" + s.listener.Addr().String(),
+		BindDN:          testBindDN,
+		BindPassword:    testBindPassword,
+		BaseDN:          testBaseDN,
+		UserFilter:      "(&(objectClass=person)(uid={username}))",
+		EmailAttribute:  "mail",
+		GroupsAttribute: "memberOf",
+		PoolSize:        2,
+		Timeout:         5 * time.Second,
+	}
+	if modify != nil {
+		modify(&config)
+	}
+	a, err := NewAuthenticator(config)
+	assert.NoError(t, err)
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t, false)
+	a := newTestAuthenticator(t, s, nil)
+	ctx := context.Background()
+
+	user, err := a.Authenticate(ctx, "jdoe", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, &User{
+		DN:     "uid=jdoe,ou=people,dc=example,dc=com",
+		Email:  "john.doe@example.com",
+		Groups: []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com"},
+	}, user)
+
+	_, err = a.Authenticate(ctx, "jdoe", "wrong")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = a.Authenticate(ctx, "nobody", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = a.Authenticate(ctx, "jdoe", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// Ambiguous filters don't authenticate anyone
+	_, err = a.Authenticate(ctx, "twin", "secret")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+
+	// The username is escaped in the filter
+	_, err = a.Authenticate(ctx, "*)(uid=jdoe", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	assert.Equal(t, `(&(objectClass=person)(uid=\2a\29\28uid=jdoe))`, s.filters[len(s.filters)-1])
+
+	// All of it was done over one connection
+	assert.Equal(t, 1, s.dials)
+}
+
+func TestAuthenticateServiceAccount(t *testing.T) {
+	s := newTestServer(t, false)
+	a := newTestAuthenticator(t, s, func(config *Config) {
+		config.BindPassword = "wrong"
+	})
+	_, err := a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+
+	// The search is anonymous without a service account
+	a = newTestAuthenticator(t, s, func(config *Config) {
+		config.BindDN = ""
+		config.BindPassword = ""
+	})
+	_, err = a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.NoError(t, err)
+}
+
+func TestAuthenticateReconnects(t *testing.T) {
+	s := newTestServer(t, false)
+	a := newTestAuthenticator(t, s, nil)
+	_, err := a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.NoError(t, err)
+
+	s.closeConns()
+	_, err = a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.dials)
+}
+
+func TestAuthenticatePoolSize(t *testing.T) {
+	s := newTestServer(t, false)
+	a := newTestAuthenticator(t, s, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Authenticate(context.Background(), "jdoe", "secret")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, s.dials, 2)
+}
+
+func TestAuthenticateTLS(t *testing.T) {
+	s := newTestServer(t, false)
+	a := newTestAuthenticator(t, s, func(config *Config) {
+		config.StartTLS = true
+		config.TLSConfig = s.clientTLSConfig()
+	})
+	_, err := a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.NoError(t, err)
+
+	// The certificate of the server is verified
+	a = newTestAuthenticator(t, s, func(config *Config) {
+		config.StartTLS = true
+	})
+	_, err = a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.Error(t, err)
+
+	s = newTestServer(t, true)
+	a = newTestAuthenticator(t, s, func(config *Config) {
+		config.URL = "ldaps://" + s.listener.Addr().String()
+		config.TLSConfig = s.clientTLSConfig()
+	})
+	_, err = a.Authenticate(context.Background(), "jdoe", "secret")
+	assert.NoError(t, err)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	for _, config := range []Config{
+		{URL: "http://ldap.example.com", UserFilter: "(uid={username})"},
+		{URL: "ldap://", UserFilter: "(uid={username})"},
+		{URL: "ldaps://ldap.example.com", StartTLS: true, UserFilter: "(uid={username})"},
+		{URL: "ldap://ldap.example.com", UserFilter: "(uid=jdoe)"},
+		{URL: "ldap://ldap.example.com", UserFilter: "(uid={username}"},
+	} {
+		_, err := NewAuthenticator(config)
+		assert.Error(t, err, config)
+	}
+}
@@ -0,0 +1,92 @@
+package ldap
+
+import (
+	"context"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// conn is a connection of the pool
+type conn struct {
+	*ldap.Conn
+	// reused is set on connections that were idle in the pool
+	reused bool
+}
+
+// pool limits the number of connections to the server and keeps the idle
+// ones for reuse
+type pool struct {
+	dial func(ctx context.Context) (*ldap.Conn, error)
+	// slots holds a token for every connection in use
+	slots chan struct{}
+	idle  chan *conn
+}
+
+func newPool(size int, dial func(ctx context.Context) (*ldap.Conn, error)) *pool {
+	return &pool{
+		dial:  dial,
+		slots: make(chan struct{}, size),
+		idle:  make(chan *conn, size),
+	}
+}
+
+// get returns an idle connection or dials a new one, waiting for one of
+// the connections in use to be put back if there are too many
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case c := <-p.idle:
+		c.reused = true
+		return c, nil
+	default:
+	}
+	c, err := p.dialConn(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialConn dials a connection in the slot of one got from the pool
+func (p *pool) dialConn(ctx context.Context) (*conn, error) {
+	c, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c}, nil
+}
+
+// put returns a connection got from the pool, with the error of its last
+// operation. Connections that failed or were closed by the server are
+// closed, c may be nil if it couldn't be replaced.
+func (p *pool) put(c *conn, err error) {
+	if c != nil {
+		if isConnError(err) || c.IsClosing() {
+			c.Close()
+		} else {
+			select {
+			case p.idle <- c:
+			default:
+				c.Close()
+			}
+		}
+	}
+	<-p.slots
+}
+
+// close closes the idle connections
+func (p *pool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
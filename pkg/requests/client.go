@@ -0,0 +1,136 @@
+package requests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// client is shared by all requests to the providers
+var client = http.DefaultClient
+
+// SetClient sets the client used for all requests to the providers. It must
+// be called before any request is made.
+func SetClient(c *http.Client) {
+	client = c
+}
+
+// Client returns the client used for requests to the providers
+func Client() *http.Client {
+	return client
+}
+
+// ClientContext returns a copy of ctx that makes the oauth2 and go-oidc
+// packages use the shared client
+func ClientContext(ctx context.Context) context.Context {
+	return WithClient(ctx, client)
+}
+
+// WithClient returns a copy of ctx that makes the oauth2 and go-oidc
+// packages, and ContextClient, use c
+func WithClient(ctx context.Context, c *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, c)
+}
+
+// ContextClient returns the client of ctx set by WithClient, or the shared
+// client
+func ContextClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return client
+}
+
+// TransportOptions configures the TLS, proxy and timeout settings of an
+// outbound HTTP transport
+type TransportOptions struct {
+	// CAFiles are PEM bundles of CAs trusted in addition to the system roots
+	CAFiles []string
+	// ClientCertFile and ClientKeyFile hold the certificate presented for
+	// mutual TLS
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+	// ProxyURL is the egress proxy to use. The proxy is taken from the
+	// environment when empty.
+	ProxyURL              string
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// NewTransport creates a transport with the settings of http.DefaultTransport
+// and the given options applied
+func NewTransport(opts TransportOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+
+	if opts.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %v", opts.ProxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := NewTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// NewTLSConfig creates a TLS client configuration from the CA, client
+// certificate and verification settings of opts
+func NewTLSConfig(opts TransportOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if len(opts.CAFiles) > 0 {
+		pool, err := loadCAFiles(opts.CAFiles)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadCAFiles returns the system roots extended with the CAs in files
+func loadCAFiles(files []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", file)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,92 @@
+package requests
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	f, err := ioutil.TempFile("", "ca.pem")
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Equal(t, nil, err)
+	return f.Name()
+}
+
+func TestNewTransportCAFiles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	transport, err := NewTransport(TransportOptions{})
+	assert.Equal(t, nil, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.NotEqual(t, nil, err)
+
+	caFile := writeServerCA(t, server)
+	defer os.Remove(caFile)
+	transport, err = NewTransport(TransportOptions{CAFiles: []string{caFile}})
+	assert.Equal(t, nil, err)
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestNewTransportInvalidFiles(t *testing.T) {
+	_, err := NewTransport(TransportOptions{CAFiles: []string{"/does/not/exist.pem"}})
+	assert.NotEqual(t, nil, err)
+
+	f, err := ioutil.TempFile("", "ca.pem")
+	assert.Equal(t, nil, err)
+	f.WriteString("not a certificate")
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = NewTransport(TransportOptions{CAFiles: []string{f.Name()}})
+	assert.NotEqual(t, nil, err)
+
+	_, err = NewTransport(TransportOptions{ClientCertFile: "/does/not/exist.pem"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNewTransportProxyURL(t *testing.T) {
+	transport, err := NewTransport(TransportOptions{
+		ProxyURL:              "http://proxy.example.com:3128",
+		ResponseHeaderTimeout: time.Minute,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, time.Minute, transport.ResponseHeaderTimeout)
+
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: "provider.example.com"}}
+	proxyURL, err := transport.Proxy(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+
+	_, err = NewTransport(TransportOptions{ProxyURL: "http://[::1"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRequestUsesClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	defer SetClient(Client())
+	SetClient(server.Client())
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	response, err := Request(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, response.Get("ok").MustBool())
+}
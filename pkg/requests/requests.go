@@ -1,6 +1,7 @@
 package requests
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,7 +13,7 @@ import (
 
 // Request parses the request body into a simplejson.Json object
 func Request(req *http.Request) (*simplejson.Json, error) {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		logger.Printf("%s %s %s", req.Method, req.URL, err)
 		return nil, err
@@ -35,7 +36,7 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 
 // RequestJSON parses the request body into the given interface
 func RequestJSON(req *http.Request, v interface{}) error {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		logger.Printf("%s %s %s", req.Method, req.URL, err)
 		return err
@@ -53,12 +54,12 @@ func RequestJSON(req *http.Request, v interface{}) error {
 }
 
 // RequestUnparsedResponse performs a GET and returns the raw response object
-func RequestUnparsedResponse(url string, header http.Header) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func RequestUnparsedResponse(ctx context.Context, url string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = header
 
-	return http.DefaultClient.Do(req)
+	return client.Do(req)
 }
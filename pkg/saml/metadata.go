@@ -0,0 +1,143 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
+)
+
+// Bindings of SAML messages
+const (
+	bindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingHTTPPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+// IdentityProvider holds what the service provider needs to know of the
+// identity provider, from its metadata
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL is the single sign on service location with the HTTP-Redirect
+	// binding
+	SSOURL *url.URL
+	// Certificates hold the keys the identity provider signs with
+	Certificates []*x509.Certificate
+}
+
+// LoadIdentityProvider loads the metadata of the identity provider from a
+// https URL or a file. The metadata holds the certificates trusted to sign
+// assertions, so it is never fetched over plain http.
+func LoadIdentityProvider(ctx context.Context, source string) (*IdentityProvider, error) {
+	var data []byte
+	if strings.Contains(source, "://") && !strings.HasPrefix(source, "https://") {
+		return nil, fmt.Errorf("metadata has to be loaded from a https URL or a file, not %q", source)
+	}
+	if strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := requests.ContextClient(ctx).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got %d from %q", resp.StatusCode, source)
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+	return ParseIdentityProvider(data)
+}
+
+// ParseIdentityProvider parses the metadata of an identity provider. The
+// metadata may be an EntitiesDescriptor, as long as it describes a single
+// identity provider.
+func ParseIdentityProvider(data []byte) (*IdentityProvider, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing metadata: %v", err)
+	}
+	var entities []*element
+	root.walk(func(e *element) {
+		if e.is(nsMetadata, "EntityDescriptor") && e.child(nsMetadata, "IDPSSODescriptor") != nil {
+			entities = append(entities, e)
+		}
+	})
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("metadata describes %d identity providers, expected 1", len(entities))
+	}
+	entity := entities[0]
+	descriptor := entity.child(nsMetadata, "IDPSSODescriptor")
+
+	idp := &IdentityProvider{EntityID: entity.attr("entityID")}
+	if idp.EntityID == "" {
+		return nil, errors.New("metadata has no entityID")
+	}
+	for _, sso := range descriptor.childElements(nsMetadata, "SingleSignOnService") {
+		if sso.attr("Binding") == bindingHTTPRedirect {
+			if idp.SSOURL, err = url.Parse(sso.attr("Location")); err != nil {
+				return nil, fmt.Errorf("invalid SingleSignOnService location: %v", err)
+			}
+			break
+		}
+	}
+	if idp.SSOURL == nil {
+		return nil, errors.New("metadata has no SingleSignOnService with the HTTP-Redirect binding")
+	}
+	for _, key := range descriptor.childElements(nsMetadata, "KeyDescriptor") {
+		if use := key.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		keyInfo := key.child(nsDSig, "KeyInfo")
+		if keyInfo == nil {
+			continue
+		}
+		for _, data := range keyInfo.childElements(nsDSig, "X509Data") {
+			for _, c := range data.childElements(nsDSig, "X509Certificate") {
+				der, err := base64.StdEncoding.DecodeString(stripSpace(c.text()))
+				if err != nil {
+					return nil, fmt.Errorf("invalid signing certificate: %v", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("invalid signing certificate: %v", err)
+				}
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+	}
+	if len(idp.Certificates) == 0 {
+		return nil, errors.New("metadata has no signing certificate")
+	}
+	return idp, nil
+}
+
+// Metadata returns the metadata of the service provider, for the identity
+// provider
+func (sp *ServiceProvider) Metadata() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<md:EntityDescriptor xmlns:md="` + nsMetadata + `" entityID="` + escape(sp.EntityID) + `">`)
+	b.WriteString(`<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + nsProtocol + `">`)
+	b.WriteString(`<md:AssertionConsumerService Binding="` + bindingHTTPPost + `" Location="` + escape(sp.ACSURL) + `" index="0" isDefault="true"/>`)
+	b.WriteString(`</md:SPSSODescriptor>`)
+	b.WriteString(`</md:EntityDescriptor>` + "\n")
+	return b.Bytes()
+}
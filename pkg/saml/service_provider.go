@@ -0,0 +1,321 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	statusSuccess            = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationMethodBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	// NameIDFormatEmail is the format of NameIDs that are email addresses
+	NameIDFormatEmail = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	// maxClockSkew is how far the clocks of the identity provider and the
+	// service provider may be apart
+	maxClockSkew = 90 * time.Second
+)
+
+// ServiceProvider implements the SAML 2.0 web browser SSO profile for a
+// service provider. AuthnRequests are sent with the HTTP-Redirect binding,
+// responses received with the HTTP-POST binding. Encrypted assertions are
+// not supported.
+type ServiceProvider struct {
+	EntityID string
+	// ACSURL is the URL of the assertion consumer service
+	ACSURL string
+	IDP    *IdentityProvider
+	// Now returns the current time, it defaults to time.Now
+	Now func() time.Time
+}
+
+// Assertion holds the subject and attributes asserted by the identity
+// provider
+type Assertion struct {
+	NameID       string
+	NameIDFormat string
+	// Attributes are keyed by both their Name and FriendlyName
+	Attributes   map[string][]string
+	SessionIndex string
+	// SessionNotOnOrAfter is when the identity provider wants the session
+	// to end, it is zero if not asserted
+	SessionNotOnOrAfter time.Time
+}
+
+func (sp *ServiceProvider) now() time.Time {
+	if sp.Now != nil {
+		return sp.Now()
+	}
+	return time.Now()
+}
+
+// AuthnRequestURL returns the URL of the identity provider to send the
+// user to with an AuthnRequest with the ID. The identity provider posts
+// the relay state back with the response.
+func (sp *ServiceProvider) AuthnRequestURL(id, relayState string) string {
+	var request bytes.Buffer
+	request.WriteString(`<samlp:AuthnRequest xmlns:samlp="` + nsProtocol + `" xmlns:saml="` + nsAssertion + `"`)
+	request.WriteString(` ID="` + escape(id) + `" Version="2.0"`)
+	request.WriteString(` IssueInstant="` + sp.now().UTC().Format(time.RFC3339) + `"`)
+	request.WriteString(` Destination="` + escape(sp.IDP.SSOURL.String()) + `"`)
+	request.WriteString(` AssertionConsumerServiceURL="` + escape(sp.ACSURL) + `"`)
+	request.WriteString(` ProtocolBinding="` + bindingHTTPPost + `">`)
+	request.WriteString(`<saml:Issuer>` + escape(sp.EntityID) + `</saml:Issuer>`)
+	request.WriteString(`<samlp:NameIDPolicy AllowCreate="true"/>`)
+	request.WriteString(`</samlp:AuthnRequest>`)
+
+	// The HTTP-Redirect binding deflates the request
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	w.Write(request.Bytes())
+	w.Close()
+
+	u := *sp.IDP.SSOURL
+	params := u.Query()
+	params.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		params.Set("RelayState", relayState)
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// ParseResponse validates the base64 encoded response to the AuthnRequest
+// with the ID and returns its assertion. Either the response or the
+// assertion has to be signed by the identity provider.
+func (sp *ServiceProvider) ParseResponse(encoded string, requestID string) (*Assertion, error) {
+	data, err := base64.StdEncoding.DecodeString(stripSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	if !response.is(nsProtocol, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+	if response.attr("Version") != "2.0" {
+		return nil, fmt.Errorf("unsupported SAML version %q", response.attr("Version"))
+	}
+	if response.hasAttr("Destination") && response.attr("Destination") != sp.ACSURL {
+		return nil, fmt.Errorf("response is destined for %q", response.attr("Destination"))
+	}
+	if response.attr("InResponseTo") != requestID {
+		return nil, errors.New("response isn't in response to the request of the login")
+	}
+	if issuer := response.child(nsAssertion, "Issuer"); issuer != nil && issuer.text() != sp.IDP.EntityID {
+		return nil, fmt.Errorf("response is issued by %q", issuer.text())
+	}
+	if err := checkStatus(response); err != nil {
+		return nil, err
+	}
+
+	// The signatures are verified with etree, from which the signed
+	// elements are read back
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	root := doc.Root()
+	responseSigned := false
+	switch signed, err := verifySignature(root, sp.IDP.Certificates, sp.now()); err {
+	case nil:
+		responseSigned = true
+		root = signed
+		if response, err = toElement(signed); err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
+		}
+	case errNotSigned:
+	default:
+		return nil, fmt.Errorf("invalid response signature: %v", err)
+	}
+
+	if len(response.childElements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions, err := childElements(root, nsAssertion, "Assertion")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("response has %d assertions, expected 1", len(assertions))
+	}
+	signedAssertion, err := verifySignature(assertions[0], sp.IDP.Certificates, sp.now())
+	switch {
+	case err == errNotSigned && responseSigned:
+		signedAssertion = assertions[0]
+	case err == errNotSigned:
+		return nil, errors.New("neither the response nor the assertion is signed")
+	case err != nil:
+		return nil, fmt.Errorf("invalid assertion signature: %v", err)
+	}
+	assertion, err := toElement(signedAssertion)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing assertion: %v", err)
+	}
+	return sp.parseAssertion(assertion, requestID)
+}
+
+// checkStatus returns an error unless the response reports success
+func checkStatus(response *element) error {
+	status := response.child(nsProtocol, "Status")
+	if status == nil {
+		return errors.New("response has no status")
+	}
+	code := status.child(nsProtocol, "StatusCode")
+	if code == nil {
+		return errors.New("response has no status code")
+	}
+	if code.attr("Value") == statusSuccess {
+		return nil
+	}
+	// The second level status code tells more, if any
+	value := code.attr("Value")
+	if sub := code.child(nsProtocol, "StatusCode"); sub != nil {
+		value = sub.attr("Value")
+	}
+	if message := status.child(nsProtocol, "StatusMessage"); message != nil && message.text() != "" {
+		return fmt.Errorf("login failed with status %s: %s", value, message.text())
+	}
+	return fmt.Errorf("login failed with status %s", value)
+}
+
+// parseAssertion checks the conditions and subject confirmation of the
+// signed assertion, and returns its subject and attributes
+func (sp *ServiceProvider) parseAssertion(assertion *element, requestID string) (*Assertion, error) {
+	now := sp.now()
+	issuer := assertion.child(nsAssertion, "Issuer")
+	if issuer == nil || issuer.text() != sp.IDP.EntityID {
+		return nil, errors.New("assertion isn't issued by the identity provider")
+	}
+
+	// Assertions have to be restricted to the service provider, as those
+	// issued for any other one would be accepted otherwise
+	conditions := assertion.child(nsAssertion, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+	if err := checkValidity(conditions, now); err != nil {
+		return nil, fmt.Errorf("assertion %v", err)
+	}
+	restrictions := conditions.childElements(nsAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("assertion has no audience restriction")
+	}
+	for _, restriction := range restrictions {
+		var ok bool
+		for _, audience := range restriction.childElements(nsAssertion, "Audience") {
+			ok = ok || audience.text() == sp.EntityID
+		}
+		if !ok {
+			return nil, errors.New("assertion is intended for another audience")
+		}
+	}
+
+	subject := assertion.child(nsAssertion, "Subject")
+	if subject == nil {
+		return nil, errors.New("assertion has no subject")
+	}
+	if err := sp.checkSubjectConfirmation(subject, requestID, now); err != nil {
+		return nil, err
+	}
+
+	a := &Assertion{Attributes: make(map[string][]string)}
+	if nameID := subject.child(nsAssertion, "NameID"); nameID != nil {
+		a.NameID = nameID.text()
+		a.NameIDFormat = nameID.attr("Format")
+	}
+	authn := assertion.child(nsAssertion, "AuthnStatement")
+	if authn == nil {
+		return nil, errors.New("assertion has no authentication statement")
+	}
+	a.SessionIndex = authn.attr("SessionIndex")
+	if authn.hasAttr("SessionNotOnOrAfter") {
+		t, err := parseTime(authn.attr("SessionNotOnOrAfter"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SessionNotOnOrAfter: %v", err)
+		}
+		a.SessionNotOnOrAfter = t
+	}
+	for _, statement := range assertion.childElements(nsAssertion, "AttributeStatement") {
+		for _, attribute := range statement.childElements(nsAssertion, "Attribute") {
+			var values []string
+			for _, value := range attribute.childElements(nsAssertion, "AttributeValue") {
+				values = append(values, value.text())
+			}
+			for _, name := range []string{attribute.attr("Name"), attribute.attr("FriendlyName")} {
+				if name != "" {
+					a.Attributes[name] = append(a.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// checkSubjectConfirmation checks that the subject can be confirmed as the
+// bearer of the assertion, which has to be delivered to the assertion
+// consumer service in response to the request
+func (sp *ServiceProvider) checkSubjectConfirmation(subject *element, requestID string, now time.Time) error {
+	for _, confirmation := range subject.childElements(nsAssertion, "SubjectConfirmation") {
+		if confirmation.attr("Method") != confirmationMethodBearer {
+			continue
+		}
+		data := confirmation.child(nsAssertion, "SubjectConfirmationData")
+		if data == nil || data.attr("Recipient") != sp.ACSURL {
+			continue
+		}
+		if data.hasAttr("InResponseTo") && data.attr("InResponseTo") != requestID {
+			continue
+		}
+		if !data.hasAttr("NotOnOrAfter") || checkValidity(data, now) != nil {
+			continue
+		}
+		return nil
+	}
+	return errors.New("assertion has no valid bearer subject confirmation")
+}
+
+// checkValidity checks the NotBefore and NotOnOrAfter attributes of the
+// element, allowing for clock skew
+func checkValidity(e *element, now time.Time) error {
+	if e.hasAttr("NotBefore") {
+		notBefore, err := parseTime(e.attr("NotBefore"))
+		if err != nil {
+			return fmt.Errorf("has an invalid NotBefore: %v", err)
+		}
+		if now.Add(maxClockSkew).Before(notBefore) {
+			return errors.New("is not valid yet")
+		}
+	}
+	if e.hasAttr("NotOnOrAfter") {
+		notOnOrAfter, err := parseTime(e.attr("NotOnOrAfter"))
+		if err != nil {
+			return fmt.Errorf("has an invalid NotOnOrAfter: %v", err)
+		}
+		if !now.Add(-maxClockSkew).Before(notOnOrAfter) {
+			return errors.New("has expired")
+		}
+	}
+	return nil
+}
+
+// parseTime parses an xs:dateTime
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// escape escapes text for an XML attribute or element
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
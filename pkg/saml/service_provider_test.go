@@ -0,0 +1,347 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIDPEntityID = "https://idp.example.com"
+	testSPEntityID  = "https://proxy.example.com/oauth2/saml/metadata"
+	testACSURL      = "https://proxy.example.com/oauth2/saml/acs"
+)
+
+var testNow = time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testIDP signs responses like an identity provider
+type testIDP struct {
+	key     *rsa.PrivateKey
+	certDER []byte
+}
+
+func newTestIDP(t *testing.T) *testIDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     testNow.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return &testIDP{key: key, certDER: der}
+}
+
+func (idp *testIDP) metadata() []byte {
+	return []byte(`<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="` + testIDPEntityID + `">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="encryption"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>invalid</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo>
+        <ds:X509Data>
+          <ds:X509Certificate>
+            ` + base64.StdEncoding.EncodeToString(idp.certDER) + `
+          </ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso?tenant=1"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`)
+}
+
+// GetKeyPair makes the identity provider a key store of goxmldsig
+func (idp *testIDP) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return idp.key, idp.certDER, nil
+}
+
+// sign replaces the marker comment within the element with the ID by an
+// enveloped signature of the element, made with goxmldsig. Comments are left
+// out when canonicalizing, so the marker doesn't change the digest.
+func (idp *testIDP) sign(t *testing.T, document, id, marker string) string {
+	return idp.signWithPrefixList(t, document, id, marker, "")
+}
+
+// signWithPrefixList signs like sign, also rendering the namespaces of the
+// InclusiveNamespaces PrefixList of the exclusive canonicalization
+func (idp *testIDP) signWithPrefixList(t *testing.T, document, id, marker, prefixList string) string {
+	doc := etree.NewDocument()
+	assert.NoError(t, doc.ReadFromString(document))
+	signed, err := detach(doc.FindElement("//[@ID='" + id + "']"))
+	assert.NoError(t, err)
+
+	ctx := dsig.NewDefaultSigningContext(idp)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(prefixList)
+	signature, err := ctx.ConstructSignature(signed, true)
+	assert.NoError(t, err)
+	if prefixList != "" {
+		// goxmldsig doesn't write the PrefixList, so the SignedInfo is
+		// signed again with it
+		transform := signature.FindElement("./ds:SignedInfo/ds:Reference/ds:Transforms/ds:Transform[@Algorithm='" + dsig.CanonicalXML10ExclusiveAlgorithmId.String() + "']")
+		inclusive := transform.CreateElement("ec:InclusiveNamespaces")
+		inclusive.CreateAttr("xmlns:ec", dsig.CanonicalXML10ExclusiveAlgorithmId.String())
+		inclusive.CreateAttr("PrefixList", prefixList)
+		signedInfo, err := detach(signature.FindElement("./ds:SignedInfo"))
+		assert.NoError(t, err)
+		canonical, err := dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("").Canonicalize(signedInfo)
+		assert.NoError(t, err)
+		hashed := sha256.Sum256(canonical)
+		value, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed[:])
+		assert.NoError(t, err)
+		signature.FindElement("./ds:SignatureValue").SetText(base64.StdEncoding.EncodeToString(value))
+	}
+
+	out := etree.NewDocument()
+	out.SetRoot(signature)
+	signatureXML, err := out.WriteToString()
+	assert.NoError(t, err)
+	return strings.Replace(document, marker, signatureXML, 1)
+}
+
+const testResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="response-id" Version="2.0" IssueInstant="2020-05-01T12:00:00Z" Destination="https://proxy.example.com/oauth2/saml/acs" InResponseTo="request-id">
+  <saml:Issuer>https://idp.example.com</saml:Issuer><!--response-signature-->
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ID="assertion-id" Version="2.0" IssueInstant="2020-05-01T12:00:00Z">
+    <saml:Issuer>https://idp.example.com</saml:Issuer><!--assertion-signature-->
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">john.doe@example.com</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData InResponseTo="request-id" NotOnOrAfter="2020-05-01T12:05:00Z" Recipient="https://proxy.example.com/oauth2/saml/acs"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="2020-05-01T11:55:00Z" NotOnOrAfter="2020-05-01T12:05:00Z">
+      <saml:AudienceRestriction><saml:Audience>https://proxy.example.com/oauth2/saml/metadata</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="2020-05-01T12:00:00Z" SessionIndex="session-index" SessionNotOnOrAfter="2020-05-01T20:00:00.000Z">
+      <saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext>
+    </saml:AuthnStatement>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="urn:oid:0.9.2342.19200300.100.1.3" FriendlyName="mail"><saml:AttributeValue xsi:type="xs:string">john.doe@example.com</saml:AttributeValue></saml:Attribute>
+      <saml:Attribute Name="groups"><saml:AttributeValue xsi:type="xs:string">admins</saml:AttributeValue><saml:AttributeValue xsi:type="xs:string">devs &amp; ops</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+func newTestServiceProvider(t *testing.T, idp *testIDP) *ServiceProvider {
+	identityProvider, err := ParseIdentityProvider(idp.metadata())
+	assert.NoError(t, err)
+	return &ServiceProvider{
+		EntityID: testSPEntityID,
+		ACSURL:   testACSURL,
+		IDP:      identityProvider,
+		Now:      func() time.Time { return testNow },
+	}
+}
+
+func encodeResponse(response string) string {
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+func TestParseIdentityProvider(t *testing.T) {
+	idp := newTestIDP(t)
+	identityProvider, err := ParseIdentityProvider(idp.metadata())
+	assert.NoError(t, err)
+	assert.Equal(t, testIDPEntityID, identityProvider.EntityID)
+	assert.Equal(t, "https://idp.example.com/sso?tenant=1", identityProvider.SSOURL.String())
+	if assert.Len(t, identityProvider.Certificates, 1) {
+		assert.Equal(t, idp.certDER, identityProvider.Certificates[0].Raw)
+	}
+
+	// Entities of federations may hold more than the identity provider
+	entities := `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata">` +
+		`<md:EntityDescriptor entityID="https://sp.example.com"><md:SPSSODescriptor/></md:EntityDescriptor>` +
+		strings.TrimPrefix(string(idp.metadata()), `<?xml version="1.0"?>`) +
+		`</md:EntitiesDescriptor>`
+	identityProvider, err = ParseIdentityProvider([]byte(entities))
+	assert.NoError(t, err)
+	assert.Equal(t, testIDPEntityID, identityProvider.EntityID)
+
+	_, err = ParseIdentityProvider([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"><md:SPSSODescriptor/></md:EntityDescriptor>`))
+	assert.Error(t, err)
+}
+
+func TestLoadIdentityProvider(t *testing.T) {
+	metadata, err := ioutil.TempFile("", "idp-metadata")
+	assert.NoError(t, err)
+	defer os.Remove(metadata.Name())
+	metadata.Write(newTestIDP(t).metadata())
+	metadata.Close()
+
+	identityProvider, err := LoadIdentityProvider(context.Background(), metadata.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, testIDPEntityID, identityProvider.EntityID)
+
+	// Anyone on the network path could replace the certificates
+	for _, source := range []string{"http://idp.example.com/metadata", "ftp://idp.example.com/metadata"} {
+		_, err = LoadIdentityProvider(context.Background(), source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestServiceProviderMetadata(t *testing.T) {
+	sp := newTestServiceProvider(t, newTestIDP(t))
+	root, err := parseXML(sp.Metadata())
+	assert.NoError(t, err)
+	assert.True(t, root.is(nsMetadata, "EntityDescriptor"))
+	assert.Equal(t, testSPEntityID, root.attr("entityID"))
+	acs := root.child(nsMetadata, "SPSSODescriptor").child(nsMetadata, "AssertionConsumerService")
+	assert.Equal(t, testACSURL, acs.attr("Location"))
+	assert.Equal(t, bindingHTTPPost, acs.attr("Binding"))
+}
+
+func TestAuthnRequestURL(t *testing.T) {
+	sp := newTestServiceProvider(t, newTestIDP(t))
+	u, err := url.Parse(sp.AuthnRequestURL("request-id", "relay-state"))
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, "1", u.Query().Get("tenant"))
+	assert.Equal(t, "relay-state", u.Query().Get("RelayState"))
+
+	deflated, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.NoError(t, err)
+	request, err := parseXML(data)
+	assert.NoError(t, err)
+	assert.True(t, request.is(nsProtocol, "AuthnRequest"))
+	assert.Equal(t, "request-id", request.attr("ID"))
+	assert.Equal(t, testACSURL, request.attr("AssertionConsumerServiceURL"))
+	assert.Equal(t, "2020-05-01T12:00:00Z", request.attr("IssueInstant"))
+	assert.Equal(t, testSPEntityID, request.child(nsAssertion, "Issuer").text())
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := newTestIDP(t)
+	sp := newTestServiceProvider(t, idp)
+
+	signedAssertion := idp.sign(t, testResponse, "assertion-id", "<!--assertion-signature-->")
+	assertion, err := sp.ParseResponse(encodeResponse(signedAssertion), "request-id")
+	assert.NoError(t, err)
+	assert.Equal(t, &Assertion{
+		NameID:       "john.doe@example.com",
+		NameIDFormat: NameIDFormatEmail,
+		Attributes: map[string][]string{
+			"urn:oid:0.9.2342.19200300.100.1.3": {"john.doe@example.com"},
+			"mail":                              {"john.doe@example.com"},
+			"groups":                            {"admins", "devs & ops"},
+		},
+		SessionIndex:        "session-index",
+		SessionNotOnOrAfter: time.Date(2020, 5, 1, 20, 0, 0, 0, time.UTC),
+	}, assertion)
+
+	// A signed response covers its assertion
+	signedResponse := idp.sign(t, testResponse, "response-id", "<!--response-signature-->")
+	_, err = sp.ParseResponse(encodeResponse(signedResponse), "request-id")
+	assert.NoError(t, err)
+	signedBoth := idp.sign(t, signedAssertion, "response-id", "<!--response-signature-->")
+	_, err = sp.ParseResponse(encodeResponse(signedBoth), "request-id")
+	assert.NoError(t, err)
+
+	// The xs prefix is only used in attribute values, so it is only rendered
+	// when canonicalizing as listed in the InclusiveNamespaces
+	signedInclusive := idp.signWithPrefixList(t, testResponse, "assertion-id", "<!--assertion-signature-->", "xs")
+	assert.Contains(t, signedInclusive, `PrefixList="xs"`)
+	_, err = sp.ParseResponse(encodeResponse(signedInclusive), "request-id")
+	assert.NoError(t, err)
+
+	// Comments are not signed, and don't cut the text they are in short
+	signedOther := idp.sign(t, strings.Replace(testResponse, ">john.doe@example.com</saml:NameID>", ">john.doe@example.com.evil.com</saml:NameID>", 1), "assertion-id", "<!--assertion-signature-->")
+	commented := strings.Replace(signedOther, "john.doe@example.com.evil.com", "john.doe@example.com<!---->.evil.com", 1)
+	assertion, err = sp.ParseResponse(encodeResponse(commented), "request-id")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com.evil.com", assertion.NameID)
+}
+
+func TestParseResponseRejectsInvalidResponses(t *testing.T) {
+	idp := newTestIDP(t)
+	sp := newTestServiceProvider(t, idp)
+	signedAssertion := idp.sign(t, testResponse, "assertion-id", "<!--assertion-signature-->")
+	signedByOther := newTestIDP(t).sign(t, testResponse, "assertion-id", "<!--assertion-signature-->")
+
+	// The signed assertion is moved out of the way of an unsigned one
+	start := strings.Index(signedAssertion, "<saml:Assertion ")
+	end := strings.Index(signedAssertion, "</saml:Assertion>") + len("</saml:Assertion>")
+	forged := strings.Replace(signedAssertion[start:end], "john.doe@", "jane.doe@", 1)
+	forged = strings.Replace(forged, `ID="assertion-id"`, `ID="forged-id"`, 1)
+	wrapped := signedAssertion[:start] +
+		`<samlp:Extensions>` + signedAssertion[start:end] + `</samlp:Extensions>` +
+		forged + signedAssertion[end:]
+	// The forged assertion keeps the ID and signature of the signed one
+	forgedWithSignature := strings.Replace(signedAssertion[start:end], "john.doe@", "jane.doe@", 1)
+	duplicateID := signedAssertion[:start] +
+		`<samlp:Extensions>` + signedAssertion[start:end] + `</samlp:Extensions>` +
+		forgedWithSignature + signedAssertion[end:]
+
+	// A signed response is embedded in one with a forged assertion
+	signedResponse := idp.sign(t, testResponse, "response-id", "<!--response-signature-->")
+	responseStart := strings.Index(signedResponse, "<saml:Issuer>")
+	wrappedResponse := strings.Replace(testResponse[:responseStart], `ID="response-id"`, `ID="forged-response-id"`, 1) +
+		`<samlp:Extensions>` + signedResponse + `</samlp:Extensions>` +
+		strings.Replace(testResponse[responseStart:], "john.doe@", "jane.doe@", 1)
+	// A second, unsigned assertion is added to a signed response
+	start = strings.Index(signedResponse, "<saml:Assertion ")
+	end = strings.Index(signedResponse, "</saml:Assertion>") + len("</saml:Assertion>")
+	addedAssertion := signedResponse[:start] + strings.Replace(signedResponse[start:end], "john.doe@", "jane.doe@", 1) + signedResponse[start:]
+	// The assertion isn't restricted to the audience of the service provider
+	start = strings.Index(testResponse, "<saml:Conditions")
+	end = strings.Index(testResponse, "</saml:Conditions>") + len("</saml:Conditions>")
+	withoutConditions := idp.sign(t, testResponse[:start]+testResponse[end:], "assertion-id", "<!--assertion-signature-->")
+	withoutAudience := idp.sign(t, strings.Replace(testResponse, "<saml:AudienceRestriction><saml:Audience>https://proxy.example.com/oauth2/saml/metadata</saml:Audience></saml:AudienceRestriction>", "", 1), "assertion-id", "<!--assertion-signature-->")
+
+	testCases := []struct {
+		name      string
+		response  string
+		requestID string
+		now       time.Time
+	}{
+		{"unsigned", testResponse, "request-id", testNow},
+		{"signed by another key", signedByOther, "request-id", testNow},
+		{"tampered", strings.Replace(signedAssertion, "admins", "owners", 1), "request-id", testNow},
+		{"wrapped", wrapped, "request-id", testNow},
+		{"with a duplicate ID", duplicateID, "request-id", testNow},
+		{"wrapping a signed response", wrappedResponse, "request-id", testNow},
+		{"with an added assertion", addedAssertion, "request-id", testNow},
+		{"with a tampered response", strings.Replace(signedResponse, "john.doe@", "jane.doe@", 1), "request-id", testNow},
+		{"in response to another request", signedAssertion, "other-request-id", testNow},
+		{"expired", signedAssertion, "request-id", testNow.Add(10 * time.Minute)},
+		{"not yet valid", signedAssertion, "request-id", testNow.Add(-10 * time.Minute)},
+		{"failed", idp.sign(t, strings.Replace(testResponse, "status:Success", "status:Responder", 1), "assertion-id", "<!--assertion-signature-->"), "request-id", testNow},
+		{"for another audience", idp.sign(t, strings.Replace(testResponse, "oauth2/saml/metadata", "other/metadata", 1), "assertion-id", "<!--assertion-signature-->"), "request-id", testNow},
+		{"without an audience restriction", withoutAudience, "request-id", testNow},
+		{"without conditions", withoutConditions, "request-id", testNow},
+		{"for another recipient", idp.sign(t, strings.Replace(testResponse, `Recipient="https://proxy.example.com/`, `Recipient="https://other.example.com/`, 1), "assertion-id", "<!--assertion-signature-->"), "request-id", testNow},
+		{"issued by another entity", idp.sign(t, strings.Replace(testResponse, "<saml:Issuer>https://idp.example.com</saml:Issuer><!--assertion", "<saml:Issuer>https://other.example.com</saml:Issuer><!--assertion", 1), "assertion-id", "<!--assertion-signature-->"), "request-id", testNow},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sp.Now = func() time.Time { return tc.now }
+			_, err := sp.ParseResponse(encodeResponse(tc.response), tc.requestID)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := sp.ParseResponse("<samlp:Response/>", "request-id")
+	assert.Error(t, err)
+}
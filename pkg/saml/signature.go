@@ -0,0 +1,90 @@
+package saml
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// errNotSigned is returned by verifySignature for elements without a
+// signature
+var errNotSigned = errors.New("not signed")
+
+// verifySignature verifies the enveloped signature of the element with the
+// certificates, and returns the element as it was signed, without the
+// signature. Only the returned element is covered by the signature, so
+// nothing may be read from elsewhere in the document.
+func verifySignature(e *etree.Element, certs []*x509.Certificate, now time.Time) (*etree.Element, error) {
+	signatures, err := childElements(e, nsDSig, "Signature")
+	if err != nil {
+		return nil, err
+	}
+	switch len(signatures) {
+	case 0:
+		return nil, errNotSigned
+	case 1:
+	default:
+		return nil, errors.New("more than one signature")
+	}
+
+	// The element is detached from the document with the namespaces in
+	// scope declared on it, so that it canonicalizes as signed
+	detached, err := detach(e)
+	if err != nil {
+		return nil, err
+	}
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	ctx.IdAttribute = "ID"
+	ctx.Clock = dsig.NewFakeClockAt(now)
+	return ctx.Validate(detached)
+}
+
+// childElements returns the child elements with the namespace and name
+func childElements(e *etree.Element, ns, name string) ([]*etree.Element, error) {
+	ctx, err := etreeutils.NSBuildParentContext(e)
+	if err != nil {
+		return nil, err
+	}
+	var children []*etree.Element
+	err = etreeutils.NSFindChildrenIterateCtx(ctx, e, ns, name, func(_ etreeutils.NSContext, c *etree.Element) error {
+		children = append(children, c)
+		return nil
+	})
+	return children, err
+}
+
+// detach copies the element out of its document, declaring the namespaces
+// in scope on it
+func detach(e *etree.Element) (*etree.Element, error) {
+	ctx, err := etreeutils.NSBuildParentContext(e)
+	if err != nil {
+		return nil, err
+	}
+	return etreeutils.NSDetatch(ctx, e)
+}
+
+// toElement converts an element of etree, as returned by verifySignature,
+// to an element as parseXML returns it
+func toElement(e *etree.Element) (*element, error) {
+	detached, err := detach(e)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(detached)
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return parseXML(data)
+}
+
+// stripSpace removes all white space, which may wrap base64 encoded values
+func stripSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
@@ -0,0 +1,202 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Namespaces of the SAML and XML Signature elements
+const (
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+	nsXML       = "http://www.w3.org/XML/1998/namespace"
+)
+
+// element is an XML element as parsed, with its namespace prefixes and
+// declarations intact
+type element struct {
+	parent *element
+	prefix string
+	name   string
+	// attrs holds the attributes, namespace declarations included
+	attrs []xml.Attr
+	// children holds the child elements and text in document order
+	children []interface{}
+}
+
+// text is the character data within an element
+type text string
+
+// parseXML parses a document. DTDs are rejected, comments and processing
+// instructions dropped.
+func parseXML(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			e := &element{parent: cur, prefix: t.Name.Space, name: t.Name.Local, attrs: t.Copy().Attr}
+			if err := e.checkPrefixes(); err != nil {
+				return nil, err
+			}
+			if cur != nil {
+				cur.children = append(cur.children, e)
+			} else if root == nil {
+				root = e
+			} else {
+				return nil, errors.New("more than one root element")
+			}
+			cur = e
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.name {
+				return nil, fmt.Errorf("unexpected end element %s", qualifiedName(t.Name))
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, text(t))
+			} else if len(bytes.TrimSpace(t)) != 0 {
+				return nil, errors.New("text outside of the root element")
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not supported")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return root, nil
+}
+
+// checkPrefixes checks that the prefixes of the element and its attributes
+// are declared
+func (e *element) checkPrefixes() error {
+	if _, ok := e.lookupNamespace(e.prefix); !ok {
+		return fmt.Errorf("undeclared namespace prefix %q", e.prefix)
+	}
+	for _, a := range e.attrs {
+		if isNamespaceDeclaration(a) || a.Name.Space == "" {
+			continue
+		}
+		if _, ok := e.lookupNamespace(a.Name.Space); !ok {
+			return fmt.Errorf("undeclared namespace prefix %q", a.Name.Space)
+		}
+	}
+	return nil
+}
+
+func isNamespaceDeclaration(a xml.Attr) bool {
+	return a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns")
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// lookupNamespace returns the namespace the prefix is bound to in the scope
+// of the element. The empty prefix is bound to the default namespace, which
+// is empty unless declared.
+func (e *element) lookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for n := e; n != nil; n = n.parent {
+		for _, a := range n.attrs {
+			if prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns" {
+				return a.Value, true
+			}
+			if prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix {
+				return a.Value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+// namespace returns the namespace of the element
+func (e *element) namespace() string {
+	ns, _ := e.lookupNamespace(e.prefix)
+	return ns
+}
+
+// is reports whether the element has the namespace and name
+func (e *element) is(ns, name string) bool {
+	return e.name == name && e.namespace() == ns
+}
+
+// attr returns the value of the attribute without a namespace
+func (e *element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// hasAttr reports whether the element has the attribute without a namespace
+func (e *element) hasAttr(name string) bool {
+	for _, a := range e.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return true
+		}
+	}
+	return false
+}
+
+// childElements returns the child elements with the namespace and name
+func (e *element) childElements(ns, name string) []*element {
+	var children []*element
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok && c.is(ns, name) {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// child returns the first child element with the namespace and name, or nil
+func (e *element) child(ns, name string) *element {
+	if children := e.childElements(ns, name); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+// text returns the text of the element, without that of its descendants,
+// with leading and trailing white space removed
+func (e *element) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		if t, ok := c.(text); ok {
+			b.WriteString(string(t))
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// walk calls fn for the element and all its descendants
+func (e *element) walk(fn func(*element)) {
+	fn(e)
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok {
+			c.walk(fn)
+		}
+	}
+}
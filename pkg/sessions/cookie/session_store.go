@@ -27,8 +27,9 @@ var _ sessions.SessionStore = &SessionStore{}
 // SessionStore is an implementation of the sessions.SessionStore
 // interface that stores sessions in client side cookies
 type SessionStore struct {
-	CookieOptions *options.CookieOptions
-	CookieCipher  *encryption.Cipher
+	CookieOptions         *options.CookieOptions
+	CookieCipher          *encryption.Cipher
+	PreviousCookieCiphers []*encryption.Cipher
 }
 
 // Save takes a sessions.SessionState and stores the information from it
@@ -53,15 +54,16 @@ func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 		// always http.ErrNoCookie
 		return nil, fmt.Errorf("Cookie %q not present", s.CookieOptions.CookieName)
 	}
-	val, _, ok := encryption.Validate(c, s.CookieOptions.CookieSecret, s.CookieOptions.CookieExpire)
+	val, _, secret, ok := encryption.ValidateAny(c, s.CookieOptions.CookieSecrets(), s.CookieOptions.CookieExpire)
 	if !ok {
 		return nil, errors.New("Cookie Signature not valid")
 	}
 
-	session, err := utils.SessionFromCookie(val, s.CookieCipher)
+	session, err := utils.SessionFromCookie(val, utils.CipherForSecret(s.CookieCipher, s.PreviousCookieCiphers, secret))
 	if err != nil {
 		return nil, err
 	}
+	session.Rotated = secret > 0
 	return session, nil
 }
 
@@ -120,8 +122,9 @@ func (s *SessionStore) makeCookie(req *http.Request, name string, value string,
 // the configuration given
 func NewCookieSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
 	return &SessionStore{
-		CookieCipher:  opts.Cipher,
-		CookieOptions: cookieOpts,
+		CookieCipher:          opts.Cipher,
+		PreviousCookieCiphers: opts.PreviousCiphers,
+		CookieOptions:         cookieOpts,
 	}, nil
 }
 
@@ -0,0 +1,351 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	sessionsBucket = []byte("sessions")
+	indexesBucket  = []byte("indexes")
+)
+
+// compactionBatchSize bounds the number of keys deleted in a transaction
+const compactionBatchSize = 1000
+
+// SessionStore is an implementation of the sessions.SessionStore
+// interface that stores sessions in a bolt database on disk, so they
+// survive restarts of the proxy. The database can only be opened by a
+// single instance of the proxy.
+type SessionStore struct {
+	*persistence.Manager
+	// Now returns the current time, sessions expire relative to it
+	Now func() time.Time
+
+	path      string
+	db        *bolt.DB
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// entry is a session or an index saved in the database
+type entry struct {
+	Value   string            `json:"value,omitempty"`
+	Members map[string]string `json:"members,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+// NewFileSessionStore initialises a new instance of the SessionStore from
+// the configuration given, and starts the periodic compaction of the
+// database
+func NewFileSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	if opts.FileStorePath == "" {
+		return nil, fmt.Errorf("file-store-path is required")
+	}
+	if opts.FileStoreCompactionInterval <= 0 {
+		return nil, fmt.Errorf("file-store-compaction-interval must be positive")
+	}
+
+	db, err := openDB(opts.FileStorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &SessionStore{
+		Now:  time.Now,
+		path: opts.FileStorePath,
+		db:   db,
+		done: make(chan struct{}),
+	}
+	fs.Manager = persistence.NewManager(fs, opts, cookieOpts)
+	go fs.runCompaction(opts.FileStoreCompactionInterval)
+	return fs, nil
+}
+
+func openDB(path string) (*bolt.DB, error) {
+	// Fail rather than wait when another process holds the database
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening session database %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{sessionsBucket, indexesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initialising session database %s: %v", path, err)
+	}
+	return db, nil
+}
+
+// Set stores the value in the sessions bucket
+func (store *SessionStore) Set(key string, value string, expiration time.Duration) error {
+	return store.update(func(tx *bolt.Tx) error {
+		return putEntry(tx.Bucket(sessionsBucket), key, &entry{
+			Value:   value,
+			Expires: store.Now().Add(expiration),
+		})
+	})
+}
+
+// Get returns the value of the key unless it has expired
+func (store *SessionStore) Get(key string) (string, error) {
+	var e *entry
+	err := store.view(func(tx *bolt.Tx) error {
+		var err error
+		e, err = getEntry(tx.Bucket(sessionsBucket), key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if e == nil || !store.Now().Before(e.Expires) {
+		return "", sessions.ErrSessionNotFound
+	}
+	return e.Value, nil
+}
+
+// Del deletes the sessions and indexes with the keys
+func (store *SessionStore) Del(keys ...string) error {
+	return store.update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			for _, bucket := range [][]byte{sessionsBucket, indexesBucket} {
+				if err := tx.Bucket(bucket).Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// AddToIndex sets the member of the index of the key
+func (store *SessionStore) AddToIndex(key string, member string, value string, expiration time.Duration) error {
+	return store.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexesBucket)
+		idx, err := getEntry(b, key)
+		if err != nil {
+			return err
+		}
+		if idx == nil || !store.Now().Before(idx.Expires) {
+			idx = &entry{Members: make(map[string]string)}
+		}
+		idx.Members[member] = value
+		idx.Expires = store.Now().Add(expiration)
+		return putEntry(b, key, idx)
+	})
+}
+
+// RemoveFromIndex removes the member from the index of the key
+func (store *SessionStore) RemoveFromIndex(key string, member string) error {
+	return store.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexesBucket)
+		idx, err := getEntry(b, key)
+		if err != nil || idx == nil {
+			return err
+		}
+		delete(idx.Members, member)
+		if len(idx.Members) == 0 {
+			return b.Delete([]byte(key))
+		}
+		return putEntry(b, key, idx)
+	})
+}
+
+// IndexMembers returns the members of the index of the key
+func (store *SessionStore) IndexMembers(key string) (map[string]string, error) {
+	var idx *entry
+	err := store.view(func(tx *bolt.Tx) error {
+		var err error
+		idx, err = getEntry(tx.Bucket(indexesBucket), key)
+		return err
+	})
+	if err != nil || idx == nil || !store.Now().Before(idx.Expires) {
+		return nil, err
+	}
+	return idx.Members, nil
+}
+
+func (store *SessionStore) update(fn func(*bolt.Tx) error) error {
+	return store.db.Update(fn)
+}
+
+func (store *SessionStore) view(fn func(*bolt.Tx) error) error {
+	return store.db.View(fn)
+}
+
+// Close stops the compaction and closes the database. It may be called more
+// than once.
+func (store *SessionStore) Close() error {
+	var err error
+	store.closeOnce.Do(func() {
+		close(store.done)
+		err = store.db.Close()
+	})
+	return err
+}
+
+// runCompaction compacts the database every interval, until the store is
+// closed
+func (store *SessionStore) runCompaction(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.compact(); err != nil {
+				logger.Printf("error compacting session database %s: %v", store.path, err)
+			}
+		case <-store.done:
+			return
+		}
+	}
+}
+
+// compact deletes the expired sessions and indexes in place, and drops the
+// members of indexes whose session is gone, so that the indexes don't
+// outgrow the sessions. Keys are deleted in transactions of at most
+// compactionBatchSize keys, so that requests aren't held up by a large
+// database. The space of deleted entries is reused by bolt, the file
+// doesn't shrink.
+func (store *SessionStore) compact() error {
+	now := store.Now()
+	expired, err := store.collectKeys(sessionsBucket, func(e *entry) bool {
+		return !now.Before(e.Expires)
+	})
+	if err != nil {
+		return err
+	}
+	err = store.updateBatches(expired, func(tx *bolt.Tx, key string) error {
+		b := tx.Bucket(sessionsBucket)
+		// The session may have been saved again in the meantime
+		e, err := getEntry(b, key)
+		if err != nil || e == nil || now.Before(e.Expires) {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	err = store.view(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		return tx.Bucket(indexesBucket).ForEach(func(k, v []byte) error {
+			if isStaleIndex(sessions, v, now) {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return store.updateBatches(stale, func(tx *bolt.Tx, key string) error {
+		b := tx.Bucket(indexesBucket)
+		idx, err := getEntry(b, key)
+		if err != nil || idx == nil {
+			return err
+		}
+		sessions := tx.Bucket(sessionsBucket)
+		for member := range idx.Members {
+			if sessions.Get([]byte(member)) == nil {
+				delete(idx.Members, member)
+			}
+		}
+		if len(idx.Members) == 0 || !now.Before(idx.Expires) {
+			return b.Delete([]byte(key))
+		}
+		return putEntry(b, key, idx)
+	})
+}
+
+// collectKeys returns the keys of the entries of the bucket matching fn.
+// Entries that can't be decoded match too, so that they are removed.
+func (store *SessionStore) collectKeys(bucket []byte, fn func(*entry) bool) ([]string, error) {
+	var keys []string
+	err := store.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil || fn(&e) {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// updateBatches calls fn for each of the keys, in a transaction per
+// compactionBatchSize keys
+func (store *SessionStore) updateBatches(keys []string, fn func(*bolt.Tx, string) error) error {
+	for len(keys) > 0 {
+		n := compactionBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		err := store.update(func(tx *bolt.Tx) error {
+			for _, key := range batch {
+				if err := fn(tx, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStaleIndex reports whether the index has expired, or has members whose
+// session is gone
+func isStaleIndex(sessions *bolt.Bucket, v []byte, now time.Time) bool {
+	var idx entry
+	if err := json.Unmarshal(v, &idx); err != nil || !now.Before(idx.Expires) {
+		return true
+	}
+	for member := range idx.Members {
+		if sessions.Get([]byte(member)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func getEntry(b *bolt.Bucket, key string) (*entry, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, nil
+	}
+	e := &entry{}
+	if err := json.Unmarshal(v, e); err != nil {
+		return nil, fmt.Errorf("error decoding entry: %v", err)
+	}
+	return e, nil
+}
+
+func putEntry(b *bolt.Bucket, key string, e *entry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), v)
+}
@@ -0,0 +1,107 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestStore(t *testing.T) (*SessionStore, func()) {
+	dir, err := ioutil.TempDir("", "file_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options.SessionOptions{
+		FileStoreOptions: options.FileStoreOptions{
+			FileStorePath:               filepath.Join(dir, "sessions.db"),
+			FileStoreCompactionInterval: time.Hour,
+		},
+	}
+	ss, err := NewFileSessionStore(opts, &options.CookieOptions{})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	store := ss.(*SessionStore)
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func bucketKeys(t *testing.T, store *SessionStore, bucket []byte) []string {
+	var keys []string
+	err := store.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	return keys
+}
+
+func TestCompactRemovesExpiredEntries(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, store.Set("expired", "value", time.Minute))
+	assert.NoError(t, store.Set("live", "value", time.Hour))
+	assert.NoError(t, store.AddToIndex("index", "expired", "info", time.Hour))
+	assert.NoError(t, store.AddToIndex("index", "live", "info", time.Hour))
+	assert.NoError(t, store.AddToIndex("expired-index", "expired", "info", time.Minute))
+
+	now := time.Now().Add(30 * time.Minute)
+	store.Now = func() time.Time { return now }
+	assert.NoError(t, store.compact())
+
+	assert.Equal(t, []string{"live"}, bucketKeys(t, store, sessionsBucket))
+	assert.Equal(t, []string{"index"}, bucketKeys(t, store, indexesBucket))
+	members, err := store.IndexMembers("index")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"live": "info"}, members)
+
+	value, err := store.Get("live")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestCompactDeletesInBatches(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	n := 2*compactionBatchSize + 1
+	expires := time.Now().Add(time.Minute)
+	err := store.update(func(tx *bolt.Tx) error {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("expired-%d", i)
+			if err := putEntry(tx.Bucket(sessionsBucket), key, &entry{Value: "value", Expires: expires}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Set("live", "value", time.Hour))
+
+	now := time.Now().Add(30 * time.Minute)
+	store.Now = func() time.Time { return now }
+	assert.NoError(t, store.compact())
+
+	assert.Equal(t, []string{"live"}, bucketKeys(t, store, sessionsBucket))
+}
+
+func TestCloseTwice(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	assert.NoError(t, store.Close())
+	assert.NotPanics(t, func() { store.Close() })
+}
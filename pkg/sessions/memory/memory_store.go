@@ -0,0 +1,229 @@
+package memory
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/persistence"
+)
+
+// SessionStore is an implementation of the sessions.SessionStore
+// interface that stores sessions in the memory of the proxy. It only suits
+// deployments running a single instance of the proxy, and sessions are lost
+// when it restarts.
+type SessionStore struct {
+	*persistence.Manager
+	// Now returns the current time, sessions expire relative to it
+	Now func() time.Time
+
+	maxSessions int
+	mutex       sync.Mutex
+	// lru holds the sessions, the most recently used first
+	lru      *list.List
+	sessions map[string]*list.Element
+	indexes  map[string]*index
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type entry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+type index struct {
+	members map[string]string
+	expires time.Time
+}
+
+// NewMemorySessionStore initialises a new instance of the SessionStore from
+// the configuration given, and starts the janitor removing expired sessions
+func NewMemorySessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	if opts.MemoryMaxSessions < 1 {
+		return nil, fmt.Errorf("memory-max-sessions must be at least 1")
+	}
+	if opts.MemoryCleanupInterval <= 0 {
+		return nil, fmt.Errorf("memory-cleanup-interval must be positive")
+	}
+
+	ms := &SessionStore{
+		Now:         time.Now,
+		maxSessions: opts.MemoryMaxSessions,
+		lru:         list.New(),
+		sessions:    make(map[string]*list.Element),
+		indexes:     make(map[string]*index),
+		done:        make(chan struct{}),
+	}
+	ms.Manager = persistence.NewManager(ms, opts, cookieOpts)
+	go ms.runJanitor(opts.MemoryCleanupInterval)
+	return ms, nil
+}
+
+// Set stores the value, evicting the least recently used sessions when
+// the store is full
+func (store *SessionStore) Set(key string, value string, expiration time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	expires := store.Now().Add(expiration)
+	if element, ok := store.sessions[key]; ok {
+		e := element.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		store.lru.MoveToFront(element)
+		return nil
+	}
+
+	store.sessions[key] = store.lru.PushFront(&entry{key: key, value: value, expires: expires})
+	for store.lru.Len() > store.maxSessions {
+		store.removeElement(store.lru.Back())
+	}
+	return nil
+}
+
+// Get returns the value of the key unless it has expired
+func (store *SessionStore) Get(key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	element, ok := store.sessions[key]
+	if !ok {
+		return "", sessions.ErrSessionNotFound
+	}
+	e := element.Value.(*entry)
+	if !store.Now().Before(e.expires) {
+		store.removeElement(element)
+		return "", sessions.ErrSessionNotFound
+	}
+	store.lru.MoveToFront(element)
+	return e.value, nil
+}
+
+// Expire sets the expiration of the session with the key
+func (store *SessionStore) Expire(key string, expiration time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if element, ok := store.sessions[key]; ok {
+		element.Value.(*entry).expires = store.Now().Add(expiration)
+	}
+	return nil
+}
+
+// Del deletes the sessions and indexes with the keys
+func (store *SessionStore) Del(keys ...string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, key := range keys {
+		if element, ok := store.sessions[key]; ok {
+			store.removeElement(element)
+		}
+		delete(store.indexes, key)
+	}
+	return nil
+}
+
+// AddToIndex sets the member of the index of the key
+func (store *SessionStore) AddToIndex(key string, member string, value string, expiration time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	idx, ok := store.indexes[key]
+	if !ok {
+		idx = &index{members: make(map[string]string)}
+		store.indexes[key] = idx
+	}
+	idx.members[member] = value
+	idx.expires = store.Now().Add(expiration)
+	return nil
+}
+
+// RemoveFromIndex removes the member from the index of the key
+func (store *SessionStore) RemoveFromIndex(key string, member string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if idx, ok := store.indexes[key]; ok {
+		delete(idx.members, member)
+		if len(idx.members) == 0 {
+			delete(store.indexes, key)
+		}
+	}
+	return nil
+}
+
+// IndexMembers returns the members of the index of the key
+func (store *SessionStore) IndexMembers(key string) (map[string]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	idx, ok := store.indexes[key]
+	if !ok || !store.Now().Before(idx.expires) {
+		return nil, nil
+	}
+	members := make(map[string]string, len(idx.members))
+	for member, value := range idx.members {
+		members[member] = value
+	}
+	return members, nil
+}
+
+func (store *SessionStore) removeElement(element *list.Element) {
+	store.lru.Remove(element)
+	delete(store.sessions, element.Value.(*entry).key)
+}
+
+// Close stops the janitor. It may be called more than once.
+func (store *SessionStore) Close() error {
+	store.stopOnce.Do(func() { close(store.done) })
+	return nil
+}
+
+// runJanitor deletes expired sessions and indexes every interval, until the
+// store is closed
+func (store *SessionStore) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			store.deleteExpired()
+		case <-store.done:
+			return
+		}
+	}
+}
+
+// deleteExpired deletes the expired sessions, and the expired indexes.
+// Members of indexes are dropped once their session is gone, so that the
+// indexes don't outgrow the sessions.
+func (store *SessionStore) deleteExpired() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := store.Now()
+	for element := store.lru.Front(); element != nil; {
+		next := element.Next()
+		if !now.Before(element.Value.(*entry).expires) {
+			store.removeElement(element)
+		}
+		element = next
+	}
+
+	for key, idx := range store.indexes {
+		for member := range idx.members {
+			if _, ok := store.sessions[member]; !ok {
+				delete(idx.members, member)
+			}
+		}
+		if len(idx.members) == 0 || !now.Before(idx.expires) {
+			delete(store.indexes, key)
+		}
+	}
+}
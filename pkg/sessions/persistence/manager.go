@@ -0,0 +1,492 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/cookies"
+	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/utils"
+)
+
+// Store is the storage of a server side session store, keeping the
+// encrypted sessions and the indexes of their handles
+type Store interface {
+	// Set stores the value under the key, expiring after expiration
+	Set(key string, value string, expiration time.Duration) error
+	// Get returns the value stored under the key, or
+	// sessions.ErrSessionNotFound if there is no such value or it has expired
+	Get(key string) (string, error)
+	// Del deletes the values and indexes with the keys
+	Del(keys ...string) error
+	// AddToIndex sets the member of the index with the key to value, and
+	// extends the expiration of the index
+	AddToIndex(key string, member string, value string, expiration time.Duration) error
+	// RemoveFromIndex removes the member from the index with the key
+	RemoveFromIndex(key string, member string) error
+	// IndexMembers returns the members of the index with the key, and their
+	// values
+	IndexMembers(key string) (map[string]string, error)
+}
+
+// Toucher is implemented by Stores that can extend the expiration of a
+// value without writing it again. Sessions in such Stores expire once idle
+// for the cookie idle timeout, and are touched whenever they are loaded.
+type Toucher interface {
+	// Expire sets the expiration of the value stored under the key
+	Expire(key string, expiration time.Duration) error
+}
+
+// Locker is implemented by Stores shared between instances of the proxy,
+// that sessions have to be locked in while they are refreshed
+type Locker interface {
+	// SetNX stores the value under the key like Set, unless the key
+	// exists. It returns whether the value was stored.
+	SetNX(key string, value string, expiration time.Duration) (bool, error)
+	// DelIfEqual atomically deletes the value stored under the key, if it
+	// equals value
+	DelIfEqual(key string, value string) error
+}
+
+// Manager implements the sessions.SessionStore,
+// sessions.ManageableSessionStore and sessions.LockingSessionStore
+// interfaces on top of a Store. The session
+// cookie holds a ticket, that is the key of the session in the Store and
+// the secret the session is encrypted with. The indexes of the sessions map
+// their handles to a sessions.SessionInfo, as the sessions themselves can't
+// be decrypted without the ticket.
+type Manager struct {
+	Store                 Store
+	CookieCipher          *encryption.Cipher
+	PreviousCookieCiphers []*encryption.Cipher
+	CookieOptions         *options.CookieOptions
+	// LegacyDecryption accepts sessions encrypted with AES-CFB by older
+	// versions
+	LegacyDecryption bool
+}
+
+// NewManager creates a Manager keeping the sessions in the store
+func NewManager(store Store, opts *options.SessionOptions, cookieOpts *options.CookieOptions) *Manager {
+	return &Manager{
+		Store:                 store,
+		CookieCipher:          opts.Cipher,
+		PreviousCookieCiphers: opts.PreviousCiphers,
+		CookieOptions:         cookieOpts,
+		LegacyDecryption:      opts.LegacyDecryption,
+	}
+}
+
+// Save takes a sessions.SessionState and stores the information from it
+// in the Store, and adds a new ticket cookie on the HTTP response writer
+func (m *Manager) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+
+	// Old sessions that we are refreshing would have a request cookie
+	// New sessions don't, so we ignore the error. storeValue will check requestCookie
+	requestCookie, _ := req.Cookie(m.CookieOptions.CookieName)
+	value, err := s.EncodeSessionState(m.CookieCipher)
+	if err != nil {
+		return err
+	}
+	ticket, err := m.storeValue(value, m.sessionTTL(), requestCookie)
+	if err != nil {
+		return err
+	}
+	err = m.indexSession(ticket, s)
+	if err != nil {
+		return fmt.Errorf("error indexing session: %v", err)
+	}
+
+	ticketCookie := m.makeCookie(
+		req,
+		ticket.encodeTicket(m.CookieOptions.CookieName),
+		m.CookieOptions.CookieExpire,
+		s.CreatedAt,
+	)
+
+	http.SetCookie(rw, ticketCookie)
+	return nil
+}
+
+// Load reads sessions.SessionState information from a ticket
+// cookie within the HTTP request object
+func (m *Manager) Load(req *http.Request) (*sessions.SessionState, error) {
+	requestCookie, err := req.Cookie(m.CookieOptions.CookieName)
+	if err != nil {
+		return nil, fmt.Errorf("error loading session: %s", err)
+	}
+
+	val, _, secret, ok := encryption.ValidateAny(requestCookie, m.CookieOptions.CookieSecrets(), m.CookieOptions.CookieExpire)
+	if !ok {
+		return nil, fmt.Errorf("Cookie Signature not valid")
+	}
+	c := utils.CipherForSecret(m.CookieCipher, m.PreviousCookieCiphers, secret)
+	session, err := m.loadSessionFromString(val, c)
+	if err != nil {
+		return nil, fmt.Errorf("error loading session: %s", err)
+	}
+	session.Rotated = secret > 0
+
+	if toucher, ok := m.Store.(Toucher); ok && m.CookieOptions.CookieIdleTimeout > 0 {
+		// The session would have expired if it had been idle, so it
+		// need not be saved again to record it as seen
+		ticket, _ := decodeTicket(m.CookieOptions.CookieName, val)
+		err = toucher.Expire(ticket.asHandle(m.CookieOptions.CookieName), m.sessionTTL())
+		if err != nil {
+			return nil, fmt.Errorf("error touching session: %s", err)
+		}
+		session.LastSeenAt = time.Now()
+	}
+	return session, nil
+}
+
+// loadSessionFromString loads the session based on the ticket value, with
+// the fields encrypted by c
+func (m *Manager) loadSessionFromString(value string, c *encryption.Cipher) (*sessions.SessionState, error) {
+	ticket, err := decodeTicket(m.CookieOptions.CookieName, value)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.Store.Get(ticket.asHandle(m.CookieOptions.CookieName))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := ticket.decryptValue(result, m.LegacyDecryption)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := sessions.DecodeSessionState(plaintext, c)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Clear clears any saved session information for a given ticket cookie
+// from the Store, and then clears the session
+func (m *Manager) Clear(rw http.ResponseWriter, req *http.Request) error {
+	// We go ahead and clear the cookie first, always.
+	clearCookie := m.makeCookie(
+		req,
+		"",
+		time.Hour*-1,
+		time.Now(),
+	)
+	http.SetCookie(rw, clearCookie)
+
+	// If there was an existing cookie we should clear the session in the store
+	requestCookie, err := req.Cookie(m.CookieOptions.CookieName)
+	if err != nil && err == http.ErrNoCookie {
+		// No existing cookie so can't clear the store
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error retrieving cookie: %v", err)
+	}
+
+	val, _, secret, ok := encryption.ValidateAny(requestCookie, m.CookieOptions.CookieSecrets(), m.CookieOptions.CookieExpire)
+	if !ok {
+		return fmt.Errorf("Cookie Signature not valid")
+	}
+
+	// We only return an error if we had an issue with the store
+	// If there's an issue decoding the ticket, ignore it
+	ticket, _ := decodeTicket(m.CookieOptions.CookieName, val)
+	if ticket != nil {
+		handle := ticket.asHandle(m.CookieOptions.CookieName)
+		// The session is needed to find the index of its user, there is
+		// nothing to remove from the index if it's gone already
+		c := utils.CipherForSecret(m.CookieCipher, m.PreviousCookieCiphers, secret)
+		if session, err := m.loadSessionFromString(val, c); err == nil && session.UserKey() != "" {
+			err = m.Store.RemoveFromIndex(m.indexKey("user", session.UserKey()), handle)
+			if err != nil {
+				return fmt.Errorf("error clearing session from index: %s", err)
+			}
+		}
+		err := m.Store.Del(handle)
+		if err != nil {
+			return fmt.Errorf("error clearing session: %s", err)
+		}
+	}
+	return nil
+}
+
+// ClearBySubject clears all sessions saved for the OIDC subject of the
+// issuer
+func (m *Manager) ClearBySubject(issuer string, subject string) error {
+	return m.clearIndex(m.indexKey("sub", issuerScoped(issuer, subject)))
+}
+
+// ClearBySessionID clears all sessions saved with the OIDC session ID of the
+// issuer
+func (m *Manager) ClearBySessionID(issuer string, sid string) error {
+	return m.clearIndex(m.indexKey("sid", issuerScoped(issuer, sid)))
+}
+
+// ClearByUser clears all sessions saved for the user
+func (m *Manager) ClearByUser(user string) error {
+	return m.clearIndex(m.indexKey("user", user))
+}
+
+// ListByUser returns the sessions saved for the user
+func (m *Manager) ListByUser(user string) ([]sessions.SessionInfo, error) {
+	key := m.indexKey("user", user)
+	members, err := m.Store.IndexMembers(key)
+	if err != nil {
+		return nil, fmt.Errorf("error reading session index: %s", err)
+	}
+
+	infos := make([]sessions.SessionInfo, 0, len(members))
+	for handle, value := range members {
+		var info sessions.SessionInfo
+		if err := json.Unmarshal([]byte(value), &info); err != nil {
+			return nil, fmt.Errorf("error decoding session info: %s", err)
+		}
+		// Sessions that expired are still in the index until it expires
+		if !info.ExpiresAt.After(time.Now()) {
+			continue
+		}
+		// So are sessions cleared by their subject or session ID, evicted,
+		// or expired while idle. They are removed from the index as found.
+		_, err := m.Store.Get(handle)
+		if err == sessions.ErrSessionNotFound {
+			if err := m.Store.RemoveFromIndex(key, handle); err != nil {
+				return nil, fmt.Errorf("error clearing session from index: %s", err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading session: %s", err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ClearByID clears the session of the user with the ID
+func (m *Manager) ClearByID(user string, id string) error {
+	// The ID is the hex encoded ticket ID, anything else could name the
+	// key of an index
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return sessions.ErrSessionNotFound
+	}
+	handle := (&TicketData{TicketID: id}).asHandle(m.CookieOptions.CookieName)
+
+	key := m.indexKey("user", user)
+	members, err := m.Store.IndexMembers(key)
+	if err != nil {
+		return fmt.Errorf("error reading session index: %s", err)
+	}
+	if _, ok := members[handle]; !ok {
+		return sessions.ErrSessionNotFound
+	}
+	if err := m.Store.RemoveFromIndex(key, handle); err != nil {
+		return fmt.Errorf("error clearing session from index: %s", err)
+	}
+	if err := m.Store.Del(handle); err != nil {
+		return fmt.Errorf("error clearing session: %s", err)
+	}
+	return nil
+}
+
+// sessionTTL is how long sessions are kept in the Store after they were
+// saved or touched: the idle timeout when there is one. The cookie
+// expiration limits the lifetime of the session either way.
+func (m *Manager) sessionTTL() time.Duration {
+	if idle := m.CookieOptions.CookieIdleTimeout; idle > 0 && idle < m.CookieOptions.CookieExpire {
+		return idle
+	}
+	return m.CookieOptions.CookieExpire
+}
+
+// Lock obtains the lock of the session of the request. Sessions in Stores
+// that are not shared between instances are always locked at once, as the
+// proxy serializes their refreshes within the process. The lock holds a
+// random token, so that it is only released by its holder.
+func (m *Manager) Lock(req *http.Request, expiration time.Duration) (string, error) {
+	rawLock := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rawLock); err != nil {
+		return "", fmt.Errorf("failed to create lock %s", err)
+	}
+	lock := hex.EncodeToString(rawLock)
+
+	locker, ok := m.Store.(Locker)
+	if !ok {
+		return lock, nil
+	}
+	key, err := m.lockKey(req)
+	if err != nil {
+		return "", err
+	}
+	locked, err := locker.SetNX(key, lock, expiration)
+	if err != nil || !locked {
+		return "", err
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock of the session of the request, unless it expired
+// and was obtained by another instance since
+func (m *Manager) Unlock(req *http.Request, lock string) error {
+	locker, ok := m.Store.(Locker)
+	if !ok {
+		return nil
+	}
+	key, err := m.lockKey(req)
+	if err != nil {
+		return err
+	}
+	return locker.DelIfEqual(key, lock)
+}
+
+// lockKey is the key of the lock of the session of the request
+func (m *Manager) lockKey(req *http.Request) (string, error) {
+	requestCookie, err := req.Cookie(m.CookieOptions.CookieName)
+	if err != nil {
+		return "", fmt.Errorf("error loading session: %s", err)
+	}
+	val, _, _, ok := encryption.ValidateAny(requestCookie, m.CookieOptions.CookieSecrets(), m.CookieOptions.CookieExpire)
+	if !ok {
+		return "", fmt.Errorf("Cookie Signature not valid")
+	}
+	ticket, err := decodeTicket(m.CookieOptions.CookieName, val)
+	if err != nil {
+		return "", err
+	}
+	return ticket.asHandle(m.CookieOptions.CookieName) + "-lock", nil
+}
+
+// makeCookie makes a cookie, signing the value if present
+func (m *Manager) makeCookie(req *http.Request, value string, expires time.Duration, now time.Time) *http.Cookie {
+	if value != "" {
+		value = encryption.SignedValue(m.CookieOptions.CookieSecret, m.CookieOptions.CookieName, value, now)
+	}
+	return cookies.MakeCookieFromOptions(
+		req,
+		m.CookieOptions.CookieName,
+		value,
+		m.CookieOptions,
+		expires,
+		now,
+	)
+}
+
+func (m *Manager) storeValue(value string, expiration time.Duration, requestCookie *http.Cookie) (*TicketData, error) {
+	ticket, err := m.getTicket(requestCookie)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ticket: %v", err)
+	}
+
+	// Each entry is encrypted with the secret of its ticket
+	ciphertext, err := ticket.encryptValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := ticket.asHandle(m.CookieOptions.CookieName)
+	err = m.Store.Set(handle, ciphertext, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// indexSession adds the session handle to the index of its user, and to
+// the indexes of its OIDC subject and session ID. Subjects and session IDs
+// are only unique per issuer, so these indexes are scoped by the iss claim
+// of the session. Handles are removed from
+// the index of the user when the session is cleared. Otherwise they go away
+// with the index once no session has refreshed it for the cookie lifetime.
+func (m *Manager) indexSession(ticket *TicketData, s *sessions.SessionState) error {
+	info, err := json.Marshal(sessions.SessionInfo{
+		ID:         ticket.TicketID,
+		CreatedAt:  s.CreatedAt,
+		ExpiresAt:  time.Now().Add(m.CookieOptions.CookieExpire),
+		ProviderID: s.ProviderID,
+	})
+	if err != nil {
+		return err
+	}
+
+	handle := ticket.asHandle(m.CookieOptions.CookieName)
+	var keys []string
+	if user := s.UserKey(); user != "" {
+		keys = append(keys, m.indexKey("user", user))
+	}
+	issuer, _ := s.Claims["iss"].(string)
+	for _, claim := range []string{"sub", "sid"} {
+		if value, ok := s.Claims[claim].(string); ok && value != "" {
+			keys = append(keys, m.indexKey(claim, issuerScoped(issuer, value)))
+		}
+	}
+	for _, key := range keys {
+		err := m.Store.AddToIndex(key, handle, string(info), m.CookieOptions.CookieExpire)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearIndex deletes all sessions in the index, and the index itself
+func (m *Manager) clearIndex(key string) error {
+	members, err := m.Store.IndexMembers(key)
+	if err != nil {
+		return fmt.Errorf("error reading session index: %s", err)
+	}
+	keys := []string{key}
+	for handle := range members {
+		keys = append(keys, handle)
+	}
+	err = m.Store.Del(keys...)
+	if err != nil {
+		return fmt.Errorf("error clearing sessions: %s", err)
+	}
+	return nil
+}
+
+// issuerScoped qualifies a claim value that is only unique per issuer
+func issuerScoped(issuer, value string) string {
+	return issuer + "\x00" + value
+}
+
+// indexKey is the key of the index of sessions with the claim value. The
+// value is hashed to keep user identifiers out of the key space.
+func (m *Manager) indexKey(claim, value string) string {
+	return fmt.Sprintf("%s-%s-%x", m.CookieOptions.CookieName, claim, sha256.Sum256([]byte(value)))
+}
+
+// getTicket retrieves an existing ticket from the cookie if present,
+// or creates a new ticket
+func (m *Manager) getTicket(requestCookie *http.Cookie) (*TicketData, error) {
+	if requestCookie == nil {
+		return newTicket()
+	}
+
+	// An existing cookie exists, try to retrieve the ticket
+	val, _, _, ok := encryption.ValidateAny(requestCookie, m.CookieOptions.CookieSecrets(), m.CookieOptions.CookieExpire)
+	if !ok {
+		// Cookie is invalid, create a new ticket
+		return newTicket()
+	}
+
+	// Valid cookie, decode the ticket
+	ticket, err := decodeTicket(m.CookieOptions.CookieName, val)
+	if err != nil {
+		// If we can't decode the ticket we have to create a new one
+		return newTicket()
+	}
+	return ticket, nil
+}
@@ -0,0 +1,123 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+)
+
+// legacyWarning logs the first decryption of an AES-CFB session, once per
+// process as every request of an older session would log it again
+var legacyWarning sync.Once
+
+// TicketData is a structure representing the ticket used in server session storage
+type TicketData struct {
+	TicketID string
+	Secret   []byte
+}
+
+func newTicket() (*TicketData, error) {
+	rawID := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
+		return nil, fmt.Errorf("failed to create new ticket ID %s", err)
+	}
+	// ticketID is hex encoded
+	ticketID := fmt.Sprintf("%x", rawID)
+
+	secret := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, fmt.Errorf("failed to create initialization vector %s", err)
+	}
+	ticket := &TicketData{
+		TicketID: ticketID,
+		Secret:   secret,
+	}
+	return ticket, nil
+}
+
+func (ticket *TicketData) asHandle(prefix string) string {
+	return fmt.Sprintf("%s-%s", prefix, ticket.TicketID)
+}
+
+func decodeTicket(cookieName string, ticketString string) (*TicketData, error) {
+	prefix := cookieName + "-"
+	if !strings.HasPrefix(ticketString, prefix) {
+		return nil, fmt.Errorf("failed to decode ticket handle")
+	}
+	trimmedTicket := strings.TrimPrefix(ticketString, prefix)
+
+	ticketParts := strings.Split(trimmedTicket, ".")
+	if len(ticketParts) != 2 {
+		return nil, fmt.Errorf("failed to decode ticket")
+	}
+	ticketID, secretBase64 := ticketParts[0], ticketParts[1]
+
+	// ticketID must be a hexadecimal string
+	_, err := hex.DecodeString(ticketID)
+	if err != nil {
+		return nil, fmt.Errorf("server ticket failed sanity checks")
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(secretBase64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode initialization vector %s", err)
+	}
+	ticketData := &TicketData{
+		TicketID: ticketID,
+		Secret:   secret,
+	}
+	return ticketData, nil
+}
+
+func (ticket *TicketData) encodeTicket(prefix string) string {
+	handle := ticket.asHandle(prefix)
+	ticketString := handle + "." + base64.RawURLEncoding.EncodeToString(ticket.Secret)
+	return ticketString
+}
+
+// encryptValue encrypts a session with the ticket secret
+func (ticket *TicketData) encryptValue(value string) (string, error) {
+	c, err := encryption.NewCipher(ticket.Secret)
+	if err != nil {
+		return "", fmt.Errorf("error initiating cipher %s", err)
+	}
+	return c.Encrypt(value, "session")
+}
+
+// decryptValue decrypts a session saved with the ticket secret. Entries
+// encrypted with AES-CFB by older versions are only decrypted with legacy.
+func (ticket *TicketData) decryptValue(value string, legacy bool) (string, error) {
+	if !encryption.IsEncrypted(value) {
+		if !legacy {
+			return "", fmt.Errorf("failed to decrypt session: not encrypted with AES-GCM")
+		}
+		// TODO: After appropriate rollout window, remove support for
+		// entries encrypted with AES-CFB, using the secret as the IV too
+		legacyWarning.Do(func() {
+			logger.Printf("WARNING: decrypting a session encrypted with AES-CFB, which has no integrity protection. This is only logged once.")
+		})
+		block, err := aes.NewCipher(ticket.Secret)
+		if err != nil {
+			return "", err
+		}
+		plaintext := []byte(value)
+		stream := cipher.NewCFBDecrypter(block, ticket.Secret)
+		stream.XORKeyStream(plaintext, plaintext)
+		return string(plaintext), nil
+	}
+
+	c, err := encryption.NewCipher(ticket.Secret)
+	if err != nil {
+		return "", err
+	}
+	return c.Decrypt(value, "session")
+}
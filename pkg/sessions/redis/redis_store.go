@@ -1,305 +1,225 @@
 package redis
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v7"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
-	"github.com/msepp/oauth2_proxy/v4/pkg/cookies"
-	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/persistence"
 )
 
-// TicketData is a structure representing the ticket used in server session storage
-type TicketData struct {
-	TicketID string
-	Secret   []byte
-}
-
 // SessionStore is an implementation of the sessions.SessionStore
 // interface that stores sessions in redis
 type SessionStore struct {
-	CookieCipher  *encryption.Cipher
-	CookieOptions *options.CookieOptions
-	Client        *redis.Client
+	*persistence.Manager
+	Client redis.UniversalClient
+	// KeyPrefix is prepended to the keys of the sessions and indexes
+	KeyPrefix string
 }
 
 // NewRedisSessionStore initialises a new instance of the SessionStore from
-// the configuration given
+// the configuration given, and checks that redis can be reached
 func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
 	client, err := newRedisClient(opts.RedisStoreOptions)
 	if err != nil {
 		return nil, fmt.Errorf("error constructing redis client: %v", err)
 	}
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
 
 	rs := &SessionStore{
-		Client:        client,
-		CookieCipher:  opts.Cipher,
-		CookieOptions: cookieOpts,
+		Client:    client,
+		KeyPrefix: opts.RedisKeyPrefix,
 	}
+	rs.Manager = persistence.NewManager(rs, opts, cookieOpts)
 	return rs, nil
 
 }
 
-func newRedisClient(opts options.RedisStoreOptions) (*redis.Client, error) {
-	if opts.UseSentinel {
-		client := redis.NewFailoverClient(&redis.FailoverOptions{
-			MasterName:    opts.SentinelMasterName,
-			SentinelAddrs: opts.SentinelConnectionURLs,
-		})
-		return client, nil
-	}
-
-	opt, err := redis.ParseURL(opts.RedisConnectionURL)
+func newRedisClient(opts options.RedisStoreOptions) (redis.UniversalClient, error) {
+	tlsConfig, err := requests.NewTLSConfig(requests.TransportOptions{
+		CAFiles:            opts.RedisCAFiles,
+		ClientCertFile:     opts.RedisClientCertFile,
+		ClientKeyFile:      opts.RedisClientKeyFile,
+		InsecureSkipVerify: opts.RedisInsecureSkipTLSVerify,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse redis url: %s", err)
+		return nil, err
 	}
 
-	client := redis.NewClient(opt)
-	return client, nil
-}
-
-// Save takes a sessions.SessionState and stores the information from it
-// to redies, and adds a new ticket cookie on the HTTP response writer
-func (store *SessionStore) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
-	if s.CreatedAt.IsZero() {
-		s.CreatedAt = time.Now()
+	if opts.UseCluster {
+		addrs, useTLS, err := parseRedisURLs(opts.ClusterConnectionURLs)
+		if err != nil {
+			return nil, err
+		}
+		clusterOpts := &redis.ClusterOptions{
+			Addrs:        addrs,
+			Username:     opts.RedisUsername,
+			Password:     opts.RedisPassword,
+			DialTimeout:  opts.RedisDialTimeout,
+			ReadTimeout:  opts.RedisReadTimeout,
+			WriteTimeout: opts.RedisWriteTimeout,
+			PoolSize:     opts.RedisPoolSize,
+			PoolTimeout:  opts.RedisPoolTimeout,
+			IdleTimeout:  opts.RedisIdleTimeout,
+		}
+		if useTLS {
+			clusterOpts.TLSConfig = tlsConfig
+		}
+		return redis.NewClusterClient(clusterOpts), nil
 	}
 
-	// Old sessions that we are refreshing would have a request cookie
-	// New sessions don't, so we ignore the error. storeValue will check requestCookie
-	requestCookie, _ := req.Cookie(store.CookieOptions.CookieName)
-	value, err := s.EncodeSessionState(store.CookieCipher)
-	if err != nil {
-		return err
-	}
-	ticketString, err := store.storeValue(value, store.CookieOptions.CookieExpire, requestCookie)
-	if err != nil {
-		return err
+	if opts.UseSentinel {
+		addrs, useTLS, err := parseRedisURLs(opts.SentinelConnectionURLs)
+		if err != nil {
+			return nil, err
+		}
+		failoverOpts := &redis.FailoverOptions{
+			MasterName:       opts.SentinelMasterName,
+			SentinelAddrs:    addrs,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.RedisUsername,
+			Password:         opts.RedisPassword,
+			DB:               opts.RedisDB,
+			DialTimeout:      opts.RedisDialTimeout,
+			ReadTimeout:      opts.RedisReadTimeout,
+			WriteTimeout:     opts.RedisWriteTimeout,
+			PoolSize:         opts.RedisPoolSize,
+			PoolTimeout:      opts.RedisPoolTimeout,
+			IdleTimeout:      opts.RedisIdleTimeout,
+		}
+		if useTLS {
+			failoverOpts.TLSConfig = tlsConfig
+		}
+		return redis.NewFailoverClient(failoverOpts), nil
 	}
 
-	ticketCookie := store.makeCookie(
-		req,
-		ticketString,
-		store.CookieOptions.CookieExpire,
-		s.CreatedAt,
-	)
-
-	http.SetCookie(rw, ticketCookie)
-	return nil
-}
-
-// Load reads sessions.SessionState information from a ticket
-// cookie within the HTTP request object
-func (store *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
-	requestCookie, err := req.Cookie(store.CookieOptions.CookieName)
+	opt, err := redis.ParseURL(opts.RedisConnectionURL)
 	if err != nil {
-		return nil, fmt.Errorf("error loading session: %s", err)
+		return nil, fmt.Errorf("unable to parse redis url: %s", err)
 	}
-
-	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.CookieSecret, store.CookieOptions.CookieExpire)
-	if !ok {
-		return nil, fmt.Errorf("Cookie Signature not valid")
+	if opts.RedisUsername != "" {
+		opt.Username = opts.RedisUsername
 	}
-	session, err := store.loadSessionFromString(val)
-	if err != nil {
-		return nil, fmt.Errorf("error loading session: %s", err)
+	if opts.RedisPassword != "" {
+		opt.Password = opts.RedisPassword
 	}
-	return session, nil
-}
-
-// loadSessionFromString loads the session based on the ticket value
-func (store *SessionStore) loadSessionFromString(value string) (*sessions.SessionState, error) {
-	ticket, err := decodeTicket(store.CookieOptions.CookieName, value)
-	if err != nil {
-		return nil, err
+	if opts.RedisDB != 0 {
+		opt.DB = opts.RedisDB
 	}
-
-	result, err := store.Client.Get(ticket.asHandle(store.CookieOptions.CookieName)).Result()
-	if err != nil {
-		return nil, err
+	opt.DialTimeout = opts.RedisDialTimeout
+	opt.ReadTimeout = opts.RedisReadTimeout
+	opt.WriteTimeout = opts.RedisWriteTimeout
+	opt.PoolSize = opts.RedisPoolSize
+	opt.PoolTimeout = opts.RedisPoolTimeout
+	opt.IdleTimeout = opts.RedisIdleTimeout
+	if opt.TLSConfig != nil {
+		// ParseURL sets the TLS config for rediss:// URLs
+		tlsConfig.ServerName = opt.TLSConfig.ServerName
+		opt.TLSConfig = tlsConfig
 	}
 
-	resultBytes := []byte(result)
-	block, err := aes.NewCipher(ticket.Secret)
-	if err != nil {
-		return nil, err
-	}
-	// Use secret as the IV too, because each entry has it's own key
-	stream := cipher.NewCFBDecrypter(block, ticket.Secret)
-	stream.XORKeyStream(resultBytes, resultBytes)
-
-	session, err := sessions.DecodeSessionState(string(resultBytes), store.CookieCipher)
-	if err != nil {
-		return nil, err
-	}
-	return session, nil
+	client := redis.NewClient(opt)
+	return client, nil
 }
 
-// Clear clears any saved session information for a given ticket cookie
-// from redis, and then clears the session
-func (store *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
-	// We go ahead and clear the cookie first, always.
-	clearCookie := store.makeCookie(
-		req,
-		"",
-		time.Hour*-1,
-		time.Now(),
-	)
-	http.SetCookie(rw, clearCookie)
-
-	// If there was an existing cookie we should clear the session in redis
-	requestCookie, err := req.Cookie(store.CookieOptions.CookieName)
-	if err != nil && err == http.ErrNoCookie {
-		// No existing cookie so can't clear redis
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("error retrieving cookie: %v", err)
-	}
-
-	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.CookieSecret, store.CookieOptions.CookieExpire)
-	if !ok {
-		return fmt.Errorf("Cookie Signature not valid")
-	}
-
-	// We only return an error if we had an issue with redis
-	// If there's an issue decoding the ticket, ignore it
-	ticket, _ := decodeTicket(store.CookieOptions.CookieName, val)
-	if ticket != nil {
-		_, err := store.Client.Del(ticket.asHandle(store.CookieOptions.CookieName)).Result()
+// parseRedisURLs returns the addresses of the redis URLs, and whether any
+// of them uses TLS. Plain host:port addresses are accepted too.
+func parseRedisURLs(urls []string) ([]string, bool, error) {
+	var addrs []string
+	var useTLS bool
+	for _, u := range urls {
+		if !strings.Contains(u, "://") {
+			addrs = append(addrs, u)
+			continue
+		}
+		parsed, err := url.Parse(u)
 		if err != nil {
-			return fmt.Errorf("error clearing cookie from redis: %s", err)
+			return nil, false, fmt.Errorf("unable to parse redis url: %s", err)
+		}
+		switch parsed.Scheme {
+		case "redis":
+		case "rediss":
+			useTLS = true
+		default:
+			return nil, false, fmt.Errorf("invalid redis url scheme: %s", parsed.Scheme)
 		}
+		addrs = append(addrs, parsed.Host)
 	}
-	return nil
+	return addrs, useTLS, nil
 }
 
-// makeCookie makes a cookie, signing the value if present
-func (store *SessionStore) makeCookie(req *http.Request, value string, expires time.Duration, now time.Time) *http.Cookie {
-	if value != "" {
-		value = encryption.SignedValue(store.CookieOptions.CookieSecret, store.CookieOptions.CookieName, value, now)
-	}
-	return cookies.MakeCookieFromOptions(
-		req,
-		store.CookieOptions.CookieName,
-		value,
-		store.CookieOptions,
-		expires,
-		now,
-	)
+// Set stores the value in redis via SETEX
+func (store *SessionStore) Set(key string, value string, expiration time.Duration) error {
+	return store.Client.Set(store.KeyPrefix+key, value, expiration).Err()
 }
 
-func (store *SessionStore) storeValue(value string, expiration time.Duration, requestCookie *http.Cookie) (string, error) {
-	ticket, err := store.getTicket(requestCookie)
-	if err != nil {
-		return "", fmt.Errorf("error getting ticket: %v", err)
-	}
-
-	ciphertext := make([]byte, len(value))
-	block, err := aes.NewCipher(ticket.Secret)
-	if err != nil {
-		return "", fmt.Errorf("error initiating cipher block %s", err)
-	}
-
-	// Use secret as the Initialization Vector too, because each entry has it's own key
-	stream := cipher.NewCFBEncrypter(block, ticket.Secret)
-	stream.XORKeyStream(ciphertext, []byte(value))
-
-	handle := ticket.asHandle(store.CookieOptions.CookieName)
-	err = store.Client.Set(handle, ciphertext, expiration).Err()
-	if err != nil {
-		return "", err
-	}
-	return ticket.encodeTicket(store.CookieOptions.CookieName), nil
+// SetNX stores the value in redis via SET NX
+func (store *SessionStore) SetNX(key string, value string, expiration time.Duration) (bool, error) {
+	return store.Client.SetNX(store.KeyPrefix+key, value, expiration).Result()
 }
 
-// getTicket retrieves an existing ticket from the cookie if present,
-// or creates a new ticket
-func (store *SessionStore) getTicket(requestCookie *http.Cookie) (*TicketData, error) {
-	if requestCookie == nil {
-		return newTicket()
-	}
-
-	// An existing cookie exists, try to retrieve the ticket
-	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.CookieSecret, store.CookieOptions.CookieExpire)
-	if !ok {
-		// Cookie is invalid, create a new ticket
-		return newTicket()
-	}
-
-	// Valid cookie, decode the ticket
-	ticket, err := decodeTicket(store.CookieOptions.CookieName, val)
-	if err != nil {
-		// If we can't decode the ticket we have to create a new one
-		return newTicket()
-	}
-	return ticket, nil
+// delIfEqualScript deletes the key if it holds the value
+var delIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DelIfEqual deletes the key from redis if it holds the value, with a script
+// to compare and delete atomically
+func (store *SessionStore) DelIfEqual(key string, value string) error {
+	return delIfEqualScript.Run(store.Client, []string{store.KeyPrefix + key}, value).Err()
 }
 
-func newTicket() (*TicketData, error) {
-	rawID := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
-		return nil, fmt.Errorf("failed to create new ticket ID %s", err)
-	}
-	// ticketID is hex encoded
-	ticketID := fmt.Sprintf("%x", rawID)
-
-	secret := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
-		return nil, fmt.Errorf("failed to create initialization vector %s", err)
+// Get returns the value of the key from redis
+func (store *SessionStore) Get(key string) (string, error) {
+	value, err := store.Client.Get(store.KeyPrefix + key).Result()
+	if err == redis.Nil {
+		return "", sessions.ErrSessionNotFound
 	}
-	ticket := &TicketData{
-		TicketID: ticketID,
-		Secret:   secret,
-	}
-	return ticket, nil
+	return value, err
 }
 
-func (ticket *TicketData) asHandle(prefix string) string {
-	return fmt.Sprintf("%s-%s", prefix, ticket.TicketID)
+// Expire sets the TTL of the key in redis
+func (store *SessionStore) Expire(key string, expiration time.Duration) error {
+	return store.Client.Expire(store.KeyPrefix+key, expiration).Err()
 }
 
-func decodeTicket(cookieName string, ticketString string) (*TicketData, error) {
-	prefix := cookieName + "-"
-	if !strings.HasPrefix(ticketString, prefix) {
-		return nil, fmt.Errorf("failed to decode ticket handle")
-	}
-	trimmedTicket := strings.TrimPrefix(ticketString, prefix)
-
-	ticketParts := strings.Split(trimmedTicket, ".")
-	if len(ticketParts) != 2 {
-		return nil, fmt.Errorf("failed to decode ticket")
+// Del deletes the keys from redis. The keys are deleted one by one, as
+// they may belong to different slots in cluster mode.
+func (store *SessionStore) Del(keys ...string) error {
+	pipe := store.Client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(store.KeyPrefix + key)
 	}
-	ticketID, secretBase64 := ticketParts[0], ticketParts[1]
+	_, err := pipe.Exec()
+	return err
+}
 
-	// ticketID must be a hexadecimal string
-	_, err := hex.DecodeString(ticketID)
-	if err != nil {
-		return nil, fmt.Errorf("server ticket failed sanity checks")
-	}
+// AddToIndex sets the member of the redis hash of the key
+func (store *SessionStore) AddToIndex(key string, member string, value string, expiration time.Duration) error {
+	pipe := store.Client.TxPipeline()
+	pipe.HSet(store.KeyPrefix+key, member, value)
+	pipe.Expire(store.KeyPrefix+key, expiration)
+	_, err := pipe.Exec()
+	return err
+}
 
-	secret, err := base64.RawURLEncoding.DecodeString(secretBase64)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode initialization vector %s", err)
-	}
-	ticketData := &TicketData{
-		TicketID: ticketID,
-		Secret:   secret,
-	}
-	return ticketData, nil
+// RemoveFromIndex removes the member from the redis hash of the key
+func (store *SessionStore) RemoveFromIndex(key string, member string) error {
+	return store.Client.HDel(store.KeyPrefix+key, member).Err()
 }
 
-func (ticket *TicketData) encodeTicket(prefix string) string {
-	handle := ticket.asHandle(prefix)
-	ticketString := handle + "." + base64.RawURLEncoding.EncodeToString(ticket.Secret)
-	return ticketString
+// IndexMembers returns the members of the redis hash of the key
+func (store *SessionStore) IndexMembers(key string) (map[string]string, error) {
+	return store.Client.HGetAll(store.KeyPrefix + key).Result()
 }
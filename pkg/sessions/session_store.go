@@ -6,6 +6,8 @@ import (
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/options"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/cookie"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/file"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/memory"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/redis"
 )
 
@@ -16,6 +18,10 @@ func NewSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOpt
 		return cookie.NewCookieSessionStore(opts, cookieOpts)
 	case options.RedisSessionStoreType:
 		return redis.NewRedisSessionStore(opts, cookieOpts)
+	case options.MemorySessionStoreType:
+		return memory.NewMemorySessionStore(opts, cookieOpts)
+	case options.FileSessionStoreType:
+		return file.NewFileSessionStore(opts, cookieOpts)
 	default:
 		return nil, fmt.Errorf("unknown session store type '%s'", opts.Type)
 	}
@@ -1,10 +1,15 @@
 package sessions_test
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -17,6 +22,9 @@ import (
 	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions"
 	sessionscookie "github.com/msepp/oauth2_proxy/v4/pkg/sessions/cookie"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/file"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/memory"
+	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/persistence"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/redis"
 	"github.com/msepp/oauth2_proxy/v4/pkg/sessions/utils"
 	. "github.com/onsi/ginkgo"
@@ -135,6 +143,223 @@ var _ = Describe("NewSessionStore", func() {
 
 			CheckCookieOptions()
 		})
+
+		Context("when a session is locked", func() {
+			var store sessionsapi.LockingSessionStore
+			var lock string
+
+			BeforeEach(func() {
+				var ok bool
+				store, ok = ss.(sessionsapi.LockingSessionStore)
+				Expect(ok).To(BeTrue())
+
+				Expect(ss.Save(response, request, session)).To(Succeed())
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+				var err error
+				lock, err = store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(lock).ToNot(BeEmpty())
+			})
+
+			It("can be locked again once unlocked", func() {
+				Expect(store.Unlock(request, lock)).To(Succeed())
+				lock, err := store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(lock).ToNot(BeEmpty())
+			})
+
+			It("can't be locked again by another instance when the store is shared", func() {
+				lock, err := store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				// Only redis is shared between instances, the other stores
+				// leave locking to the proxy
+				_, shared := ss.(*redis.SessionStore)
+				Expect(lock == "").To(Equal(shared))
+			})
+
+			It("is unlocked when the lock expires", func() {
+				if _, ok := ss.(*redis.SessionStore); !ok {
+					Skip("only redis locks sessions")
+				}
+				mr.FastForward(time.Minute + time.Second)
+				lock, err := store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(lock).ToNot(BeEmpty())
+			})
+
+			It("isn't unlocked with an expired lock obtained by another since", func() {
+				if _, ok := ss.(*redis.SessionStore); !ok {
+					Skip("only redis locks sessions")
+				}
+				mr.FastForward(time.Minute + time.Second)
+				other, err := store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(other).ToNot(BeEmpty())
+
+				Expect(store.Unlock(request, lock)).To(Succeed())
+				locked, err := store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(locked).To(BeEmpty())
+
+				Expect(store.Unlock(request, other)).To(Succeed())
+				locked, err = store.Lock(request, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(locked).ToNot(BeEmpty())
+			})
+		})
+
+		Context("when sessions are revoked", func() {
+			var first, second, other *http.Request
+			const issuer = "https://issuer.example.com"
+
+			saveWithIssuer := func(iss, sub, sid string) *http.Request {
+				s := *session
+				s.Claims = map[string]interface{}{"iss": iss, "sub": sub, "sid": sid}
+				saveResp := httptest.NewRecorder()
+				err := ss.Save(saveResp, httptest.NewRequest("GET", "http://example.com/", nil), &s)
+				Expect(err).ToNot(HaveOccurred())
+
+				loadReq := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, c := range saveResp.Result().Cookies() {
+					loadReq.AddCookie(c)
+				}
+				return loadReq
+			}
+			saveWithClaims := func(sub, sid string) *http.Request {
+				return saveWithIssuer(issuer, sub, sid)
+			}
+
+			BeforeEach(func() {
+				first = saveWithClaims("subject", "sid-1")
+				second = saveWithClaims("subject", "sid-2")
+				other = saveWithClaims("other", "sid-3")
+			})
+
+			It("implements RevocableSessionStore", func() {
+				_, ok := ss.(sessionsapi.RevocableSessionStore)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("clears only the session with the session ID", func() {
+				err := ss.(sessionsapi.RevocableSessionStore).ClearBySessionID(issuer, "sid-1")
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ss.Load(first)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(second)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = ss.Load(other)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("lists the sessions of the user", func() {
+				infos, err := ss.(sessionsapi.ManageableSessionStore).ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(HaveLen(3))
+				for _, info := range infos {
+					Expect(info.ID).To(MatchRegexp("^[0-9a-f]{32}$"))
+					Expect(info.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+					Expect(info.ExpiresAt).To(BeTemporally("~", time.Now().Add(cookieOpts.CookieExpire), time.Minute))
+				}
+
+				infos, err = ss.(sessionsapi.ManageableSessionStore).ListByUser("jane.doe@example.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(BeEmpty())
+			})
+
+			It("doesn't list the sessions cleared by their subject or session ID", func() {
+				store := ss.(sessionsapi.RevocableSessionStore)
+				Expect(store.ClearBySessionID(issuer, "sid-3")).To(Succeed())
+				infos, err := ss.(sessionsapi.ManageableSessionStore).ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(HaveLen(2))
+
+				Expect(store.ClearBySubject(issuer, "subject")).To(Succeed())
+				infos, err = ss.(sessionsapi.ManageableSessionStore).ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(BeEmpty())
+			})
+
+			It("clears a session of the user by its ID", func() {
+				store := ss.(sessionsapi.ManageableSessionStore)
+				infos, err := store.ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(HaveLen(3))
+
+				Expect(store.ClearByID("jane.doe@example.com", infos[0].ID)).To(Equal(sessionsapi.ErrSessionNotFound))
+				Expect(store.ClearByID(session.Email, "sub")).To(Equal(sessionsapi.ErrSessionNotFound))
+				Expect(store.ClearByID(session.Email, infos[0].ID)).To(Succeed())
+
+				remaining, err := store.ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(remaining).To(HaveLen(2))
+				loaded := 0
+				for _, req := range []*http.Request{first, second, other} {
+					if _, err := ss.Load(req); err == nil {
+						loaded++
+					}
+				}
+				Expect(loaded).To(Equal(2))
+			})
+
+			It("clears all sessions of the user", func() {
+				s := *session
+				s.Email = "jane.doe@example.com"
+				otherUserResp := httptest.NewRecorder()
+				Expect(ss.Save(otherUserResp, httptest.NewRequest("GET", "http://example.com/", nil), &s)).To(Succeed())
+				otherUser := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, c := range otherUserResp.Result().Cookies() {
+					otherUser.AddCookie(c)
+				}
+
+				By("clearing one of the sessions first")
+				Expect(ss.Clear(httptest.NewRecorder(), second)).To(Succeed())
+
+				err := ss.(sessionsapi.RevocableSessionStore).ClearByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, req := range []*http.Request{first, second, other} {
+					_, err = ss.Load(req)
+					Expect(err).To(HaveOccurred())
+				}
+				_, err = ss.Load(otherUser)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("clears all sessions of the subject", func() {
+				err := ss.(sessionsapi.RevocableSessionStore).ClearBySubject(issuer, "subject")
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ss.Load(first)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(second)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(other)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("only clears the sessions of the issuer", func() {
+				otherIssuer := saveWithIssuer("https://other.example.com", "subject", "sid-1")
+				store := ss.(sessionsapi.RevocableSessionStore)
+				Expect(store.ClearBySubject("https://other.example.com", "subject")).To(Succeed())
+
+				_, err := ss.Load(otherIssuer)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(first)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = ss.Load(second)
+				Expect(err).ToNot(HaveOccurred())
+
+				otherIssuer = saveWithIssuer("https://other.example.com", "subject", "sid-1")
+				Expect(store.ClearBySessionID(issuer, "sid-1")).To(Succeed())
+				_, err = ss.Load(first)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(otherIssuer)
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
 	}
 
 	SessionStoreInterfaceTests := func(persistent bool) {
@@ -278,9 +503,13 @@ var _ = Describe("NewSessionStore", func() {
 			if persistent {
 				Context("after the refresh period, but before the cookie expire period", func() {
 					BeforeEach(func() {
-						switch ss.(type) {
+						switch store := ss.(type) {
 						case *redis.SessionStore:
 							mr.FastForward(cookieOpts.CookieRefresh + time.Minute)
+						case *memory.SessionStore:
+							store.Now = func() time.Time { return time.Now().Add(cookieOpts.CookieRefresh + time.Minute) }
+						case *file.SessionStore:
+							store.Now = func() time.Time { return time.Now().Add(cookieOpts.CookieRefresh + time.Minute) }
 						}
 					})
 
@@ -292,9 +521,13 @@ var _ = Describe("NewSessionStore", func() {
 					var err error
 
 					BeforeEach(func() {
-						switch ss.(type) {
+						switch store := ss.(type) {
 						case *redis.SessionStore:
 							mr.FastForward(cookieOpts.CookieExpire + time.Minute)
+						case *memory.SessionStore:
+							store.Now = func() time.Time { return time.Now().Add(cookieOpts.CookieExpire + time.Minute) }
+						case *file.SessionStore:
+							store.Now = func() time.Time { return time.Now().Add(cookieOpts.CookieExpire + time.Minute) }
 						}
 
 						loadedSession, err = ss.Load(request)
@@ -365,6 +598,128 @@ var _ = Describe("NewSessionStore", func() {
 
 			SessionStoreInterfaceTests(persistent)
 		})
+
+		Context("with a rotated cookie secret", func() {
+			var loadedSession *sessionsapi.SessionState
+
+			BeforeEach(func() {
+				newCipher := func(secret string) *encryption.Cipher {
+					cipher, err := encryption.NewCipher(utils.SecretBytes(secret))
+					Expect(err).ToNot(HaveOccurred())
+					return cipher
+				}
+				oldSecret := "0123456789abcdefghijklmnopqrstuv"
+				newSecret := "vutsrqponmlkjihgfedcba9876543210"
+
+				// Save with the old secret
+				cookieOpts.CookieSecret = oldSecret
+				opts.Cipher = newCipher(oldSecret)
+				oldStore, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(oldStore.Save(response, request, session)).To(Succeed())
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+
+				// Load with the new secret, the old one being a previous secret
+				rotatedCookieOpts := *cookieOpts
+				rotatedCookieOpts.CookieSecret = newSecret
+				rotatedCookieOpts.PreviousCookieSecrets = []string{oldSecret}
+				rotatedOpts := *opts
+				rotatedOpts.Cipher = newCipher(newSecret)
+				rotatedOpts.PreviousCiphers = []*encryption.Cipher{opts.Cipher}
+				switch store := oldStore.(type) {
+				case *memory.SessionStore:
+					// Sessions in memory are only seen by the store that saved them
+					store.Manager = persistence.NewManager(store, &rotatedOpts, &rotatedCookieOpts)
+					ss = store
+				case *file.SessionStore:
+					// The database can't be opened by a second store
+					store.Manager = persistence.NewManager(store, &rotatedOpts, &rotatedCookieOpts)
+					ss = store
+				default:
+					ss, err = sessions.NewSessionStore(&rotatedOpts, &rotatedCookieOpts)
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				loadedSession, err = ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("loads the session saved with the previous secret", func() {
+				Expect(loadedSession.Email).To(Equal(session.Email))
+				Expect(loadedSession.AccessToken).To(Equal(session.AccessToken))
+				Expect(loadedSession.RefreshToken).To(Equal(session.RefreshToken))
+			})
+
+			It("marks the session for saving with the current secret", func() {
+				Expect(loadedSession.Rotated).To(BeTrue())
+
+				resaved := httptest.NewRecorder()
+				Expect(ss.Save(resaved, request, loadedSession)).To(Succeed())
+				reloadRequest := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, cookie := range resaved.Result().Cookies() {
+					reloadRequest.AddCookie(cookie)
+				}
+				reloadedSession, err := ss.Load(reloadRequest)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reloadedSession.Rotated).To(BeFalse())
+				Expect(reloadedSession.AccessToken).To(Equal(session.AccessToken))
+			})
+		})
+
+		if persistent {
+			Context("with an idle timeout", func() {
+				var offset time.Duration
+				fastForward := func(d time.Duration) {
+					offset += d
+					now := offset
+					switch store := ss.(type) {
+					case *redis.SessionStore:
+						mr.FastForward(d)
+					case *memory.SessionStore:
+						store.Now = func() time.Time { return time.Now().Add(now) }
+					case *file.SessionStore:
+						store.Now = func() time.Time { return time.Now().Add(now) }
+					}
+				}
+
+				BeforeEach(func() {
+					offset = 0
+					cookieOpts.CookieIdleTimeout = 30 * time.Minute
+
+					var err error
+					ss, err = sessions.NewSessionStore(opts, cookieOpts)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(ss.Save(response, request, session)).To(Succeed())
+					for _, cookie := range response.Result().Cookies() {
+						request.AddCookie(cookie)
+					}
+				})
+
+				It("expires the session once idle for the idle timeout", func() {
+					fastForward(31 * time.Minute)
+					_, err := ss.Load(request)
+					Expect(err).To(HaveOccurred())
+
+					infos, err := ss.(sessionsapi.ManageableSessionStore).ListByUser(session.Email)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(infos).To(BeEmpty())
+				})
+
+				It("keeps the session while it is loaded within the idle timeout", func() {
+					if _, ok := ss.(persistence.Toucher); !ok {
+						Skip("the store is only touched by saving the session again")
+					}
+					for i := 0; i < 3; i++ {
+						fastForward(20 * time.Minute)
+						loadedSession, err := ss.Load(request)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(loadedSession.IdleTime()).To(BeNumerically("<", time.Minute))
+					}
+				})
+			})
+		}
 	}
 
 	BeforeEach(func() {
@@ -432,6 +787,308 @@ var _ = Describe("NewSessionStore", func() {
 		Context("the redis.SessionStore", func() {
 			RunSessionTests(true)
 		})
+
+		Context("with a key prefix", func() {
+			BeforeEach(func() {
+				opts.RedisKeyPrefix = "prefix:"
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				s := *session
+				s.Claims = map[string]interface{}{"iss": "https://issuer.example.com", "sub": "subject"}
+				Expect(ss.Save(response, request, &s)).To(Succeed())
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+			})
+
+			It("prefixes the keys of the sessions and indexes", func() {
+				keys := mr.Keys()
+				Expect(keys).To(HaveLen(3))
+				for _, key := range keys {
+					Expect(key).To(HavePrefix("prefix:" + cookieOpts.CookieName + "-"))
+				}
+			})
+
+			It("loads and revokes the session", func() {
+				_, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(ss.(sessionsapi.RevocableSessionStore).ClearBySubject("https://issuer.example.com", "subject")).To(Succeed())
+				_, err = ss.Load(request)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when redis can't be reached", func() {
+			BeforeEach(func() {
+				mr.Close()
+			})
+
+			It("returns an error", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(HavePrefix("error connecting to redis: "))
+				Expect(ss).To(BeNil())
+			})
+		})
+
+		Context("with a missing CA file", func() {
+			BeforeEach(func() {
+				opts.RedisCAFiles = []string{"/does/not/exist"}
+			})
+
+			It("returns an error", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).To(HaveOccurred())
+				Expect(ss).To(BeNil())
+			})
+		})
+
+		Context("with sentinel connection URLs", func() {
+			BeforeEach(func() {
+				opts.UseSentinel = true
+				opts.SentinelMasterName = "master"
+			})
+
+			It("rejects URLs with another scheme", func() {
+				opts.SentinelConnectionURLs = []string{"http://" + mr.Addr()}
+				_, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).To(MatchError("error constructing redis client: invalid redis url scheme: http"))
+			})
+		})
+
+		Context("with a tampered session entry", func() {
+			var ss sessionsapi.SessionStore
+
+			BeforeEach(func() {
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ss.Save(response, request, session)).To(Succeed())
+
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+
+				// The session is saved next to the index of its user
+				keys := mr.Keys()
+				Expect(keys).To(HaveLen(2))
+				key := keys[0]
+				if strings.Contains(key, "-user-") {
+					key = keys[1]
+				}
+				value, err := mr.Get(key)
+				Expect(err).ToNot(HaveOccurred())
+				tampered := []byte(value)
+				tampered[len(tampered)-1] ^= 'A' ^ 'B'
+				Expect(mr.Set(key, string(tampered))).To(Succeed())
+			})
+
+			It("returns an error loading the session", func() {
+				loadedSession, err := ss.Load(request)
+				Expect(err).To(HaveOccurred())
+				Expect(loadedSession).To(BeNil())
+			})
+		})
+		Context("with a session entry encrypted with AES-CFB", func() {
+			BeforeEach(func() {
+				session = &sessionsapi.SessionState{Email: "john.doe@example.com", User: "john.doe"}
+			})
+
+			// saveLegacy saves the session as older versions did, encrypted
+			// with AES-CFB under the ticket secret
+			saveLegacy := func() sessionsapi.SessionStore {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ss.Save(response, request, session)).To(Succeed())
+				cookies := response.Result().Cookies()
+				Expect(cookies).To(HaveLen(1))
+				request.AddCookie(cookies[0])
+
+				value, err := base64.URLEncoding.DecodeString(strings.Split(cookies[0].Value, "|")[0])
+				Expect(err).ToNot(HaveOccurred())
+				ticket := strings.SplitN(string(value), ".", 2)
+				secret, err := base64.RawURLEncoding.DecodeString(ticket[1])
+				Expect(err).ToNot(HaveOccurred())
+
+				plaintext, err := session.EncodeSessionState(nil)
+				Expect(err).ToNot(HaveOccurred())
+				block, err := aes.NewCipher(secret)
+				Expect(err).ToNot(HaveOccurred())
+				ciphertext := []byte(plaintext)
+				cipher.NewCFBEncrypter(block, secret).XORKeyStream(ciphertext, ciphertext)
+				Expect(mr.Set(ticket[0], string(ciphertext))).To(Succeed())
+				return ss
+			}
+
+			It("loads the session with legacy decryption", func() {
+				opts.LegacyDecryption = true
+				ss := saveLegacy()
+				loadedSession, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loadedSession.Email).To(Equal(session.Email))
+			})
+
+			It("returns an error loading the session without legacy decryption", func() {
+				ss := saveLegacy()
+				loadedSession, err := ss.Load(request)
+				Expect(err).To(MatchError("error loading session: failed to decrypt session: not encrypted with AES-GCM"))
+				Expect(loadedSession).To(BeNil())
+			})
+		})
+	})
+
+	Context("with type 'memory'", func() {
+		BeforeEach(func() {
+			opts.Type = options.MemorySessionStoreType
+			opts.MemoryMaxSessions = 100
+			opts.MemoryCleanupInterval = time.Minute
+		})
+
+		AfterEach(func() {
+			if store, ok := ss.(*memory.SessionStore); ok {
+				Expect(store.Close()).To(Succeed())
+			}
+		})
+
+		It("creates a memory.SessionStore", func() {
+			var err error
+			ss, err = sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ss).To(BeAssignableToTypeOf(&memory.SessionStore{}))
+		})
+
+		It("can be closed more than once", func() {
+			var err error
+			ss, err = sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ss.(*memory.SessionStore).Close()).To(Succeed())
+			Expect(ss.(*memory.SessionStore).Close()).To(Succeed())
+		})
+
+		Context("the memory.SessionStore", func() {
+			RunSessionTests(true)
+		})
+
+		Context("when more sessions than memory-max-sessions are saved", func() {
+			var requests []*http.Request
+
+			BeforeEach(func() {
+				opts.MemoryMaxSessions = 2
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				requests = nil
+				for i := 0; i < 3; i++ {
+					if i == 2 {
+						By("using the first session, so the second is the least recently used")
+						_, err := ss.Load(requests[0])
+						Expect(err).ToNot(HaveOccurred())
+					}
+
+					saveResp := httptest.NewRecorder()
+					Expect(ss.Save(saveResp, httptest.NewRequest("GET", "http://example.com/", nil), session)).To(Succeed())
+					req := httptest.NewRequest("GET", "http://example.com/", nil)
+					for _, c := range saveResp.Result().Cookies() {
+						req.AddCookie(c)
+					}
+					requests = append(requests, req)
+				}
+			})
+
+			It("evicts the least recently used session", func() {
+				_, err := ss.Load(requests[0])
+				Expect(err).ToNot(HaveOccurred())
+				_, err = ss.Load(requests[1])
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(requests[2])
+				Expect(err).ToNot(HaveOccurred())
+
+				infos, err := ss.(sessionsapi.ManageableSessionStore).ListByUser(session.Email)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(infos).To(HaveLen(2))
+			})
+		})
+
+		Context("with memory-max-sessions unset", func() {
+			BeforeEach(func() {
+				opts.MemoryMaxSessions = 0
+			})
+
+			It("returns an error", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).To(HaveOccurred())
+				Expect(ss).To(BeNil())
+			})
+		})
+	})
+
+	Context("with type 'file'", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "sessions")
+			Expect(err).ToNot(HaveOccurred())
+			opts.Type = options.FileSessionStoreType
+			opts.FileStorePath = filepath.Join(dir, "sessions.db")
+			opts.FileStoreCompactionInterval = time.Hour
+		})
+
+		AfterEach(func() {
+			if store, ok := ss.(*file.SessionStore); ok {
+				store.Close()
+			}
+			os.RemoveAll(dir)
+		})
+
+		It("creates a file.SessionStore", func() {
+			var err error
+			ss, err = sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ss).To(BeAssignableToTypeOf(&file.SessionStore{}))
+		})
+
+		Context("the file.SessionStore", func() {
+			RunSessionTests(true)
+		})
+
+		Context("when the store is reopened", func() {
+			BeforeEach(func() {
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ss.Save(response, request, session)).To(Succeed())
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+				Expect(ss.(*file.SessionStore).Close()).To(Succeed())
+
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("loads the sessions saved before", func() {
+				loadedSession, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loadedSession.Email).To(Equal(session.Email))
+			})
+		})
+
+		Context("with file-store-path unset", func() {
+			BeforeEach(func() {
+				opts.FileStorePath = ""
+			})
+
+			It("returns an error", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).To(HaveOccurred())
+				Expect(ss).To(BeNil())
+			})
+		})
 	})
 
 	Context("with an invalid type", func() {
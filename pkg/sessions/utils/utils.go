@@ -17,6 +17,15 @@ func SessionFromCookie(v string, c *encryption.Cipher) (s *sessions.SessionState
 	return sessions.DecodeSessionState(v, c)
 }
 
+// CipherForSecret returns the cipher of the cookie secret with index i in
+// CookieOptions.CookieSecrets, given the current and the previous ciphers
+func CipherForSecret(c *encryption.Cipher, previous []*encryption.Cipher, i int) *encryption.Cipher {
+	if i > 0 && i <= len(previous) {
+		return previous[i-1]
+	}
+	return c
+}
+
 // SecretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
 func SecretBytes(secret string) []byte {
 	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+	"github.com/msepp/oauth2_proxy/v4/providers"
+)
+
+// ProviderOptions configures one of several providers users can choose from
+// on the sign in page. They are set with [[providers]] tables in the config
+// file and replace the provider configured by the top level options. Only
+// approval_prompt, email_domains and the SAML attributes fall back to the top
+// level options, the OIDC claim settings are shared by all providers.
+type ProviderOptions struct {
+	ID           string `toml:"id"`
+	Name         string `toml:"name"`
+	Provider     string `toml:"provider"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+
+	LoginURL          string `toml:"login_url"`
+	RedeemURL         string `toml:"redeem_url"`
+	ProfileURL        string `toml:"profile_url"`
+	ValidateURL       string `toml:"validate_url"`
+	Scope             string `toml:"scope"`
+	ApprovalPrompt    string `toml:"approval_prompt"`
+	OIDCIssuerURL     string `toml:"oidc_issuer_url"`
+	SkipOIDCDiscovery bool   `toml:"skip_oidc_discovery"`
+	OIDCJwksURL       string `toml:"oidc_jwks_url"`
+	OIDCEndSessionURL string `toml:"oidc_end_session_url"`
+
+	SAMLIDPMetadata     string `toml:"saml_idp_metadata"`
+	SAMLEntityID        string `toml:"saml_entity_id"`
+	SAMLEmailAttribute  string `toml:"saml_email_attribute"`
+	SAMLGroupsAttribute string `toml:"saml_groups_attribute"`
+
+	EmailDomains             []string `toml:"email_domains"`
+	AllowedGroups            []string `toml:"allowed_groups"`
+	AllowedRoles             []string `toml:"allowed_roles"`
+	AzureTenant              string   `toml:"azure_tenant"`
+	BitbucketTeam            string   `toml:"bitbucket_team"`
+	BitbucketRepository      string   `toml:"bitbucket_repository"`
+	GitHubOrg                string   `toml:"github_org"`
+	GitHubTeam               string   `toml:"github_team"`
+	GitLabGroup              string   `toml:"gitlab_group"`
+	GoogleGroups             []string `toml:"google_group"`
+	GoogleAdminEmail         string   `toml:"google_admin_email"`
+	GoogleServiceAccountJSON string   `toml:"google_service_account_json"`
+}
+
+// signInProvider is one of the providers offered on the sign in page
+type signInProvider struct {
+	ID           string
+	Name         string
+	provider     providers.Provider
+	emailDomains []string
+	validator    func(string) bool
+}
+
+// providerIDRegex restricts provider IDs to characters that are safe in the
+// start URL and in the CSRF cookie
+var providerIDRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// loadProviderOptions reads the [[providers]] tables of the config file
+func loadProviderOptions(path string) ([]ProviderOptions, error) {
+	var cfg struct {
+		Providers []ProviderOptions `toml:"providers"`
+	}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Providers, nil
+}
+
+// options returns a copy of the top level options with the provider's
+// settings applied, to build the provider from
+func (po ProviderOptions) options(o *Options) *Options {
+	c := *o
+	c.Providers = nil
+	c.oidcVerifier = nil
+	c.logoutVerifiers = nil
+	c.jwtBearerVerifiers = nil
+
+	c.Provider = po.Provider
+	c.ClientID = po.ClientID
+	c.ClientSecret = po.ClientSecret
+	c.LoginURL = po.LoginURL
+	c.RedeemURL = po.RedeemURL
+	c.ProfileURL = po.ProfileURL
+	c.ValidateURL = po.ValidateURL
+	c.Scope = po.Scope
+	c.OIDCIssuerURL = po.OIDCIssuerURL
+	c.SkipOIDCDiscovery = po.SkipOIDCDiscovery
+	c.OIDCJwksURL = po.OIDCJwksURL
+	c.OIDCEndSessionURL = po.OIDCEndSessionURL
+	c.AllowedGroups = po.AllowedGroups
+	c.AllowedRoles = po.AllowedRoles
+	c.AzureTenant = po.AzureTenant
+	c.BitbucketTeam = po.BitbucketTeam
+	c.BitbucketRepository = po.BitbucketRepository
+	c.GitHubOrg = po.GitHubOrg
+	c.GitHubTeam = po.GitHubTeam
+	c.GitLabGroup = po.GitLabGroup
+	c.GoogleGroups = po.GoogleGroups
+	c.GoogleAdminEmail = po.GoogleAdminEmail
+	c.GoogleServiceAccountJSON = po.GoogleServiceAccountJSON
+	c.SAMLIDPMetadata = po.SAMLIDPMetadata
+	c.SAMLEntityID = po.SAMLEntityID
+	if po.SAMLEmailAttribute != "" {
+		c.SAMLEmailAttribute = po.SAMLEmailAttribute
+	}
+	if po.SAMLGroupsAttribute != "" {
+		c.SAMLGroupsAttribute = po.SAMLGroupsAttribute
+	}
+	if po.ApprovalPrompt != "" {
+		c.ApprovalPrompt = po.ApprovalPrompt
+	}
+	return &c
+}
+
+// parseProviders builds the providers configured with [[providers]]. The
+// first one is the default provider, used when none is selected.
+func parseProviders(o *Options, msgs []string) ([]string, error) {
+	o.signInProviders = nil
+	seen := make(map[string]bool)
+	for _, po := range o.Providers {
+		var providerMsgs []string
+		switch {
+		case po.ID == "":
+			msgs = append(msgs, "missing setting: providers.id")
+			continue
+		case !providerIDRegex.MatchString(po.ID):
+			msgs = append(msgs, fmt.Sprintf("invalid provider id %q: only letters, digits, '.', '_' and '-' are allowed", po.ID))
+			continue
+		case seen[po.ID]:
+			msgs = append(msgs, fmt.Sprintf("duplicate provider id %q", po.ID))
+			continue
+		}
+		seen[po.ID] = true
+
+		c := po.options(o)
+		if c.Provider == "" {
+			providerMsgs = append(providerMsgs, "missing setting: provider")
+		}
+		if c.ClientID == "" && c.Provider != "saml" {
+			providerMsgs = append(providerMsgs, "missing setting: client_id")
+		}
+		if c.ClientSecret == "" && c.Provider != "login.gov" && c.Provider != "saml" {
+			providerMsgs = append(providerMsgs, "missing setting: client_secret")
+		}
+		if (len(c.AllowedGroups) > 0 || len(c.AllowedRoles) > 0) && c.Provider != "oidc" {
+			providerMsgs = append(providerMsgs, "allowed_groups and allowed_roles are only supported by the oidc provider")
+		}
+		providerMsgs = validateGoogleGroups(c, providerMsgs)
+
+		var err error
+		providerMsgs, err = parseOIDCIssuer(c, providerMsgs)
+		if err != nil {
+			return msgs, fmt.Errorf("provider %q: %v", po.ID, err)
+		}
+		providerMsgs = parseProviderInfo(c, providerMsgs)
+		for _, msg := range providerMsgs {
+			msgs = append(msgs, fmt.Sprintf("provider %q: %s", po.ID, msg))
+		}
+
+		if c.oidcVerifier != nil && o.SkipJwtBearerTokens {
+			o.jwtBearerVerifiers = append(o.jwtBearerVerifiers, c.oidcVerifier)
+		}
+		o.logoutVerifiers = append(o.logoutVerifiers, c.logoutVerifiers...)
+
+		name := po.Name
+		if name == "" {
+			name = c.provider.Data().ProviderName
+		}
+		o.signInProviders = append(o.signInProviders, &signInProvider{
+			ID:           po.ID,
+			Name:         name,
+			provider:     c.provider,
+			emailDomains: po.EmailDomains,
+		})
+	}
+	if len(o.signInProviders) > 0 {
+		o.provider = o.signInProviders[0].provider
+	}
+	return msgs, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/msepp/oauth2_proxy/v4/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadProviderOptions(t *testing.T) {
+	f, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`
+email_domains = ["*"]
+
+[[providers]]
+id = "employees"
+name = "Google"
+provider = "google"
+client_id = "google-client"
+client_secret = "google-secret"
+email_domains = ["example.com"]
+
+[[providers]]
+id = "contractors"
+provider = "github"
+client_id = "github-client"
+client_secret = "github-secret"
+github_org = "contractors"
+`)
+	f.Close()
+
+	providerOptions, err := loadProviderOptions(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ProviderOptions{
+		{
+			ID:           "employees",
+			Name:         "Google",
+			Provider:     "google",
+			ClientID:     "google-client",
+			ClientSecret: "google-secret",
+			EmailDomains: []string{"example.com"},
+		},
+		{
+			ID:           "contractors",
+			Provider:     "github",
+			ClientID:     "github-client",
+			ClientSecret: "github-secret",
+			GitHubOrg:    "contractors",
+		},
+	}, providerOptions)
+}
+
+func TestParseProviders(t *testing.T) {
+	o := testOptions()
+	o.ClientID = ""
+	o.ClientSecret = ""
+	o.Providers = []ProviderOptions{
+		{ID: "employees", Provider: "google", ClientID: "google-client", ClientSecret: "google-secret"},
+		{ID: "contractors", Provider: "github", ClientID: "github-client", ClientSecret: "github-secret", GitHubOrg: "contractors"},
+	}
+	assert.Equal(t, nil, o.Validate())
+
+	if assert.Len(t, o.signInProviders, 2) {
+		assert.Equal(t, "employees", o.signInProviders[0].ID)
+		assert.Equal(t, "Google", o.signInProviders[0].Name)
+		assert.Equal(t, "google-client", o.signInProviders[0].provider.Data().ClientID)
+		assert.Equal(t, "contractors", o.signInProviders[1].ID)
+		assert.Equal(t, "GitHub", o.signInProviders[1].Name)
+		assert.IsType(t, &providers.GitHubProvider{}, o.signInProviders[1].provider)
+	}
+	// the first provider is the default
+	assert.Equal(t, o.signInProviders[0].provider, o.provider)
+}
+
+func TestParseProvidersInvalid(t *testing.T) {
+	o := testOptions()
+	o.Providers = []ProviderOptions{
+		{ID: "employees", Provider: "google", ClientSecret: "google-secret"},
+		{ID: "employees", Provider: "github", ClientID: "github-client", ClientSecret: "github-secret"},
+		{ID: "a:b", Provider: "github", ClientID: "github-client", ClientSecret: "github-secret"},
+		{ID: "contractors", Provider: "github", ClientID: "github-client", ClientSecret: "github-secret", AllowedGroups: []string{"admins"}},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		`provider "employees": missing setting: client_id`,
+		`duplicate provider id "employees"`,
+		`invalid provider id "a:b": only letters, digits, '.', '_' and '-' are allowed`,
+		`provider "contractors": allowed_groups and allowed_roles are only supported by the oidc provider`,
+	})
+	assert.Contains(t, err.Error(), expected)
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -94,7 +95,7 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 }
 
 // GetLoginURL with Azure specific OAuth2 parameters
-func (p *AzureProvider) GetLoginURL(redirectURI, state string) string {
+func (p *AzureProvider) GetLoginURL(redirectURI, state string, extraParams url.Values) string {
 	var a url.URL
 	a = *p.LoginURL
 	params, _ := url.ParseQuery(a.RawQuery)
@@ -106,19 +107,20 @@ func (p *AzureProvider) GetLoginURL(redirectURI, state string) string {
 	if p.ApprovalPrompt != "" {
 		params.Set("prompt", p.ApprovalPrompt) // Azure uses "prompt" instead of "approval_prompt"
 	}
+	addExtraParams(params, extraParams)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
 
 // GetEmailAddress returns the Account email address
-func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+func (p *AzureProvider) GetEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
 	var email string
 	var err error
 
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return "", err
 	}
@@ -152,7 +154,7 @@ func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error
 }
 
 // Redeem an Azure OAuth2 token
-func (p *AzureProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (s *sessions.SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -164,19 +166,22 @@ func (p *AzureProvider) Redeem(redirectURL, code string) (s *sessions.SessionSta
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
 		params.Add("resource", p.ProtectedResource.String())
 	}
 
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = http.NewRequestWithContext(ctx, "POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = requests.Client().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +220,7 @@ func (p *AzureProvider) Redeem(redirectURL, code string) (s *sessions.SessionSta
 
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
-func (p *AzureProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+func (p *AzureProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
 	if s != nil {
 		log.Printf("RefreshSessionIfNeeded: refresh_token_len: %d, expires_on: %v, after: %t", len(s.RefreshToken), s.ExpiresOn, s.ExpiresOn.After(time.Now()))
 	} else {
@@ -226,7 +231,7 @@ func (p *AzureProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool,
 		return false, nil
 	}
 
-	newSession, err := p.redeemRefreshToken(s.RefreshToken)
+	newSession, err := p.redeemRefreshToken(ctx, s.RefreshToken)
 	if err != nil {
 		logger.Printf("AZURE: redeem failed: %v", err)
 		return false, err
@@ -243,7 +248,7 @@ func (p *AzureProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool,
 	return true, nil
 }
 
-func (p *AzureProvider) redeemRefreshToken(refreshToken string) (*sessions.SessionState, error) {
+func (p *AzureProvider) redeemRefreshToken(ctx context.Context, refreshToken string) (*sessions.SessionState, error) {
 	// https://docs.microsoft.com/en-us/azure/active-directory/develop/v1-protocols-oauth-code
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
@@ -256,13 +261,13 @@ func (p *AzureProvider) redeemRefreshToken(refreshToken string) (*sessions.Sessi
 		req *http.Request
 		err error
 	)
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = http.NewRequestWithContext(ctx, "POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Client().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -297,7 +302,7 @@ func (p *AzureProvider) redeemRefreshToken(refreshToken string) (*sessions.Sessi
 
 	log.Printf("refresh_token len: %d, expires_on: %v", len(s.RefreshToken), s.ExpiresOn)
 
-	if s.Email, err = p.GetEmailAddress(s); err != nil {
+	if s.Email, err = p.GetEmailAddress(ctx, s); err != nil {
 		return nil, err
 	}
 
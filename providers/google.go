@@ -2,6 +2,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -15,7 +16,7 @@ import (
 
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
 	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
-	"golang.org/x/oauth2"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/googleapi"
@@ -27,7 +28,7 @@ type GoogleProvider struct {
 	RedeemRefreshURL *url.URL
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
-	GroupValidator func(string) bool
+	GroupValidator func(context.Context, string) bool
 }
 
 type claims struct {
@@ -65,7 +66,7 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 		ProviderData: p,
 		// Set a default GroupValidator to just always return valid (true), it will
 		// be overwritten if we configured a Google group restriction.
-		GroupValidator: func(email string) bool {
+		GroupValidator: func(ctx context.Context, email string) bool {
 			return true
 		},
 	}
@@ -97,7 +98,7 @@ func claimsFromIDToken(idToken string) (*claims, error) {
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (s *sessions.SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -109,14 +110,17 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionSt
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = http.NewRequestWithContext(ctx, "POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Client().Do(req)
 	if err != nil {
 		return
 	}
@@ -161,15 +165,15 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionSt
 // SetGroupRestriction configures the GoogleProvider to restrict access to the
 // specified group(s). AdminEmail has to be an administrative email on the domain that is
 // checked. CredentialsFile is the path to a json file containing a Google service
-// account credentials.
-func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
-	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
+// account credentials. The directory API is called with the client of ctx.
+func (p *GoogleProvider) SetGroupRestriction(ctx context.Context, groups []string, adminEmail string, credentialsReader io.Reader) {
+	adminService := getAdminService(ctx, adminEmail, credentialsReader)
+	p.GroupValidator = func(ctx context.Context, email string) bool {
+		return userInGroup(ctx, adminService, groups, email)
 	}
 }
 
-func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
+func getAdminService(ctx context.Context, adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
 		logger.Fatal("can't read Google credentials file:", err)
@@ -180,7 +184,7 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	}
 	conf.Subject = adminEmail
 
-	client := conf.Client(oauth2.NoContext)
+	client := conf.Client(ctx)
 	adminService, err := admin.New(client)
 	if err != nil {
 		logger.Fatal(err)
@@ -188,11 +192,11 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	return adminService
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
+func userInGroup(ctx context.Context, service *admin.Service, groups []string, email string) bool {
 	for _, group := range groups {
 		// Use the HasMember API to checking for the user's presence in each group or nested subgroups
 		req := service.Members.HasMember(group, email)
-		r, err := req.Do()
+		r, err := req.Context(ctx).Do()
 		if err != nil {
 			err, ok := err.(*googleapi.Error)
 			if ok && err.Code == 404 {
@@ -203,7 +207,7 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 				// e.g. "member@otherdomain.com" in the group "group@mydomain.com" will result in a 400 error
 				// from the HasMember API. In that case, attempt to query the member object directly from the group.
 				req := service.Members.Get(group, email)
-				r, err := req.Do()
+				r, err := req.Context(ctx).Do()
 
 				if err != nil {
 					logger.Printf("error using get API to check member %s of google group %s: user not in the group", email, group)
@@ -229,24 +233,24 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 
 // ValidateGroup validates that the provided email exists in the configured Google
 // group(s).
-func (p *GoogleProvider) ValidateGroup(email string) bool {
-	return p.GroupValidator(email)
+func (p *GoogleProvider) ValidateGroup(ctx context.Context, email string) bool {
+	return p.GroupValidator(ctx, email)
 }
 
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
-func (p *GoogleProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+func (p *GoogleProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
 	}
 
-	newToken, newIDToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
+	newToken, newIDToken, duration, err := p.redeemRefreshToken(ctx, s.RefreshToken)
 	if err != nil {
 		return false, err
 	}
 
 	// re-check that the user is in the proper google group(s)
-	if !p.ValidateGroup(s.Email) {
+	if !p.ValidateGroup(ctx, s.Email) {
 		return false, fmt.Errorf("%s is no longer in the group(s)", s.Email)
 	}
 
@@ -258,7 +262,7 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool,
 	return true, nil
 }
 
-func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, idToken string, expires time.Duration, err error) {
+func (p *GoogleProvider) redeemRefreshToken(ctx context.Context, refreshToken string) (token string, idToken string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
@@ -266,13 +270,13 @@ func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string,
 	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = http.NewRequestWithContext(ctx, "POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Client().Do(req)
 	if err != nil {
 		return
 	}
@@ -2,7 +2,9 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +16,7 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
 	jose "gopkg.in/square/go-jose.v2"
 )
 
@@ -21,15 +24,12 @@ import (
 type LoginGovProvider struct {
 	*ProviderData
 
-	// TODO (@timothy-spencer): Ideally, the nonce would be in the session state, but the session state
-	// is created only upon code redemption, not during the auth, when this must be supplied.
-	Nonce     string
 	AcrValues string
 	JWTKey    *rsa.PrivateKey
 	PubJWKURL *url.URL
 }
 
-// For generating a nonce
+// For generating the ID of client assertions
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randSeq(n int) string {
@@ -43,6 +43,7 @@ func randSeq(n int) string {
 // NewLoginGovProvider initiates a new LoginGovProvider
 func NewLoginGovProvider(p *ProviderData) *LoginGovProvider {
 	p.ProviderName = "login.gov"
+	p.UsesNonce = true
 
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{
@@ -71,7 +72,6 @@ func NewLoginGovProvider(p *ProviderData) *LoginGovProvider {
 
 	return &LoginGovProvider{
 		ProviderData: p,
-		Nonce:        randSeq(32),
 	}
 }
 
@@ -88,10 +88,14 @@ type loginGovCustomClaims struct {
 	jwt.StandardClaims
 }
 
-// checkNonce checks the nonce in the id_token
-func checkNonce(idToken string, p *LoginGovProvider) (err error) {
+// checkNonce checks the nonce in the id_token against the nonce of the login
+func checkNonce(ctx context.Context, idToken, nonce string, p *LoginGovProvider) (err error) {
 	token, err := jwt.ParseWithClaims(idToken, &loginGovCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		resp, myerr := http.Get(p.PubJWKURL.String())
+		req, myerr := http.NewRequestWithContext(ctx, "GET", p.PubJWKURL.String(), nil)
+		if myerr != nil {
+			return nil, myerr
+		}
+		resp, myerr := requests.Client().Do(req)
 		if myerr != nil {
 			return nil, myerr
 		}
@@ -119,23 +123,23 @@ func checkNonce(idToken string, p *LoginGovProvider) (err error) {
 	}
 
 	claims := token.Claims.(*loginGovCustomClaims)
-	if claims.Nonce != p.Nonce {
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
 		err = fmt.Errorf("nonce validation failed")
 		return
 	}
 	return
 }
 
-func emailFromUserInfo(accessToken string, userInfoEndpoint string) (email string, err error) {
+func emailFromUserInfo(ctx context.Context, accessToken string, userInfoEndpoint string) (email string, err error) {
 	// query the user info endpoint for user attributes
 	var req *http.Request
-	req, err = http.NewRequest("GET", userInfoEndpoint, nil)
+	req, err = http.NewRequestWithContext(ctx, "GET", userInfoEndpoint, nil)
 	if err != nil {
 		return
 	}
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Client().Do(req)
 	if err != nil {
 		return
 	}
@@ -174,7 +178,7 @@ func emailFromUserInfo(accessToken string, userInfoEndpoint string) (email strin
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (s *sessions.SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -198,16 +202,19 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 	params.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = http.NewRequestWithContext(ctx, "POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = requests.Client().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -236,14 +243,14 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 	}
 
 	// check nonce here
-	err = checkNonce(jsonResponse.IDToken, p)
+	err = checkNonce(ctx, jsonResponse.IDToken, nonce, p)
 	if err != nil {
 		return
 	}
 
 	// Get the email address
 	var email string
-	email, err = emailFromUserInfo(jsonResponse.AccessToken, p.ProfileURL.String())
+	email, err = emailFromUserInfo(ctx, jsonResponse.AccessToken, p.ProfileURL.String())
 	if err != nil {
 		return
 	}
@@ -260,7 +267,7 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 }
 
 // GetLoginURL overrides GetLoginURL to add login.gov parameters
-func (p *LoginGovProvider) GetLoginURL(redirectURI, state string) string {
+func (p *LoginGovProvider) GetLoginURL(redirectURI, state string, extraParams url.Values) string {
 	var a url.URL
 	a = *p.LoginURL
 	params, _ := url.ParseQuery(a.RawQuery)
@@ -271,7 +278,7 @@ func (p *LoginGovProvider) GetLoginURL(redirectURI, state string) string {
 	params.Set("response_type", "code")
 	params.Add("state", state)
 	params.Add("acr_values", p.AcrValues)
-	params.Add("nonce", p.Nonce)
+	addExtraParams(params, extraParams)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
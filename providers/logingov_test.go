@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -60,7 +61,6 @@ func newLoginGovProvider() (l *LoginGovProvider, serverKey *MyKeyData, err error
 			ValidateURL:  &url.URL{},
 			Scope:        ""})
 	l.JWTKey = privateKey
-	l.Nonce = "fakenonce"
 	return
 }
 
@@ -189,7 +189,7 @@ func TestLoginGovProviderSessionData(t *testing.T) {
 	p.PubJWKURL, pubjwkserver = newLoginGovServer(pubjwkbody)
 	defer pubjwkserver.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem(context.Background(), "http://redirect/", "code1234", "", "fakenonce")
 	assert.NoError(t, err)
 	assert.NotEqual(t, session, nil)
 	assert.Equal(t, "timothy.spencer@gsa.gov", session.Email)
@@ -197,6 +197,20 @@ func TestLoginGovProviderSessionData(t *testing.T) {
 
 	// The test ought to run in under 2 seconds.  If not, you may need to bump this up.
 	assert.InDelta(t, session.ExpiresOn.Unix(), time.Now().Unix()+expiresIn, 2)
+
+	// The ID token has to carry the nonce of the login
+	_, err = p.Redeem(context.Background(), "http://redirect/", "code1234", "", "")
+	assert.Error(t, err)
+}
+
+func TestLoginGovProviderGetLoginURL(t *testing.T) {
+	p, _, err := newLoginGovProvider()
+	assert.NoError(t, err)
+	assert.True(t, p.Data().UsesNonce)
+
+	loginURL, err := url.Parse(p.GetLoginURL("http://redirect/", "state", url.Values{"nonce": {"login-nonce"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"login-nonce"}, loginURL.Query()["nonce"])
 }
 
 func TestLoginGovProviderBadNonce(t *testing.T) {
@@ -283,7 +297,7 @@ func TestLoginGovProviderBadNonce(t *testing.T) {
 	p.PubJWKURL, pubjwkserver = newLoginGovServer(pubjwkbody)
 	defer pubjwkserver.Close()
 
-	_, err = p.Redeem("http://redirect/", "code1234")
+	_, err = p.Redeem(context.Background(), "http://redirect/", "code1234", "", "fakenonce")
 
 	// The "badfakenonce" in the idtoken above should cause this to error out
 	assert.Error(t, err)
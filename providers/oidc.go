@@ -2,12 +2,16 @@ package providers
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
 	"github.com/msepp/oauth2_proxy/v4/pkg/requests"
 
 	"golang.org/x/oauth2"
@@ -19,17 +23,36 @@ type OIDCProvider struct {
 
 	Verifier             *oidc.IDTokenVerifier
 	AllowUnverifiedEmail bool
+
+	// AllowedGroups and AllowedRoles restrict logins to users that have at
+	// least one of the listed values in the GroupsClaim and RolesClaim of
+	// their ID token respectively. Claims may be nested, eg:
+	// "realm_access.roles".
+	AllowedGroups []string
+	AllowedRoles  []string
+	GroupsClaim   string
+	RolesClaim    string
+
+	// EndSessionURL is the end_session_endpoint used for RP-initiated logout
+	EndSessionURL *url.URL
+
+	// SessionClaims lists ID token claims that are kept in the session in
+	// addition to oidcSessionClaims, eg: "tid"
+	SessionClaims []string
 }
 
+// oidcSessionClaims lists the ID token claims that are kept in the session
+var oidcSessionClaims = []string{"iss", "sub", "sid", "preferred_username", "name"}
+
 // NewOIDCProvider initiates a new OIDCProvider
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 	p.ProviderName = "OpenID Connect"
+	p.UsesNonce = true
 	return &OIDCProvider{ProviderData: p}
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *OIDCProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
-	ctx := context.Background()
+func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (s *sessions.SessionState, err error) {
 	c := oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -38,27 +61,36 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *sessions.SessionStat
 		},
 		RedirectURL: redirectURL,
 	}
-	token, err := c.Exchange(ctx, code)
+	token, err := c.Exchange(requests.ClientContext(ctx), code, codeVerifierOptions(codeVerifier)...)
 	if err != nil {
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
-	s, err = p.createSessionState(ctx, token)
+	s, err = p.createSessionState(ctx, token, nonce)
 	if err != nil {
 		return nil, fmt.Errorf("unable to update session: %v", err)
 	}
 	return
 }
 
+// codeVerifierOptions adds the PKCE code verifier to the token exchange when
+// one was used for the login
+func codeVerifierOptions(codeVerifier string) []oauth2.AuthCodeOption {
+	if codeVerifier == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", codeVerifier)}
+}
+
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
-func (p *OIDCProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+func (p *OIDCProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
 	}
 
 	origExpiration := s.ExpiresOn
 
-	err := p.redeemRefreshToken(s)
+	err := p.redeemRefreshToken(ctx, s)
 	if err != nil {
 		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
 	}
@@ -67,7 +99,7 @@ func (p *OIDCProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, e
 	return true, nil
 }
 
-func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error) {
+func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *sessions.SessionState) (err error) {
 	c := oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -75,16 +107,16 @@ func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error)
 			TokenURL: p.RedeemURL.String(),
 		},
 	}
-	ctx := context.Background()
 	t := &oauth2.Token{
 		RefreshToken: s.RefreshToken,
 		Expiry:       time.Now().Add(-time.Hour),
 	}
-	token, err := c.TokenSource(ctx, t).Token()
+	token, err := c.TokenSource(requests.ClientContext(ctx), t).Token()
 	if err != nil {
 		return fmt.Errorf("failed to get token: %v", err)
 	}
-	newSession, err := p.createSessionState(ctx, token)
+	// ID tokens issued on refresh don't necessarily carry the nonce
+	newSession, err := p.createSessionState(ctx, token, "")
 	if err != nil {
 		return fmt.Errorf("unable to update session: %v", err)
 	}
@@ -94,10 +126,14 @@ func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error)
 	s.CreatedAt = newSession.CreatedAt
 	s.ExpiresOn = newSession.ExpiresOn
 	s.Email = newSession.Email
+	s.Groups = newSession.Groups
+	s.Claims = newSession.Claims
 	return
 }
 
-func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Token) (*sessions.SessionState, error) {
+// createSessionState creates a session from the tokens. A non-empty nonce
+// must match the nonce claim of the ID token.
+func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Token, nonce string) (*sessions.SessionState, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
 		return nil, fmt.Errorf("token response did not contain an id_token")
@@ -108,6 +144,9 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 	if err != nil {
 		return nil, fmt.Errorf("could not verify id_token: %v", err)
 	}
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("id_token nonce doesn't match the nonce of the login")
+	}
 
 	// Extract custom claims.
 	var claims struct {
@@ -118,6 +157,10 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
 	}
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
 
 	if claims.Email == "" {
 		if p.ProfileURL.String() == "" {
@@ -128,7 +171,7 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		// contents at the profileURL contains the email.
 		// Make a query to the userinfo endpoint, and attempt to locate the email from there.
 
-		req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -150,7 +193,7 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
 	}
 
-	return &sessions.SessionState{
+	s := &sessions.SessionState{
 		AccessToken:  token.AccessToken,
 		IDToken:      rawIDToken,
 		RefreshToken: token.RefreshToken,
@@ -158,12 +201,58 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		ExpiresOn:    idToken.Expiry,
 		Email:        claims.Email,
 		User:         claims.Subject,
-	}, nil
+	}
+	p.SetSessionClaims(s, allClaims)
+	return s, nil
+}
+
+// SetSessionClaims fills in the groups and the claims of a session from the
+// claims of its ID token. Authorize only checks the groups and roles kept
+// in the session, the ID token isn't decoded again on every request.
+func (p *OIDCProvider) SetSessionClaims(s *sessions.SessionState, claims map[string]interface{}) {
+	s.Groups = claimValues(claims, p.GroupsClaim)
+	s.Claims = p.sessionClaims(claims)
+}
+
+// sessionClaims picks the ID token claims that are kept in the session.
+// The roles are stored under the name of the configured RolesClaim.
+func (p *OIDCProvider) sessionClaims(claims map[string]interface{}) map[string]interface{} {
+	kept := make(map[string]interface{})
+	for _, name := range append(oidcSessionClaims, p.SessionClaims...) {
+		if v, ok := claims[name]; ok {
+			kept[name] = v
+		}
+	}
+	if roles := claimValues(claims, p.RolesClaim); len(roles) > 0 {
+		kept[p.RolesClaim] = roles
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// GetLogoutURL returns the end_session_endpoint with the session's ID token
+// as id_token_hint, so the user is signed out of the provider as well
+func (p *OIDCProvider) GetLogoutURL(s *sessions.SessionState, redirectURI string) string {
+	if p.EndSessionURL == nil || p.EndSessionURL.String() == "" {
+		return ""
+	}
+	a := *p.EndSessionURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	if s.IDToken != "" {
+		params.Set("id_token_hint", s.IDToken)
+	}
+	params.Set("client_id", p.ClientID)
+	if redirectURI != "" {
+		params.Set("post_logout_redirect_uri", redirectURI)
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
 }
 
 // ValidateSessionState checks that the session's IDToken is still valid
-func (p *OIDCProvider) ValidateSessionState(s *sessions.SessionState) bool {
-	ctx := context.Background()
+func (p *OIDCProvider) ValidateSessionState(ctx context.Context, s *sessions.SessionState) bool {
 	_, err := p.Verifier.Verify(ctx, s.IDToken)
 	if err != nil {
 		return false
@@ -172,6 +261,80 @@ func (p *OIDCProvider) ValidateSessionState(s *sessions.SessionState) bool {
 	return true
 }
 
+// Authorize checks the groups and roles kept in the session when it was
+// created from an ID token against the configured allowed groups and roles.
+// Sessions without an ID token, eg: from token introspection or LDAP, have
+// no claims to check and are denied.
+func (p *OIDCProvider) Authorize(s *sessions.SessionState) bool {
+	if len(p.AllowedGroups) == 0 && len(p.AllowedRoles) == 0 {
+		return true
+	}
+	if s.IDToken == "" {
+		logger.Printf("denying %s: no claims for authorization, the session wasn't created from an ID token", s.Email)
+		return false
+	}
+
+	groups := s.Groups
+	roles := stringValues(s.Claims[p.RolesClaim])
+	if len(p.AllowedGroups) > 0 && !containsAny(groups, p.AllowedGroups) {
+		return false
+	}
+	if len(p.AllowedRoles) > 0 && !containsAny(roles, p.AllowedRoles) {
+		return false
+	}
+	return true
+}
+
+// claimValues returns the string values of the claim at the given path.
+// Nested claims are addressed with dots, eg: "realm_access.roles". Both single
+// string values and lists of strings are supported.
+func claimValues(claims map[string]interface{}, path string) []string {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return stringValues(value)
+}
+
+// stringValues converts a single string or a list of strings held in a claim
+// into a string slice
+func stringValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func containsAny(values []string, allowed []string) bool {
+	for _, value := range values {
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func getOIDCHeader(accessToken string) http.Header {
 	header := make(http.Header)
 	header.Set("Accept", "application/json")
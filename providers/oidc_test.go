@@ -0,0 +1,207 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOIDCProvider() *OIDCProvider {
+	return NewOIDCProvider(&ProviderData{})
+}
+
+// unsignedIDToken builds a JWT shaped token carrying the given claims, to be
+// verified with insecureKeySet.
+func unsignedIDToken(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(payload) + ".sig"
+}
+
+// sessionWithClaims builds a session the way it is created from an ID token
+// carrying the given claims.
+func sessionWithClaims(p *OIDCProvider, claims map[string]interface{}) *sessions.SessionState {
+	s := &sessions.SessionState{IDToken: "id-token"}
+	p.SetSessionClaims(s, claims)
+	return s
+}
+
+func TestOIDCProviderClaimValues(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups": []interface{}{"admins", "devs"},
+		"role":   "reader",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access", "writer"},
+		},
+	}
+
+	assert.Equal(t, []string{"admins", "devs"}, claimValues(claims, "groups"))
+	assert.Equal(t, []string{"reader"}, claimValues(claims, "role"))
+	assert.Equal(t, []string{"offline_access", "writer"}, claimValues(claims, "realm_access.roles"))
+	assert.Empty(t, claimValues(claims, "realm_access.missing"))
+	assert.Empty(t, claimValues(claims, ""))
+}
+
+func TestOIDCProviderAuthorizeWithoutRestrictions(t *testing.T) {
+	p := newTestOIDCProvider()
+	assert.True(t, p.Authorize(&sessions.SessionState{}))
+}
+
+func TestOIDCProviderAuthorizeGroups(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsClaim = "groups"
+	p.AllowedGroups = []string{"admins"}
+
+	allowed := sessionWithClaims(p, map[string]interface{}{
+		"groups": []interface{}{"devs", "admins"},
+	})
+	denied := sessionWithClaims(p, map[string]interface{}{
+		"groups": []interface{}{"devs"},
+	})
+
+	assert.True(t, p.Authorize(allowed))
+	assert.False(t, p.Authorize(denied))
+	assert.False(t, p.Authorize(&sessions.SessionState{}))
+}
+
+func TestOIDCProviderAuthorizeNestedRoles(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.RolesClaim = "realm_access.roles"
+	p.AllowedRoles = []string{"writer"}
+
+	allowed := sessionWithClaims(p, map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"writer"}},
+	})
+	denied := sessionWithClaims(p, map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"reader"}},
+	})
+
+	assert.True(t, p.Authorize(allowed))
+	assert.False(t, p.Authorize(denied))
+}
+
+func TestOIDCProviderAuthorizeWithoutIDToken(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsClaim = "groups"
+	p.AllowedGroups = []string{"admins"}
+
+	// sessions from token introspection or LDAP have no claims to check,
+	// even if they carry groups
+	s := &sessions.SessionState{AccessToken: "opaque", Groups: []string{"admins"}}
+	assert.False(t, p.Authorize(s))
+}
+
+func TestOIDCProviderSessionClaims(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.RolesClaim = "realm_access.roles"
+	p.SessionClaims = []string{"tid"}
+
+	claims := p.sessionClaims(map[string]interface{}{
+		"sub":                "1234",
+		"tid":                "tenant-1",
+		"preferred_username": "jdoe",
+		"nonce":              "abc",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"writer"},
+		},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"sub":                "1234",
+		"tid":                "tenant-1",
+		"preferred_username": "jdoe",
+		"realm_access.roles": []string{"writer"},
+	}, claims)
+
+	assert.Nil(t, p.sessionClaims(map[string]interface{}{}))
+}
+
+func TestOIDCProviderAuthorizeGroupsAndRoles(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsClaim = "groups"
+	p.RolesClaim = "roles"
+	p.AllowedGroups = []string{"admins"}
+	p.AllowedRoles = []string{"writer"}
+
+	onlyGroup := sessionWithClaims(p, map[string]interface{}{
+		"groups": []interface{}{"admins"},
+	})
+	both := sessionWithClaims(p, map[string]interface{}{
+		"groups": []interface{}{"admins"},
+		"roles":  []interface{}{"writer"},
+	})
+
+	assert.False(t, p.Authorize(onlyGroup))
+	assert.True(t, p.Authorize(both))
+}
+
+func TestOIDCProviderGetLogoutURL(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.ClientID = "client"
+	s := &sessions.SessionState{IDToken: "id-token"}
+
+	assert.Equal(t, "", p.GetLogoutURL(s, "https://proxy.example.com/"))
+
+	p.EndSessionURL, _ = url.Parse("https://provider.example.com/logout?foo=bar")
+	logoutURL, err := url.Parse(p.GetLogoutURL(s, "https://proxy.example.com/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "provider.example.com", logoutURL.Host)
+	assert.Equal(t, url.Values{
+		"foo":                      {"bar"},
+		"client_id":                {"client"},
+		"id_token_hint":            {"id-token"},
+		"post_logout_redirect_uri": {"https://proxy.example.com/"},
+	}, logoutURL.Query())
+}
+
+// insecureKeySet accepts the signature of any token
+type insecureKeySet struct{}
+
+func (insecureKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.Split(jwt, ".")[1])
+}
+
+func TestOIDCProviderRedeemChecksNonce(t *testing.T) {
+	idToken := unsignedIDToken(t, map[string]interface{}{
+		"iss":   "https://issuer.example.com",
+		"aud":   "client",
+		"sub":   "1234",
+		"email": "john.doe@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "login-nonce",
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	assert.True(t, p.Data().UsesNonce)
+	p.ClientID = "client"
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.Verifier = oidc.NewVerifier("https://issuer.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client", SupportedSigningAlgs: []string{"none"}})
+
+	session, err := p.Redeem(context.Background(), "https://proxy.example.com/oauth2/callback", "code1234", "", "login-nonce")
+	assert.NoError(t, err)
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "john.doe@example.com", session.Email)
+	}
+
+	_, err = p.Redeem(context.Background(), "https://proxy.example.com/oauth2/callback", "code1234", "", "other-nonce")
+	assert.Error(t, err)
+}
@@ -17,6 +17,9 @@ type ProviderData struct {
 	ValidateURL       *url.URL
 	Scope             string
 	ApprovalPrompt    string
+	// UsesNonce is set for providers issuing ID tokens, which get a nonce
+	// per login to check the ID token against
+	UsesNonce bool
 }
 
 // Data returns the ProviderData
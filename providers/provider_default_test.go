@@ -1,6 +1,10 @@
 package providers
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -10,9 +14,68 @@ import (
 
 func TestRefresh(t *testing.T) {
 	p := &ProviderData{}
-	refreshed, err := p.RefreshSessionIfNeeded(&sessions.SessionState{
+	refreshed, err := p.RefreshSessionIfNeeded(context.Background(), &sessions.SessionState{
 		ExpiresOn: time.Now().Add(time.Duration(-11) * time.Minute),
 	})
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestGetLoginURLExtraParams(t *testing.T) {
+	p := &ProviderData{
+		LoginURL: &url.URL{Scheme: "https", Host: "provider.example.com", Path: "/authorize"},
+		ClientID: "client",
+		Scope:    "openid",
+	}
+	loginURL, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/", url.Values{
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}))
+	assert.Equal(t, nil, err)
+
+	params := loginURL.Query()
+	assert.Equal(t, "nonce:/", params.Get("state"))
+	assert.Equal(t, "challenge", params.Get("code_challenge"))
+	assert.Equal(t, "S256", params.Get("code_challenge_method"))
+}
+
+func TestRedeemCodeVerifier(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "a1234"}`))
+	}))
+	defer server.Close()
+
+	redeemURL, _ := url.Parse(server.URL)
+	p := &ProviderData{RedeemURL: redeemURL}
+
+	session, err := p.Redeem(context.Background(), "https://proxy.example.com/oauth2/callback", "code1234", "verifier", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, "verifier", form.Get("code_verifier"))
+
+	_, err = p.Redeem(context.Background(), "https://proxy.example.com/oauth2/callback", "code1234", "", "")
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, form, "code_verifier")
+}
+
+func TestRedeemContextCanceled(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	redeemURL, _ := url.Parse(server.URL)
+	p := &ProviderData{RedeemURL: redeemURL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := p.Redeem(ctx, "https://proxy.example.com/oauth2/callback", "code1234", "", "")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
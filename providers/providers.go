@@ -1,20 +1,26 @@
 package providers
 
 import (
+	"context"
+	"net/url"
+
 	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
 	"github.com/msepp/oauth2_proxy/v4/pkg/encryption"
 )
 
-// Provider represents an upstream identity provider implementation
+// Provider represents an upstream identity provider implementation. Methods
+// that call out to the provider abort when their context is done.
 type Provider interface {
 	Data() *ProviderData
-	GetEmailAddress(*sessions.SessionState) (string, error)
-	GetUserName(*sessions.SessionState) (string, error)
-	Redeem(string, string) (*sessions.SessionState, error)
-	ValidateGroup(string) bool
-	ValidateSessionState(*sessions.SessionState) bool
-	GetLoginURL(redirectURI, finalRedirect string) string
-	RefreshSessionIfNeeded(*sessions.SessionState) (bool, error)
+	GetEmailAddress(context.Context, *sessions.SessionState) (string, error)
+	GetUserName(context.Context, *sessions.SessionState) (string, error)
+	Redeem(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*sessions.SessionState, error)
+	ValidateGroup(context.Context, string) bool
+	Authorize(*sessions.SessionState) bool
+	ValidateSessionState(context.Context, *sessions.SessionState) bool
+	GetLoginURL(redirectURI, state string, extraParams url.Values) string
+	GetLogoutURL(s *sessions.SessionState, redirectURI string) string
+	RefreshSessionIfNeeded(context.Context, *sessions.SessionState) (bool, error)
 	SessionFromCookie(string, *encryption.Cipher) (*sessions.SessionState, error)
 	CookieForSession(*sessions.SessionState, *encryption.Cipher) (string, error)
 }
@@ -38,6 +44,8 @@ func New(provider string, p *ProviderData) Provider {
 		return NewLoginGovProvider(p)
 	case "bitbucket":
 		return NewBitbucketProvider(p)
+	case "saml":
+		return NewSAMLProvider(p)
 	default:
 		return NewGoogleProvider(p)
 	}
@@ -0,0 +1,95 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/saml"
+)
+
+// SAMLProvider signs users in with a SAML 2.0 identity provider. Logins are
+// started with an AuthnRequest and completed by the assertion consumer
+// service with SessionFromResponse, there is no code to redeem.
+type SAMLProvider struct {
+	*ProviderData
+
+	SP *saml.ServiceProvider
+	// EmailAttribute and GroupsAttribute name the attributes holding the
+	// email address and the groups of the user
+	EmailAttribute  string
+	GroupsAttribute string
+}
+
+// NewSAMLProvider initiates a new SAMLProvider
+func NewSAMLProvider(p *ProviderData) *SAMLProvider {
+	p.ProviderName = "SAML"
+	return &SAMLProvider{ProviderData: p}
+}
+
+// samlRequestID returns the ID of the AuthnRequest of the login with the
+// state. The response has to be in response to it, which ties the response
+// to the login it was requested for.
+func samlRequestID(state string) string {
+	h := sha256.Sum256([]byte(state))
+	return fmt.Sprintf("id-%x", h[:20])
+}
+
+// GetLoginURL returns the URL of the identity provider with an AuthnRequest.
+// The state is passed as the relay state.
+func (p *SAMLProvider) GetLoginURL(redirectURI, state string, extraParams url.Values) string {
+	return p.SP.AuthnRequestURL(samlRequestID(state), state)
+}
+
+// Redeem is not supported, SAML responses are posted to the assertion
+// consumer service
+func (p *SAMLProvider) Redeem(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (*sessions.SessionState, error) {
+	return nil, errors.New("SAML logins are completed by the assertion consumer service")
+}
+
+// SessionFromResponse validates the SAML response posted to the assertion
+// consumer service for the login with the state, and returns the session
+// of the user
+func (p *SAMLProvider) SessionFromResponse(samlResponse, state string) (*sessions.SessionState, error) {
+	assertion, err := p.SP.ParseResponse(samlResponse, samlRequestID(state))
+	if err != nil {
+		return nil, err
+	}
+	return p.sessionFromAssertion(assertion)
+}
+
+// sessionFromAssertion maps the NameID and attributes of the assertion to a
+// session. The NameID is the email address without an email attribute if
+// it has the email address format.
+func (p *SAMLProvider) sessionFromAssertion(a *saml.Assertion) (*sessions.SessionState, error) {
+	s := &sessions.SessionState{
+		User:      a.NameID,
+		Groups:    a.Attributes[p.GroupsAttribute],
+		CreatedAt: time.Now(),
+		ExpiresOn: a.SessionNotOnOrAfter,
+	}
+	if emails := a.Attributes[p.EmailAttribute]; len(emails) > 0 {
+		s.Email = emails[0]
+	} else if a.NameIDFormat == saml.NameIDFormatEmail {
+		s.Email = a.NameID
+	}
+	if s.Email == "" {
+		return nil, fmt.Errorf("assertion has neither a %q attribute nor an email address NameID", p.EmailAttribute)
+	}
+	return s, nil
+}
+
+// ValidateSessionState returns true, there is no token to validate with the
+// identity provider
+func (p *SAMLProvider) ValidateSessionState(ctx context.Context, s *sessions.SessionState) bool {
+	return true
+}
+
+// Metadata returns the metadata of the service provider
+func (p *SAMLProvider) Metadata() []byte {
+	return p.SP.Metadata()
+}
@@ -0,0 +1,87 @@
+package providers
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSAMLProvider() *SAMLProvider {
+	p := NewSAMLProvider(&ProviderData{})
+	p.EmailAttribute = "mail"
+	p.GroupsAttribute = "memberOf"
+	p.SP = &saml.ServiceProvider{
+		EntityID: "https://proxy.example.com/oauth2/saml/metadata",
+		ACSURL:   "https://proxy.example.com/oauth2/saml/acs",
+		IDP: &saml.IdentityProvider{
+			EntityID: "https://idp.example.com",
+			SSOURL:   &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/sso"},
+		},
+	}
+	return p
+}
+
+func TestSAMLProviderGetLoginURL(t *testing.T) {
+	p := newTestSAMLProvider()
+	assert.Equal(t, "SAML", p.Data().ProviderName)
+
+	loginURL, err := url.Parse(p.GetLoginURL("", "state", url.Values{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.example.com", loginURL.Host)
+	assert.Equal(t, "state", loginURL.Query().Get("RelayState"))
+
+	// The request ID is derived from the state, so only responses to the
+	// login with the state are accepted
+	deflated, err := base64.StdEncoding.DecodeString(loginURL.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	request, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(request), `ID="`+samlRequestID("state")+`"`)
+	assert.NotEqual(t, samlRequestID("state"), samlRequestID("other"))
+}
+
+func TestSAMLProviderSessionFromAssertion(t *testing.T) {
+	p := newTestSAMLProvider()
+	expires := time.Date(2020, 5, 1, 20, 0, 0, 0, time.UTC)
+
+	s, err := p.sessionFromAssertion(&saml.Assertion{
+		NameID:       "jdoe",
+		NameIDFormat: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
+		Attributes: map[string][]string{
+			"mail":     {"john.doe@example.com", "jd@example.com"},
+			"memberOf": {"admins", "devs"},
+		},
+		SessionNotOnOrAfter: expires,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe", s.User)
+	assert.Equal(t, "john.doe@example.com", s.Email)
+	assert.Equal(t, []string{"admins", "devs"}, s.Groups)
+	assert.Equal(t, expires, s.ExpiresOn)
+
+	// An email address NameID is the email without an email attribute
+	s, err = p.sessionFromAssertion(&saml.Assertion{
+		NameID:       "john.doe@example.com",
+		NameIDFormat: saml.NameIDFormatEmail,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", s.Email)
+	assert.Empty(t, s.Groups)
+	assert.True(t, s.ExpiresOn.IsZero())
+
+	_, err = p.sessionFromAssertion(&saml.Assertion{NameID: "jdoe"})
+	assert.Error(t, err)
+}
+
+func TestSAMLProviderRedeem(t *testing.T) {
+	_, err := newTestSAMLProvider().Redeem(context.Background(), "", "code", "", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	sessionsapi "github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"github.com/msepp/oauth2_proxy/v4/providers"
+)
+
+// refreshLockMargin is added to the timeout of a refresh for the expiration
+// of the lock held during it, so that the lock outlives the refresh. The lock
+// bounds how long a session stays locked should the instance refreshing it
+// go away. It is a variable for the tests.
+var refreshLockMargin = 5 * time.Second
+
+const (
+	// refreshLockTimeout bounds refreshes made while holding the lock of
+	// the session when provider calls don't time out otherwise
+	refreshLockTimeout = 30 * time.Second
+	// refreshLockPollInterval is how often an instance waiting for the
+	// lock of a session tries to obtain it
+	refreshLockPollInterval = 50 * time.Millisecond
+	// refreshResultExpiration is how long a refreshed session is handed to
+	// requests still carrying the session it replaced, e.g. requests sent
+	// before the browser got the new session cookie
+	refreshResultExpiration = 30 * time.Second
+)
+
+// errSessionLocked is returned when the lock of an expired session couldn't
+// be obtained to refresh it. The session is kept to be refreshed later.
+var errSessionLocked = errors.New("timed out waiting for the lock of the session")
+
+// refreshGroup deduplicates the refreshes of a session within the process
+type refreshGroup struct {
+	mutex sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done      chan struct{}
+	session   *sessionsapi.SessionState
+	refreshed bool
+	err       error
+}
+
+// do calls fn unless a call with the key is in flight or has refreshed the
+// session recently, in which case it returns a copy of the results of that
+// call instead
+func (g *refreshGroup) do(key string, fn func() (*sessionsapi.SessionState, bool, error)) (*sessionsapi.SessionState, bool, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*refreshCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-c.done
+		if c.session == nil {
+			return nil, c.refreshed, c.err
+		}
+		session := *c.session
+		return &session, c.refreshed, c.err
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mutex.Unlock()
+
+	session, refreshed, err := fn()
+	if session != nil {
+		// The caller goes on to modify its session
+		result := *session
+		c.session = &result
+	}
+	c.refreshed, c.err = refreshed, err
+	close(c.done)
+
+	forget := func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+	}
+	if refreshed && err == nil {
+		time.AfterFunc(refreshResultExpiration, forget)
+	} else {
+		forget()
+	}
+	return session, refreshed, err
+}
+
+// refreshSession refreshes the session with the provider if needed. It
+// returns the session to continue with, whether it was refreshed and has to
+// be saved, and a func to call once it was saved.
+//
+// Concurrent refreshes of the same session are serialized, as with
+// providers rotating refresh tokens all but the first would fail. Within
+// the process the requests losing the race get the session refreshed by
+// the first. With a sessionsapi.LockingSessionStore, instances also lock
+// the session in the store while refreshing it, and those waiting for the
+// lock reload the session once they get it. Sessions are never refreshed
+// without the lock: should it not be obtained in time, the request goes on
+// with the session as reloaded from the store if it was refreshed, or fails
+// with errSessionLocked.
+func (p *OAuthProxy) refreshSession(req *http.Request, provider providers.Provider, session *sessionsapi.SessionState) (*sessionsapi.SessionState, bool, func(), error) {
+	release := func() {}
+	refresh := func(s *sessionsapi.SessionState) (*sessionsapi.SessionState, bool, error) {
+		ctx, cancel := p.providerContext(req)
+		defer cancel()
+		refreshed, err := provider.RefreshSessionIfNeeded(ctx, s)
+		return s, refreshed, err
+	}
+	refreshLocked := func(s *sessionsapi.SessionState) (*sessionsapi.SessionState, bool, error) {
+		// The refresh must not outlive the lock
+		ctx, cancel := context.WithTimeout(req.Context(), p.refreshLockTimeout())
+		defer cancel()
+		refreshed, err := provider.RefreshSessionIfNeeded(ctx, s)
+		return s, refreshed, err
+	}
+
+	// Providers only refresh expired sessions with a refresh token, there
+	// is nothing to serialize otherwise
+	if session.RefreshToken == "" || session.ExpiresOn.After(time.Now()) {
+		s, refreshed, err := refresh(session)
+		return s, refreshed, release, err
+	}
+
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(session.RefreshToken)))
+	s, refreshed, err := p.refreshes.do(key, func() (*sessionsapi.SessionState, bool, error) {
+		store, ok := p.sessionStore.(sessionsapi.LockingSessionStore)
+		if !ok {
+			return refresh(session)
+		}
+		unlock, reloaded, locked, err := p.lockSession(req, store)
+		if err != nil {
+			return nil, false, err
+		}
+		release = unlock
+		if !locked {
+			// Another instance is still refreshing the session, redeeming
+			// its refresh token as well would fail
+			if reloaded.IsExpired() {
+				return nil, false, errSessionLocked
+			}
+			return reloaded, false, nil
+		}
+		if reloaded != nil {
+			// The session may have been refreshed while waiting for the lock
+			return refreshLocked(reloaded)
+		}
+		return refreshLocked(session)
+	})
+	return s, refreshed, release, err
+}
+
+// refreshLockTimeout is the timeout of refreshes made while holding the lock
+// of the session
+func (p *OAuthProxy) refreshLockTimeout() time.Duration {
+	if p.providerTimeout > 0 {
+		return p.providerTimeout
+	}
+	return refreshLockTimeout
+}
+
+// lockSession obtains the lock of the session of the request. When another
+// instance held it, the session is reloaded once the lock was obtained, or
+// once waiting for the lock timed out, in which case it isn't locked. The
+// returned func releases the lock.
+func (p *OAuthProxy) lockSession(req *http.Request, store sessionsapi.LockingSessionStore) (func(), *sessionsapi.SessionState, bool, error) {
+	var lock string
+	var waited bool
+	expiration := p.refreshLockTimeout() + refreshLockMargin
+	deadline := time.Now().Add(expiration)
+	for {
+		var err error
+		lock, err = store.Lock(req, expiration)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("error locking session: %v", err)
+		}
+		if lock != "" {
+			break
+		}
+		waited = true
+		if time.Now().After(deadline) {
+			// The lock would have expired by now, so another instance
+			// obtained it since
+			logger.Printf("Timed out waiting for the lock of the session, continuing without refreshing it")
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, nil, false, req.Context().Err()
+		case <-time.After(refreshLockPollInterval):
+		}
+	}
+
+	unlock := func() {
+		if lock == "" {
+			return
+		}
+		if err := store.Unlock(req, lock); err != nil {
+			logger.Printf("Error unlocking session: %v", err)
+		}
+	}
+	if !waited {
+		return unlock, nil, true, nil
+	}
+	session, err := store.Load(req)
+	if err != nil {
+		unlock()
+		return nil, nil, false, fmt.Errorf("error reloading session: %v", err)
+	}
+	return unlock, session, lock != "", nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// RotatingRefreshProvider rotates the refresh token on every refresh, and
+// fails refreshes with a refresh token that was used already
+type RotatingRefreshProvider struct {
+	*TestProvider
+	mutex        sync.Mutex
+	refreshToken string
+	refreshes    int
+}
+
+func (p *RotatingRefreshProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	// Give concurrent requests time to race
+	time.Sleep(20 * time.Millisecond)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if s.RefreshToken != p.refreshToken {
+		return false, errors.New("refresh token was used already")
+	}
+	p.refreshes++
+	p.refreshToken = fmt.Sprintf("refresh-token-%d", p.refreshes)
+	s.AccessToken = fmt.Sprintf("access-token-%d", p.refreshes)
+	s.RefreshToken = p.refreshToken
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func newRefreshTest(t *testing.T, modifiers ...OptionsModifier) (*ProcessCookieTest, *RotatingRefreshProvider) {
+	test := NewAuthOnlyEndpointTest(modifiers...)
+	provider := &RotatingRefreshProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, ""),
+		refreshToken: "refresh-token-0",
+	}
+	provider.ValidToken = true
+	test.proxy.provider = provider
+	err := test.SaveSession(&sessions.SessionState{
+		Email:        "john.doe@example.com",
+		AccessToken:  "access-token-0",
+		RefreshToken: "refresh-token-0",
+		CreatedAt:    time.Now(),
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	})
+	assert.NoError(t, err)
+	return test, provider
+}
+
+func TestRefreshGroup(t *testing.T) {
+	var group refreshGroup
+	var calls int
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, refreshed, err := group.do("key", func() (*sessions.SessionState, bool, error) {
+				calls++
+				<-start
+				return &sessions.SessionState{AccessToken: "refreshed"}, true, nil
+			})
+			assert.NoError(t, err)
+			assert.True(t, refreshed)
+			assert.Equal(t, "refreshed", session.AccessToken)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(start)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+
+	// The refreshed session is handed to late requests too
+	session, refreshed, err := group.do("key", func() (*sessions.SessionState, bool, error) {
+		calls++
+		return nil, false, errors.New("refresh token was used already")
+	})
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, "refreshed", session.AccessToken)
+	assert.Equal(t, 1, calls)
+}
+
+func TestConcurrentRequestsRefreshSessionOnce(t *testing.T) {
+	test, provider := newRefreshTest(t)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+			for _, cookie := range test.req.Cookies() {
+				req.AddCookie(cookie)
+			}
+			test.proxy.ServeHTTP(rw, req)
+			codes[i] = rw.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusAccepted, code)
+	}
+	assert.Equal(t, 1, provider.refreshes)
+}
+
+// LockedSessionStore simulates another instance of the proxy refreshing
+// the session while holding its lock
+type LockedSessionStore struct {
+	sessions.SessionStore
+	// refreshElsewhere is called when the lock is first asked for
+	refreshElsewhere func(req *http.Request)
+	// held keeps the lock from being obtained
+	held    bool
+	locks   int
+	unlocks int
+}
+
+func (s *LockedSessionStore) Lock(req *http.Request, expiration time.Duration) (string, error) {
+	s.locks++
+	if s.held {
+		return "", nil
+	}
+	if s.locks == 1 {
+		s.refreshElsewhere(req)
+		return "", nil
+	}
+	return "lock", nil
+}
+
+func (s *LockedSessionStore) Unlock(req *http.Request, lock string) error {
+	s.unlocks++
+	return nil
+}
+
+func TestRefreshSessionReloadsSessionRefreshedByOtherInstance(t *testing.T) {
+	test, provider := newRefreshTest(t, func(opts *Options) {
+		opts.SessionOptions.Type = "memory"
+	})
+	defer test.proxy.sessionStore.(io.Closer).Close()
+	store := &LockedSessionStore{SessionStore: test.proxy.sessionStore}
+	store.refreshElsewhere = func(req *http.Request) {
+		session, err := store.Load(req)
+		assert.NoError(t, err)
+		_, err = provider.RefreshSessionIfNeeded(context.Background(), session)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Save(httptest.NewRecorder(), req, session))
+	}
+	test.proxy.sessionStore = store
+
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	// Refreshed once, by the other instance
+	assert.Equal(t, 1, provider.refreshes)
+	assert.Equal(t, 2, store.locks)
+	assert.Equal(t, 1, store.unlocks)
+}
+
+func TestRefreshSessionDoesNotRefreshWithoutLock(t *testing.T) {
+	defer func(margin time.Duration) { refreshLockMargin = margin }(refreshLockMargin)
+	refreshLockMargin = 10 * time.Millisecond
+
+	test, provider := newRefreshTest(t, func(opts *Options) {
+		opts.SessionOptions.Type = "memory"
+		opts.ProviderTimeout = 10 * time.Millisecond
+	})
+	defer test.proxy.sessionStore.(io.Closer).Close()
+	// Another instance holds the lock for longer than its expiration
+	store := &LockedSessionStore{SessionStore: test.proxy.sessionStore, held: true}
+	test.proxy.sessionStore = store
+
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	// The session isn't cleared, and its refresh token isn't redeemed
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, 0, provider.refreshes)
+	assert.True(t, store.locks > 1)
+	assert.Equal(t, 0, store.unlocks)
+	for _, c := range rw.Result().Cookies() {
+		assert.NotEqual(t, test.proxy.CookieName, c.Name)
+	}
+}
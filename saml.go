@@ -0,0 +1,132 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/msepp/oauth2_proxy/v4/pkg/logger"
+	"github.com/msepp/oauth2_proxy/v4/providers"
+)
+
+// samlProvider is implemented by providers whose logins are completed by the
+// SAML assertion consumer service instead of the OAuth callback
+type samlProvider interface {
+	providers.Provider
+	SessionFromResponse(samlResponse, state string) (*sessions.SessionState, error)
+	Metadata() []byte
+}
+
+// samlRepostTemplate posts the SAML response to the assertion consumer
+// service once more. The response is posted cross-site by the identity
+// provider, so browsers may leave out the CSRF cookie, but they send it
+// along with this same-site post.
+var samlRepostTemplate = template.Must(template.New("saml_repost").Parse(`<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Signing in</title>
+</head>
+<body onload="document.forms[0].submit()">
+	<form method="POST" action="{{.Action}}">
+		<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}">
+		<input type="hidden" name="RelayState" value="{{.RelayState}}">
+		<input type="hidden" name="repost" value="1">
+		<noscript><button type="submit">Continue</button></noscript>
+	</form>
+</body>
+</html>`))
+
+// SAMLMetadata serves the metadata of the SAML service provider selected by
+// the provider parameter, for registering it with the identity provider
+func (p *OAuthProxy) SAMLMetadata(rw http.ResponseWriter, req *http.Request) {
+	provider, _, ok := p.getProvider(req.FormValue("provider"))
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	sp, ok := provider.(samlProvider)
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/samlmetadata+xml")
+	rw.Write(sp.Metadata())
+}
+
+// SAMLACS is the assertion consumer service, which completes SAML logins
+// with the response posted by the identity provider. The relay state is the
+// state of the login.
+func (p *OAuthProxy) SAMLACS(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		p.ErrorPage(rw, http.StatusMethodNotAllowed, "Method Not Allowed", "Method Not Allowed")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		logger.Printf("Error while parsing SAML response: %s", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	samlResponse, relayState := req.PostForm.Get("SAMLResponse"), req.PostForm.Get("RelayState")
+	if !p.hasCSRFCookie(req) && req.PostForm.Get("repost") == "" {
+		p.repostSAMLResponse(rw, samlResponse, relayState)
+		return
+	}
+
+	state, csrfCookie, ok := p.checkLoginState(rw, req, relayState, "SAML")
+	if !ok {
+		return
+	}
+	provider, validator, ok := p.getProvider(state.ProviderID)
+	if !ok {
+		logger.Printf("Error while parsing SAML response: unknown provider %q", state.ProviderID)
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		return
+	}
+	sp, ok := provider.(samlProvider)
+	if !ok {
+		logger.Printf("Error while parsing SAML response: provider %q is not a SAML provider", state.ProviderID)
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		return
+	}
+
+	session, err := sp.SessionFromResponse(samlResponse, relayState)
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via SAML: %s", err)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid SAML response")
+		return
+	}
+
+	p.completeLogin(rw, req, state, csrfCookie, provider, validator, session, "SAML")
+}
+
+// hasCSRFCookie returns whether the request carries the CSRF cookie of any
+// login flow
+func (p *OAuthProxy) hasCSRFCookie(req *http.Request) bool {
+	for _, c := range req.Cookies() {
+		if c.Name == p.CSRFCookieName || strings.HasPrefix(c.Name, p.CSRFCookieName+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// repostSAMLResponse serves a page posting the SAML response to the
+// assertion consumer service again, see samlRepostTemplate
+func (p *OAuthProxy) repostSAMLResponse(rw http.ResponseWriter, samlResponse, relayState string) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	err := samlRepostTemplate.Execute(rw, struct {
+		Action       string
+		SAMLResponse string
+		RelayState   string
+	}{
+		Action:       p.SAMLACSPath,
+		SAMLResponse: samlResponse,
+		RelayState:   relayState,
+	})
+	if err != nil {
+		logger.Printf("Error rendering SAML repost template: %s", err.Error())
+	}
+}
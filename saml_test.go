@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msepp/oauth2_proxy/v4/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// SAMLTestProvider accepts the SAML response "valid" of the login with the
+// state it last started
+type SAMLTestProvider struct {
+	*TestProvider
+	state string
+}
+
+func (p *SAMLTestProvider) GetLoginURL(redirectURI, state string, extraParams url.Values) string {
+	p.state = state
+	return "https://idp.example.com/sso?RelayState=" + url.QueryEscape(state)
+}
+
+func (p *SAMLTestProvider) SessionFromResponse(samlResponse, state string) (*sessions.SessionState, error) {
+	if samlResponse != "valid" || state != p.state {
+		return nil, errors.New("invalid response")
+	}
+	return &sessions.SessionState{Email: p.EmailAddress, User: "jdoe"}, nil
+}
+
+func (p *SAMLTestProvider) Metadata() []byte {
+	return []byte("<md:EntityDescriptor/>")
+}
+
+func newSAMLTestProxy(t *testing.T) (*OAuthProxy, *SAMLTestProvider) {
+	proxy := newLoginStateTestProxy(t)
+	provider := &SAMLTestProvider{TestProvider: proxy.provider.(*TestProvider)}
+	proxy.provider = provider
+	return proxy, provider
+}
+
+// startSAMLLogin starts a login and returns its relay state and CSRF cookie
+func startSAMLLogin(t *testing.T, proxy *OAuthProxy) (string, *http.Cookie) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Fprivate", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.NoError(t, err)
+	cookies := rw.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	return loginURL.Query().Get("RelayState"), cookies[0]
+}
+
+func postSAMLResponse(proxy *OAuthProxy, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	proxy, _ := newSAMLTestProxy(t)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/saml/metadata", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/samlmetadata+xml", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "<md:EntityDescriptor/>", rw.Body.String())
+
+	// There is no metadata without a SAML provider
+	proxy = newLoginStateTestProxy(t)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestSAMLACS(t *testing.T) {
+	proxy, _ := newSAMLTestProxy(t)
+	relayState, csrfCookie := startSAMLLogin(t, proxy)
+
+	rw := postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}}, csrfCookie)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/private", rw.Header().Get("Location"))
+	req, _ := http.NewRequest("GET", "/private", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, err := proxy.LoadCookiedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+
+	// The login is completed only once
+	rw = postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}, "repost": {"1"}})
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSAMLACSRejectsInvalidLogins(t *testing.T) {
+	proxy, _ := newSAMLTestProxy(t)
+	relayState, csrfCookie := startSAMLLogin(t, proxy)
+	otherRelayState, otherCSRFCookie := startSAMLLogin(t, proxy)
+
+	// The response is only accepted for the login it was requested for
+	rw := postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}}, csrfCookie)
+	assert.Equal(t, 403, rw.Code)
+	rw = postSAMLResponse(proxy, url.Values{"SAMLResponse": {"invalid"}, "RelayState": {otherRelayState}}, otherCSRFCookie)
+	assert.Equal(t, 403, rw.Code)
+	rw = postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {"state"}}, otherCSRFCookie)
+	assert.Equal(t, 500, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/saml/acs", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 405, rw.Code)
+}
+
+func TestSAMLACSReposts(t *testing.T) {
+	proxy, _ := newSAMLTestProxy(t)
+	relayState, csrfCookie := startSAMLLogin(t, proxy)
+
+	// The cross-site post of the identity provider may come without the
+	// CSRF cookie, it is posted again same-site
+	rw := postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}})
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `action="/oauth2/saml/acs"`)
+	assert.Contains(t, rw.Body.String(), `name="SAMLResponse" value="valid"`)
+	assert.Contains(t, rw.Body.String(), `name="repost" value="1"`)
+	assert.Empty(t, rw.Result().Cookies())
+
+	rw = postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}, "repost": {"1"}}, csrfCookie)
+	assert.Equal(t, 302, rw.Code)
+
+	// Reposts without the cookie are not reposted again
+	relayState, _ = startSAMLLogin(t, proxy)
+	rw = postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}, "repost": {"1"}})
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSAMLACSExpiredLogin(t *testing.T) {
+	proxy, _ := newSAMLTestProxy(t)
+	proxy.maxLoginDuration = time.Nanosecond
+	relayState, csrfCookie := startSAMLLogin(t, proxy)
+	time.Sleep(time.Millisecond)
+	rw := postSAMLResponse(proxy, url.Values{"SAMLResponse": {"valid"}, "RelayState": {relayState}}, csrfCookie)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Login expired")
+}
@@ -116,7 +116,11 @@ func getTemplates() *template.Template {
 	{{ if .SignInMessage }}
 	<p>{{.SignInMessage}}</p>
 	{{ end}}
+	{{ range .Providers }}
+	<button type="submit" class="btn" name="provider" value="{{.ID}}">Sign in with {{.Name}}</button><br/>
+	{{ else }}
 	<button type="submit" class="btn">Sign in with {{.ProviderName}}</button><br/>
+	{{ end }}
 	</form>
 	</div>
 